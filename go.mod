@@ -1,8 +1,20 @@
 module udpdemo
 
-go 1.14
+go 1.21
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/libp2p/go-reuseport v0.0.2
 	github.com/marcusolsson/tui-go v0.4.0
 )
+
+require (
+	github.com/gdamore/encoding v0.0.0-20151215212835-b23993cbb635 // indirect
+	github.com/gdamore/tcell v1.1.0 // indirect
+	github.com/lucasb-eyer/go-colorful v0.0.0-20180709185858-c7842319cf3a // indirect
+	github.com/mattn/go-runewidth v0.0.3 // indirect
+	github.com/mitchellh/go-wordwrap v1.0.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/sys v0.0.0-20190228124157-a34e9553db1e // indirect
+	golang.org/x/text v0.3.0 // indirect
+)
@@ -0,0 +1,151 @@
+// Package logging 客户端和服务器共用的分级结构化日志，基于log/slog
+// 每个模块用New(component)拿一个logger，输出时带component字段
+// Init之前的日志和标准库log的输出也走同一个handler
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Options 日志配置，File为空时丢弃日志，不能写到stdout，会破坏终端界面
+type Options struct {
+	File       string
+	Level      string // debug/info/warn/error
+	Format     string // logfmt/json
+	MaxSize    int64  // 单个文件最大字节数，超过后轮转，0不轮转
+	MaxBackups int    // 保留几个旧文件
+}
+
+var (
+	level   = new(slog.LevelVar)
+	current atomic.Value // handlerBox，atomic.Value要求类型一致，text和json的handler类型不同
+
+	lock   sync.Mutex
+	output io.Closer
+)
+
+func init() {
+	current.Store(handlerBox{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})})
+	// 标准库log的输出（包括第三方库）也走handler
+	slog.SetDefault(slog.New(rootHandler{}))
+}
+
+// ParseLevel debug/info/warn/error，不区分大小写
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return l, fmt.Errorf("bad log level: %s", s)
+	}
+	return l, nil
+}
+
+// SetLevel 运行时修改级别
+func SetLevel(s string) error {
+	l, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// Init 打开日志文件，替换之前的输出，可以重复调用
+func Init(opts Options) error {
+	if err := SetLevel(opts.Level); err != nil {
+		return err
+	}
+
+	var w io.Writer = io.Discard
+	var closer io.Closer
+	if len(opts.File) > 0 {
+		rw, err := NewRotateWriter(opts.File, opts.MaxSize, opts.MaxBackups)
+		if err != nil {
+			return err
+		}
+		w, closer = rw, rw
+	}
+
+	hopts := &slog.HandlerOptions{Level: level, AddSource: true, ReplaceAttr: stringer}
+	var h slog.Handler
+	switch opts.Format {
+	case "", "logfmt":
+		h = slog.NewTextHandler(w, hopts)
+	case "json":
+		h = slog.NewJSONHandler(w, hopts)
+	default:
+		if closer != nil {
+			closer.Close()
+		}
+		return fmt.Errorf("bad log format: %s", opts.Format)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	current.Store(handlerBox{h})
+	if output != nil {
+		output.Close()
+	}
+	output = closer
+	return nil
+}
+
+// stringer 地址之类实现了String的值按字符串输出，json里不展开成对象
+func stringer(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindAny {
+		if s, ok := a.Value.Any().(fmt.Stringer); ok {
+			a.Value = slog.StringValue(s.String())
+		}
+	}
+	return a
+}
+
+// New 模块的logger
+func New(component string) *slog.Logger {
+	return slog.New(rootHandler{}).With("component", component)
+}
+
+type handlerBox struct {
+	h slog.Handler
+}
+
+// rootHandler 每次写日志时取当前的handler，Init之前创建的logger也会用上新的配置
+type rootHandler struct {
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h rootHandler) handler() slog.Handler {
+	handler := current.Load().(handlerBox).h
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	return handler
+}
+
+func (h rootHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= level.Level()
+}
+
+func (h rootHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h rootHandler) with(op func(slog.Handler) slog.Handler) rootHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return rootHandler{ops: append(ops, op)}
+}
+
+func (h rootHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h rootHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
@@ -0,0 +1,64 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 帧格式：type(1) streamID(4) seq(4) ack(4) wnd(2) payload
+// data/fin帧按seq编号，保证有序；ack为期望收到的下一个seq，wnd为接收方还能缓存的帧数
+const (
+	frameData byte = iota + 1
+	frameFin
+	frameAck
+	frameRst
+
+	headerSize = 15
+
+	// MaxPayload 每帧最大负载，加上头部和前缀不超过一个UDP包
+	MaxPayload = 1200
+)
+
+type frame struct {
+	typ    byte
+	stream uint32
+	seq    uint32
+	ack    uint32
+	wnd    uint16
+	data   []byte
+}
+
+func (f *frame) marshal() []byte {
+	b := make([]byte, headerSize+len(f.data))
+	b[0] = f.typ
+	binary.BigEndian.PutUint32(b[1:], f.stream)
+	binary.BigEndian.PutUint32(b[5:], f.seq)
+	binary.BigEndian.PutUint32(b[9:], f.ack)
+	binary.BigEndian.PutUint16(b[13:], f.wnd)
+	copy(b[headerSize:], f.data)
+	return b
+}
+
+func unmarshalFrame(b []byte) (*frame, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("frame too short: %d", len(b))
+	}
+	f := &frame{
+		typ:    b[0],
+		stream: binary.BigEndian.Uint32(b[1:]),
+		seq:    binary.BigEndian.Uint32(b[5:]),
+		ack:    binary.BigEndian.Uint32(b[9:]),
+		wnd:    binary.BigEndian.Uint16(b[13:]),
+	}
+	if f.typ < frameData || f.typ > frameRst {
+		return nil, fmt.Errorf("unknown frame type: %d", f.typ)
+	}
+	if len(b) > headerSize {
+		if len(b)-headerSize > MaxPayload {
+			return nil, fmt.Errorf("frame too long: %d", len(b))
+		}
+		f.data = make([]byte, len(b)-headerSize)
+		copy(f.data, b[headerSize:])
+	}
+	return f, nil
+}
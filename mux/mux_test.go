@@ -0,0 +1,256 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"udpdemo/netsim"
+)
+
+// newPair 模拟网络上的两个会话，a打开的流由b接收
+func newPair(t *testing.T, n *netsim.Network) (a, b *Session) {
+	t.Helper()
+	ca, err := n.Listen("1.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := n.Listen("1.0.0.2:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = NewSession(ca, cb.LocalAddr(), true, nil)
+	b = NewSession(cb, ca.LocalAddr(), false, nil)
+	for _, p := range []struct {
+		conn *netsim.Conn
+		sess *Session
+	}{{ca, a}, {cb, b}} {
+		p := p
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, _, err := p.conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				p.sess.Input(buf[:n])
+			}
+		}()
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+		ca.Close()
+		cb.Close()
+	})
+	return a, b
+}
+
+func randData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func streamCount(s *Session) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// waitRemoved 等到会话里没有流
+func waitRemoved(t *testing.T, s *Session) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for streamCount(s) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams left in session", streamCount(s))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// transfer a向b发送data再关闭，b收完后也关闭，两边的流都应该从会话里删掉
+func transfer(t *testing.T, a, b *Session, data []byte) {
+	t.Helper()
+	sa, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sa.Write(data)
+		if err == nil {
+			err = sa.Close()
+		}
+		errc <- err
+	}()
+
+	sb, err := b.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	sb.Close()
+	waitRemoved(t, a)
+	waitRemoved(t, b)
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name    string
+		loss    float64
+		latency time.Duration
+		jitter  time.Duration
+	}{
+		{"clean", 0, 0, 0},
+		{"loss", 0.1, time.Millisecond, 0},
+		{"reorder", 0, time.Millisecond, 10 * time.Millisecond},
+		{"loss+reorder", 0.1, time.Millisecond, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			n := netsim.New(1)
+			a, b := newPair(t, n)
+			n.SetLoss(tt.loss)
+			n.SetLatency(tt.latency)
+			n.SetJitter(tt.jitter)
+			transfer(t, a, b, randData(t, 256*1024))
+			if tt.loss > 0 && n.Drops()[netsim.DropLoss] == 0 {
+				t.Fatal("no packet lost")
+			}
+		})
+	}
+}
+
+// TestSeqWrap seq从接近2^32开始，传输过程中回绕
+func TestSeqWrap(t *testing.T) {
+	initSeq = 1<<32 - 100
+	defer func() { initSeq = 0 }()
+
+	n := netsim.New(1)
+	a, b := newPair(t, n)
+	n.SetLoss(0.05)
+	n.SetLatency(time.Millisecond)
+	n.SetJitter(5 * time.Millisecond)
+	transfer(t, a, b, randData(t, 300*MaxPayload))
+}
+
+// TestWindowStall 接收方不读时发送方按窗口停下来，读走之后继续，不会因为探测被丢弃而断开
+func TestWindowStall(t *testing.T) {
+	n := netsim.New(1)
+	a, b := newPair(t, n)
+	data := randData(t, 4*maxRecvBuf)
+
+	sa, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.SetWriteDeadline(time.Now().Add(time.Second))
+	written, err := sa.Write(data)
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("write to stalled stream: %d %v", written, err)
+	}
+	if written >= len(data) {
+		t.Fatalf("wrote %d bytes without reader", written)
+	}
+
+	sb, err := b.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.lock.Lock()
+	buffered := sb.rcvBuf.Len()
+	sb.lock.Unlock()
+	if buffered > maxRecvBuf {
+		t.Fatalf("receiver buffered %d bytes, window %d", buffered, maxRecvBuf)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		sa.SetWriteDeadline(time.Time{})
+		_, err := sa.Write(data[written:])
+		if err == nil {
+			err = sa.Close()
+		}
+		errc <- err
+	}()
+	sb.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := ioutil.ReadAll(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHalfClosedRemoved 对端读完不关闭，本端的流在finTimeout之后删掉，对端收到rst也删掉
+func TestHalfClosedRemoved(t *testing.T) {
+	n := netsim.New(1)
+	a, b := newPair(t, n)
+
+	sa, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa.Write([]byte("hello"))
+	sa.Close()
+	sb, err := b.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := ioutil.ReadAll(sb); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q %v", got, err)
+	}
+
+	// 等fin确认之后假装对端已经安静了finTimeout
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sa.lock.Lock()
+		acked := len(sa.sndQueue) == 0
+		if acked {
+			sa.lastRecv = time.Now().Add(-finTimeout)
+		}
+		sa.lock.Unlock()
+		if acked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("fin not acked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitRemoved(t, a)
+	waitRemoved(t, b)
+	if _, err := sb.Write([]byte("late")); !errors.Is(err, ErrStreamReset) {
+		t.Fatalf("write after peer removed: %v", err)
+	}
+	if _, err := sa.Read(make([]byte, 1)); err != io.EOF && !errors.Is(err, ErrTimeout) {
+		t.Fatalf("read after removed: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+// Package mux 在已经打洞的UDP通路上复用多个可靠有序的流，每个流实现net.Conn，带流量控制和拥塞控制
+// 每个对端一个Session，直接复用打洞用的net.PacketConn发送，帧前面加上prefix；
+// 读PacketConn的一方负责分流，把去掉prefix的帧通过Input交给对应的Session，
+// 这样服务器消息、聊天、文件传输和流可以共用一个NAT映射
+package mux
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"udpdemo/logging"
+)
+
+const (
+	maxRetries   = 20 // 单帧重传次数，超过则认为对端断开
+	tickInterval = 20 * time.Millisecond
+
+	acceptBacklog = 16
+	closedKeep    = time.Minute // 关闭的流ID保留时间，用于识别迟到的帧
+)
+
+var logger = logging.New("mux")
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+	ErrTimeout       = errors.New("mux: peer not responding")
+)
+
+type Session struct {
+	conn   net.PacketConn
+	remote net.Addr
+	prefix []byte
+
+	lock     sync.Mutex
+	streams  map[uint32]*Stream
+	closedID map[uint32]time.Time
+	nextID   uint32
+	isClosed bool
+
+	acceptChan chan *Stream
+	die        chan struct{}
+}
+
+// NewSession 两端的initiator必须不同，用于划分流ID空间，避免同时打开的流ID冲突
+// conn由调用方负责读取和关闭
+func NewSession(conn net.PacketConn, remote net.Addr, initiator bool, prefix []byte) *Session {
+	s := &Session{
+		conn:       conn,
+		remote:     remote,
+		prefix:     prefix,
+		streams:    make(map[uint32]*Stream),
+		closedID:   make(map[uint32]time.Time),
+		acceptChan: make(chan *Stream, acceptBacklog),
+		die:        make(chan struct{}),
+	}
+	if initiator {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	go s.tickLoop()
+	return s
+}
+
+// isLocalID 本端打开的流ID和nextID奇偶相同
+func (s *Session) isLocalID(id uint32) bool {
+	return id%2 == s.nextID%2
+}
+
+func (s *Session) OpenStream() (*Stream, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed {
+		return nil, ErrSessionClosed
+	}
+	st := newStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID += 2
+	return st, nil
+}
+
+// Open 打开一个流，返回net.Conn
+func (s *Session) Open() (net.Conn, error) {
+	return s.OpenStream()
+}
+
+// Accept 实现net.Listener
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Addr 实现net.Listener
+func (s *Session) Addr() net.Addr {
+	return s.LocalAddr()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.acceptChan:
+		return st, nil
+	case <-s.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Input 处理一个收到的帧
+func (s *Session) Input(b []byte) error {
+	f, err := unmarshalFrame(b)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	if s.isClosed {
+		s.lock.Unlock()
+		return ErrSessionClosed
+	}
+	st, ok := s.streams[f.stream]
+	if !ok {
+		// 迟到的ack和rst直接丢弃，已关闭或者不存在的本端流回复rst
+		if f.typ == frameAck || f.typ == frameRst {
+			s.lock.Unlock()
+			return nil
+		}
+		if _, closed := s.closedID[f.stream]; closed || s.isLocalID(f.stream) {
+			s.lock.Unlock()
+			s.writeFrame(&frame{typ: frameRst, stream: f.stream})
+			return nil
+		}
+		st = newStream(s, f.stream)
+		select {
+		case s.acceptChan <- st:
+			s.streams[st.id] = st
+		default:
+			s.lock.Unlock()
+			logger.Warn("accept backlog full, reset stream", "stream", f.stream)
+			s.writeFrame(&frame{typ: frameRst, stream: f.stream})
+			return nil
+		}
+	}
+	s.lock.Unlock()
+
+	st.input(f)
+	return nil
+}
+
+func (s *Session) writeFrame(f *frame) {
+	b := append(append(make([]byte, 0, len(s.prefix)+headerSize+len(f.data)), s.prefix...), f.marshal()...)
+	if _, err := s.conn.WriteTo(b, s.remote); err != nil {
+		logger.Error("send frame fail", "err", err)
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+	s.closedID[id] = time.Now()
+}
+
+func (s *Session) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.die:
+			return
+		}
+
+		s.lock.Lock()
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		for id, t := range s.closedID {
+			if time.Since(t) > closedKeep {
+				delete(s.closedID, id)
+			}
+		}
+		s.lock.Unlock()
+
+		for _, st := range streams {
+			st.tick()
+		}
+	}
+}
+
+// Close 关闭会话和所有的流，不通知对端
+func (s *Session) Close() error {
+	s.lock.Lock()
+	if s.isClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.isClosed = true
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.die)
+	s.lock.Unlock()
+
+	for _, st := range streams {
+		st.abort(ErrSessionClosed)
+	}
+	return nil
+}
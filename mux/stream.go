@@ -0,0 +1,455 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxSendQueue = 256          // 发送缓存的帧数，满了Write阻塞
+	maxRecvBuf   = 256 * 1024   // 接收缓存字节数，决定通告给对端的窗口
+	maxRecvAhead = maxSendQueue // 最多缓存超前多少个乱序帧
+
+	initCwnd       = 4
+	initSsthresh   = 64
+	dupAckResend   = 3 // 收到几个重复ack触发快速重传
+	initRTO        = 300 * time.Millisecond
+	minRTO         = 100 * time.Millisecond
+	maxRTO         = 3 * time.Second
+	windowUpdateAt = maxRecvBuf / 4 // 读走这么多数据后主动通告窗口
+
+	finTimeout = time.Minute // 本端的fin确认之后，对端这么久没有任何帧就删掉流
+)
+
+// initSeq 双方的初始seq，测试时改成接近回绕的值
+var initSeq uint32
+
+// seqLess seq按序列号算术比较，回绕之后仍然正确，两个seq相差不能超过2^31
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type segment struct {
+	f       *frame
+	sentAt  time.Time // 为零表示还没发送
+	retries int
+}
+
+// timeoutError 超过读写deadline时返回，实现net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Stream 一个可靠有序的双向字节流，实现net.Conn
+// Close只关闭写方向，读到对端的fin后返回io.EOF
+// 发送端按min(拥塞窗口, 对端通告窗口)控制在途帧数，拥塞窗口为慢启动+拥塞避免，
+// 超时重传时窗口降为1，收到重复ack时快速重传并减半
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// 发送
+	sndNext  uint32     // 下一个分配的seq
+	sndQueue []*segment // 未确认的帧，按seq排序
+	sndFin   bool
+	peerWnd  uint32 // 对端通告的窗口，单位帧
+	cwnd     float64
+	ssthresh float64
+	dupAcks  int
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	timeouts int // 连续超时次数，收到对端的任何帧就清零
+
+	// 接收
+	rcvNext    uint32
+	rcvBuf     bytes.Buffer
+	ooo        map[uint32]*frame // 乱序到达的帧
+	rcvFin     bool
+	advWnd     uint16 // 上次通告的窗口
+	readSinceA int    // 上次通告窗口之后读走的字节数
+	lastRecv   time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+
+	err error // 流异常结束的原因
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	st := &Stream{
+		id:       id,
+		sess:     sess,
+		sndNext:  initSeq,
+		rcvNext:  initSeq,
+		ooo:      make(map[uint32]*frame),
+		peerWnd:  initSsthresh,
+		cwnd:     initCwnd,
+		ssthresh: initSsthresh,
+		rto:      initRTO,
+		lastRecv: time.Now(),
+	}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for st.rcvBuf.Len() == 0 {
+		if st.rcvFin {
+			return 0, io.EOF
+		}
+		if st.err != nil {
+			return 0, st.err
+		}
+		if deadlineExceeded(st.readDeadline) {
+			return 0, timeoutError{}
+		}
+		st.cond.Wait()
+	}
+	n, _ := st.rcvBuf.Read(p)
+
+	// 窗口从很小重新打开时主动通告，避免对端一直等重传超时
+	st.readSinceA += n
+	if st.readSinceA >= windowUpdateAt || (st.advWnd == 0 && st.recvWindow() > 0) {
+		st.sendAck()
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for len(st.sndQueue) >= maxSendQueue && st.err == nil && !deadlineExceeded(st.writeDeadline) {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			return written, st.err
+		}
+		if deadlineExceeded(st.writeDeadline) {
+			return written, timeoutError{}
+		}
+		if st.sndFin {
+			return written, io.ErrClosedPipe
+		}
+		n := len(p) - written
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		data := make([]byte, n)
+		copy(data, p[written:written+n])
+		st.enqueue(&frame{typ: frameData, data: data})
+		written += n
+		st.flush()
+	}
+	return written, nil
+}
+
+// Close 发送fin，已经写入的数据仍然会可靠送达
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.sndFin || st.err != nil {
+		return nil
+	}
+	st.sndFin = true
+	st.enqueue(&frame{typ: frameFin})
+	st.flush()
+	return nil
+}
+
+// Reset 立即中断流并通知对端
+func (st *Stream) Reset() {
+	st.sess.writeFrame(&frame{typ: frameRst, stream: st.id})
+	st.abort(ErrStreamReset)
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.readDeadline = t
+	st.readTimer = st.resetTimer(st.readTimer, t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.writeDeadline = t
+	st.writeTimer = st.resetTimer(st.writeTimer, t)
+	return nil
+}
+
+// resetTimer 到期时唤醒阻塞的读写，需要持有锁
+func (st *Stream) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	st.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		st.lock.Lock()
+		st.cond.Broadcast()
+		st.lock.Unlock()
+	})
+}
+
+func (st *Stream) abort(err error) {
+	st.lock.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.sndQueue = nil
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	st.sess.removeStream(st.id)
+}
+
+func (st *Stream) enqueue(f *frame) {
+	f.stream = st.id
+	f.seq = st.sndNext
+	st.sndNext++
+	st.sndQueue = append(st.sndQueue, &segment{f: f})
+}
+
+// recvWindow 还能接收的帧数，需要持有锁
+func (st *Stream) recvWindow() uint16 {
+	free := maxRecvBuf - st.rcvBuf.Len()
+	if free <= 0 {
+		return 0
+	}
+	return uint16(free / MaxPayload)
+}
+
+// writeSegment 发送帧，捎带ack和窗口，需要持有锁
+func (st *Stream) writeSegment(seg *segment) {
+	seg.f.ack = st.rcvNext
+	seg.f.wnd = st.recvWindow()
+	st.advWnd = seg.f.wnd
+	st.readSinceA = 0
+	seg.sentAt = time.Now()
+	st.sess.writeFrame(seg.f)
+}
+
+// sendAck 需要持有锁
+func (st *Stream) sendAck() {
+	st.advWnd = st.recvWindow()
+	st.readSinceA = 0
+	st.sess.writeFrame(&frame{typ: frameAck, stream: st.id, ack: st.rcvNext, wnd: st.advWnd})
+}
+
+// sendWindow 允许的在途帧数，对端窗口为0时仍允许1帧作为探测
+func (st *Stream) sendWindow() int {
+	w := int(st.cwnd)
+	if int(st.peerWnd) < w {
+		w = int(st.peerWnd)
+	}
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// flush 在窗口允许的范围内发送还没发送的帧，需要持有锁
+func (st *Stream) flush() {
+	inflight := 0
+	for _, seg := range st.sndQueue {
+		if seg.sentAt.IsZero() {
+			if inflight >= st.sendWindow() {
+				return
+			}
+			st.writeSegment(seg)
+		}
+		inflight++
+	}
+}
+
+// tick 最早的未确认帧超时则重传，窗口降为1，其余在途帧等待重新发送
+// 本端已经关闭并且fin被确认了，对端迟迟不发fin也不发数据时删掉流，避免半关闭的流一直留在会话里
+func (st *Stream) tick() {
+	st.lock.Lock()
+	if st.sndFin && len(st.sndQueue) == 0 && st.err == nil && time.Since(st.lastRecv) > finTimeout {
+		st.lock.Unlock()
+		st.sess.writeFrame(&frame{typ: frameRst, stream: st.id})
+		st.abort(ErrTimeout)
+		return
+	}
+	if len(st.sndQueue) == 0 || st.sndQueue[0].sentAt.IsZero() || time.Since(st.sndQueue[0].sentAt) < st.rto {
+		st.lock.Unlock()
+		return
+	}
+
+	first := st.sndQueue[0]
+	first.retries++
+	// 对端窗口为0时重传的探测帧会被丢掉，但是对端还在回复ack，不算断开
+	st.timeouts++
+	if st.timeouts > maxRetries {
+		st.lock.Unlock()
+		st.sess.writeFrame(&frame{typ: frameRst, stream: st.id})
+		st.abort(ErrTimeout)
+		return
+	}
+	st.ssthresh = st.cwnd / 2
+	if st.ssthresh < 2 {
+		st.ssthresh = 2
+	}
+	st.cwnd = 1
+	st.dupAcks = 0
+	st.rto *= 2
+	if st.rto > maxRTO {
+		st.rto = maxRTO
+	}
+	for _, seg := range st.sndQueue[1:] {
+		seg.sentAt = time.Time{}
+	}
+	st.writeSegment(first)
+	st.lock.Unlock()
+}
+
+func (st *Stream) input(f *frame) {
+	if f.typ == frameRst {
+		st.abort(ErrStreamReset)
+		return
+	}
+
+	st.lock.Lock()
+	st.lastRecv = time.Now()
+	st.timeouts = 0
+	st.handleAck(f)
+	if f.typ == frameData || f.typ == frameFin {
+		// 接收缓存满了丢弃，对端按窗口0处理，超时重传相当于探测
+		fits := f.typ == frameFin || st.rcvBuf.Len()+len(f.data) <= maxRecvBuf
+		if fits && !seqLess(f.seq, st.rcvNext) && seqLess(f.seq, st.rcvNext+maxRecvAhead) {
+			st.ooo[f.seq] = f
+		}
+		for {
+			next, ok := st.ooo[st.rcvNext]
+			if !ok {
+				break
+			}
+			delete(st.ooo, st.rcvNext)
+			st.rcvNext++
+			if next.typ == frameFin {
+				st.rcvFin = true
+			} else {
+				st.rcvBuf.Write(next.data)
+			}
+		}
+		st.sendAck()
+	}
+	st.cond.Broadcast()
+	done := st.sndFin && st.rcvFin && len(st.sndQueue) == 0
+	st.lock.Unlock()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+}
+
+// handleAck 移除已确认的帧，更新rtt和拥塞窗口，需要持有锁
+func (st *Stream) handleAck(f *frame) {
+	// 确认了还没发送的seq，是错误或者伪造的帧
+	if seqLess(st.sndNext, f.ack) {
+		return
+	}
+	st.peerWnd = uint32(f.wnd)
+
+	acked := 0
+	for acked < len(st.sndQueue) && seqLess(st.sndQueue[acked].f.seq, f.ack) {
+		acked++
+	}
+	if acked == 0 {
+		// 纯ack并且没有推进，说明对端收到了乱序的帧
+		if f.typ == frameAck && len(st.sndQueue) > 0 && !st.sndQueue[0].sentAt.IsZero() && f.ack == st.sndQueue[0].f.seq {
+			st.dupAcks++
+			if st.dupAcks == dupAckResend {
+				st.ssthresh = st.cwnd / 2
+				if st.ssthresh < 2 {
+					st.ssthresh = 2
+				}
+				st.cwnd = st.ssthresh
+				st.writeSegment(st.sndQueue[0])
+			}
+		}
+		st.flush()
+		return
+	}
+
+	// 只用没有重传过的帧计算rtt
+	last := st.sndQueue[acked-1]
+	if last.retries == 0 && !last.sentAt.IsZero() {
+		st.updateRTT(time.Since(last.sentAt))
+	}
+	for i := 0; i < acked; i++ {
+		if st.cwnd < st.ssthresh {
+			st.cwnd++
+		} else {
+			st.cwnd += 1 / st.cwnd
+		}
+	}
+	if st.cwnd > maxSendQueue {
+		st.cwnd = maxSendQueue
+	}
+	st.dupAcks = 0
+	st.sndQueue = st.sndQueue[acked:]
+	st.flush()
+}
+
+// updateRTT 按RFC 6298计算rto，需要持有锁
+func (st *Stream) updateRTT(rtt time.Duration) {
+	if st.srtt == 0 {
+		st.srtt = rtt
+		st.rttvar = rtt / 2
+	} else {
+		delta := st.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		st.rttvar = (st.rttvar*3 + delta) / 4
+		st.srtt = (st.srtt*7 + rtt) / 8
+	}
+	st.rto = st.srtt + 4*st.rttvar
+	if st.rto < minRTO {
+		st.rto = minRTO
+	}
+	if st.rto > maxRTO {
+		st.rto = maxRTO
+	}
+}
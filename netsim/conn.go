@@ -0,0 +1,161 @@
+package netsim
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn 模拟网络上的UDP连接
+type Conn struct {
+	net  *Network
+	nat  *NAT // 为nil表示在公网上
+	addr *net.UDPAddr
+
+	in        chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock     sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // 修改deadline时关闭，唤醒阻塞的读
+}
+
+func newConn(n *Network, nat *NAT, addr *net.UDPAddr) *Conn {
+	return &Conn{
+		net:    n,
+		nat:    nat,
+		addr:   addr,
+		in:     make(chan packet, queueSize),
+		closed: make(chan struct{}),
+		wake:   make(chan struct{}),
+	}
+}
+
+func (c *Conn) enqueue(p packet) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	select {
+	case c.in <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadFromUDP 阻塞到收到包、超过deadline或者关闭
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.lock.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.lock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var p packet
+		var err error
+		woken := false
+		select {
+		case p = <-c.in:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			woken = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if woken {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, p.data), p.from, nil
+	}
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDP(b)
+	if addr == nil {
+		return n, nil, err
+	}
+	return n, addr, err
+}
+
+// WriteToUDP NAT后面的连接发出去的包源地址会被转换
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	to := &net.UDPAddr{IP: addr.IP.To4(), Port: addr.Port}
+	from := c.addr
+	if c.nat != nil {
+		from = c.nat.outbound(c, to)
+	}
+	c.net.send(from, to, b)
+	return len(b), nil
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if a, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	return c.WriteToUDP(b, a)
+}
+
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.net.unbind(c)
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr 监听的地址，NAT后面的是内网地址
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	c.lock.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 写不会阻塞，忽略
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var _ net.PacketConn = (*Conn)(nil)
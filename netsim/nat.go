@@ -0,0 +1,189 @@
+package netsim
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type NATType int
+
+const (
+	// FullCone 映射和目的地址无关，映射建立后任何地址都可以发进来
+	FullCone NATType = iota
+	// Restricted 映射和目的地址无关，只有内网发过包的IP可以发进来
+	Restricted
+	// PortRestricted 映射和目的地址无关，只有内网发过包的IP和端口可以发进来
+	PortRestricted
+	// Symmetric 每个目的地址一个映射，只有这个目的地址可以发进来
+	Symmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case FullCone:
+		return "full-cone"
+	case Restricted:
+		return "restricted"
+	case PortRestricted:
+		return "port-restricted"
+	case Symmetric:
+		return "symmetric"
+	}
+	return fmt.Sprintf("NATType(%d)", int(t))
+}
+
+const firstMappedPort = 40000
+
+type mapping struct {
+	conn    *Conn
+	public  *net.UDPAddr
+	allowed map[string]bool // 内网发过包的目的IP或者地址，看NAT类型
+	used    time.Time       // 最后一次往外发包的时间，只有往外发包才续期
+}
+
+type NAT struct {
+	net    *Network
+	typ    NATType
+	ip     net.IP
+	lock   sync.Mutex
+	expire time.Duration // 0不超时
+
+	conns    map[string]*Conn    // 内网地址 -> Conn
+	mappings map[string]*mapping // 内网地址（对称NAT加上目的地址） -> 映射
+	ports    map[int]*mapping    // 公网端口 -> 映射
+	nextPort int
+}
+
+func newNAT(n *Network, typ NATType, ip net.IP) *NAT {
+	return &NAT{
+		net:      n,
+		typ:      typ,
+		ip:       ip,
+		conns:    make(map[string]*Conn),
+		mappings: make(map[string]*mapping),
+		ports:    make(map[int]*mapping),
+		nextPort: firstMappedPort,
+	}
+}
+
+func (nat *NAT) Type() NATType {
+	return nat.typ
+}
+
+func (nat *NAT) IP() net.IP {
+	return nat.ip
+}
+
+// SetMappingTimeout 映射多久没有往外发包就失效，0不失效
+func (nat *NAT) SetMappingTimeout(d time.Duration) {
+	nat.lock.Lock()
+	nat.expire = d
+	nat.lock.Unlock()
+}
+
+// Reset 清空所有映射，相当于NAT重启，之后往外发包会分配新的端口
+func (nat *NAT) Reset() {
+	nat.lock.Lock()
+	nat.mappings = make(map[string]*mapping)
+	nat.ports = make(map[int]*mapping)
+	nat.lock.Unlock()
+}
+
+// Listen 在NAT后面的内网地址监听，端口为0时自动分配
+func (nat *NAT) Listen(addr string) (*Conn, error) {
+	a, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
+	if a.Port == 0 {
+		for a.Port = firstEphemeralPort; nat.conns[a.String()] != nil; a.Port++ {
+		}
+	}
+	if _, ok := nat.conns[a.String()]; ok {
+		return nil, fmt.Errorf("netsim: %s already in use", a)
+	}
+	c := newConn(nat.net, nat, a)
+	nat.conns[a.String()] = c
+	return c, nil
+}
+
+func (nat *NAT) unbind(c *Conn) {
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
+	if nat.conns[c.addr.String()] == c {
+		delete(nat.conns, c.addr.String())
+	}
+	for key, m := range nat.mappings {
+		if m.conn == c {
+			delete(nat.mappings, key)
+			delete(nat.ports, m.public.Port)
+		}
+	}
+}
+
+func (nat *NAT) expired(m *mapping, now time.Time) bool {
+	return nat.expire > 0 && now.Sub(m.used) > nat.expire
+}
+
+// outbound 内网往外发包，返回转换后的公网源地址
+func (nat *NAT) outbound(c *Conn, to *net.UDPAddr) *net.UDPAddr {
+	now := nat.net.clock()
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
+
+	key := c.addr.String()
+	if nat.typ == Symmetric {
+		key += " " + to.String()
+	}
+	m, ok := nat.mappings[key]
+	if ok && nat.expired(m, now) {
+		delete(nat.mappings, key)
+		delete(nat.ports, m.public.Port)
+		ok = false
+	}
+	if !ok {
+		m = &mapping{
+			conn:    c,
+			public:  &net.UDPAddr{IP: nat.ip, Port: nat.nextPort},
+			allowed: make(map[string]bool),
+		}
+		nat.nextPort++
+		nat.mappings[key] = m
+		nat.ports[m.public.Port] = m
+	}
+	m.used = now
+	switch nat.typ {
+	case Restricted:
+		m.allowed[to.IP.String()] = true
+	case PortRestricted, Symmetric:
+		m.allowed[to.String()] = true
+	}
+	return &net.UDPAddr{IP: m.public.IP, Port: m.public.Port}
+}
+
+// inbound 外面发到公网端口的包，返回内网的Conn，不允许时返回nil
+func (nat *NAT) inbound(port int, from *net.UDPAddr) *Conn {
+	now := nat.net.clock()
+	nat.lock.Lock()
+	defer nat.lock.Unlock()
+
+	m, ok := nat.ports[port]
+	if !ok || nat.expired(m, now) {
+		return nil
+	}
+	switch nat.typ {
+	case Restricted:
+		if !m.allowed[from.IP.String()] {
+			return nil
+		}
+	case PortRestricted, Symmetric:
+		if !m.allowed[from.String()] {
+			return nil
+		}
+	}
+	return m.conn
+}
@@ -0,0 +1,224 @@
+// Package netsim 内存里的模拟网络，用来在go test里测试打洞
+// 节点可以直接在公网上（比如服务器），也可以在模拟的NAT后面，NAT有四种：完全锥形、IP限制锥形、端口限制锥形、对称
+// 可以配置丢包率、延迟、抖动和NAT映射的超时时间，丢包用固定种子的随机数，同样的发包顺序丢的包也一样
+// 地址都是*net.UDPAddr，Conn实现了net.PacketConn，也有ReadFromUDP/WriteToUDP，可以直接替换真实的UDP连接
+package netsim
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	firstEphemeralPort = 30000
+	queueSize          = 1024 // 每个Conn最多缓存多少个包，满了丢弃
+)
+
+// 丢包原因
+const (
+	DropLoss     = "loss"     // 按丢包率随机丢弃
+	DropNoRoute  = "no_route" // 目的地址没人监听
+	DropFiltered = "filtered" // NAT没有映射或者过滤规则不允许
+	DropQueue    = "queue_full"
+)
+
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+type Network struct {
+	lock    sync.Mutex
+	rand    *rand.Rand
+	loss    float64
+	latency time.Duration
+	jitter  time.Duration
+	now     func() time.Time
+
+	public   map[string]*Conn // 公网地址 -> Conn
+	nats     map[string]*NAT  // NAT的公网IP -> NAT
+	nextPort int
+	drops    map[string]int
+}
+
+// New seed决定丢包的随机数
+func New(seed int64) *Network {
+	return &Network{
+		rand:     rand.New(rand.NewSource(seed)),
+		now:      time.Now,
+		public:   make(map[string]*Conn),
+		nats:     make(map[string]*NAT),
+		nextPort: firstEphemeralPort,
+		drops:    make(map[string]int),
+	}
+}
+
+// SetLoss 丢包率，0到1
+func (n *Network) SetLoss(p float64) {
+	n.lock.Lock()
+	n.loss = p
+	n.lock.Unlock()
+}
+
+// SetLatency 每个包的单向延迟
+func (n *Network) SetLatency(d time.Duration) {
+	n.lock.Lock()
+	n.latency = d
+	n.lock.Unlock()
+}
+
+// SetJitter 每个包在延迟之外再随机加上[0, d)，包会乱序到达
+func (n *Network) SetJitter(d time.Duration) {
+	n.lock.Lock()
+	n.jitter = d
+	n.lock.Unlock()
+}
+
+// SetClock 替换NAT映射超时用的时钟，测试超时的时候不用真的等
+func (n *Network) SetClock(now func() time.Time) {
+	n.lock.Lock()
+	n.now = now
+	n.lock.Unlock()
+}
+
+func (n *Network) clock() time.Time {
+	n.lock.Lock()
+	now := n.now
+	n.lock.Unlock()
+	return now()
+}
+
+// Drops 按原因统计的丢包数
+func (n *Network) Drops() map[string]int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	drops := make(map[string]int, len(n.drops))
+	for reason, count := range n.drops {
+		drops[reason] = count
+	}
+	return drops
+}
+
+func (n *Network) drop(reason string) {
+	n.lock.Lock()
+	n.drops[reason]++
+	n.lock.Unlock()
+}
+
+func parseAddr(addr string) (*net.UDPAddr, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if a.IP == nil {
+		return nil, fmt.Errorf("netsim: %s: ip is required", addr)
+	}
+	a.IP = a.IP.To4()
+	if a.IP == nil {
+		return nil, fmt.Errorf("netsim: %s: only ipv4", addr)
+	}
+	return a, nil
+}
+
+// Listen 在公网上监听，端口为0时自动分配
+func (n *Network) Listen(addr string) (*Conn, error) {
+	a, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.nats[a.IP.String()]; ok {
+		return nil, fmt.Errorf("netsim: %s is a nat", a.IP)
+	}
+	if a.Port == 0 {
+		a.Port = n.nextPort
+		n.nextPort++
+	}
+	if _, ok := n.public[a.String()]; ok {
+		return nil, fmt.Errorf("netsim: %s already in use", a)
+	}
+	c := newConn(n, nil, a)
+	n.public[a.String()] = c
+	return c, nil
+}
+
+// NewNAT 新建一个NAT设备，publicIP是它的公网IP
+func (n *Network) NewNAT(typ NATType, publicIP string) (*NAT, error) {
+	ip := net.ParseIP(publicIP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("netsim: bad ip %s", publicIP)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.nats[ip.String()]; ok {
+		return nil, fmt.Errorf("netsim: nat %s already exists", ip)
+	}
+	for _, c := range n.public {
+		if c.addr.IP.Equal(ip) {
+			return nil, fmt.Errorf("netsim: %s already in use", ip)
+		}
+	}
+	nat := newNAT(n, typ, ip)
+	n.nats[ip.String()] = nat
+	return nat, nil
+}
+
+func (n *Network) unbind(c *Conn) {
+	if c.nat != nil {
+		c.nat.unbind(c)
+		return
+	}
+	n.lock.Lock()
+	if n.public[c.addr.String()] == c {
+		delete(n.public, c.addr.String())
+	}
+	n.lock.Unlock()
+}
+
+// send from是公网上的源地址，NAT后面的已经转换过了
+func (n *Network) send(from, to *net.UDPAddr, b []byte) {
+	n.lock.Lock()
+	lost := n.loss > 0 && n.rand.Float64() < n.loss
+	latency := n.latency
+	if !lost && n.jitter > 0 {
+		latency += time.Duration(n.rand.Int63n(int64(n.jitter)))
+	}
+	n.lock.Unlock()
+	if lost {
+		n.drop(DropLoss)
+		return
+	}
+
+	p := packet{data: append([]byte(nil), b...), from: from}
+	if latency <= 0 {
+		n.deliver(to, p)
+		return
+	}
+	time.AfterFunc(latency, func() { n.deliver(to, p) })
+}
+
+// deliver 到了目的地址，目的是NAT时按映射和过滤规则转给内网
+func (n *Network) deliver(to *net.UDPAddr, p packet) {
+	n.lock.Lock()
+	nat := n.nats[to.IP.String()]
+	c := n.public[to.String()]
+	n.lock.Unlock()
+
+	if nat != nil {
+		if c = nat.inbound(to.Port, p.from); c == nil {
+			n.drop(DropFiltered)
+			return
+		}
+	}
+	if c == nil {
+		n.drop(DropNoRoute)
+		return
+	}
+	if !c.enqueue(p) {
+		n.drop(DropQueue)
+	}
+}
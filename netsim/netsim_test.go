@@ -0,0 +1,321 @@
+package netsim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWait = 50 * time.Millisecond
+
+func listen(t *testing.T, l interface {
+	Listen(string) (*Conn, error)
+}, addr string) *Conn {
+	t.Helper()
+	c, err := l.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func mustNAT(t *testing.T, n *Network, typ NATType, ip string) *NAT {
+	t.Helper()
+	nat, err := n.NewNAT(typ, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nat
+}
+
+func send(t *testing.T, c *Conn, data string, to net.Addr) {
+	t.Helper()
+	if _, err := c.WriteToUDP([]byte(data), to.(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recv 收到的包，testWait内没收到返回nil
+func recv(t *testing.T, c *Conn) (string, *net.UDPAddr) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(testWait))
+	buf := make([]byte, 1500)
+	n, from, err := c.ReadFromUDP(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "", nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n]), from
+}
+
+func TestPublic(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "1.1.1.1:1000")
+	b := listen(t, n, "2.2.2.2:0")
+
+	send(t, a, "hello", b.LocalAddr())
+	data, from := recv(t, b)
+	if data != "hello" || from.String() != "1.1.1.1:1000" {
+		t.Fatalf("recv %q from %v", data, from)
+	}
+	if _, err := n.Listen("1.1.1.1:1000"); err == nil {
+		t.Fatal("listen same addr twice")
+	}
+
+	send(t, a, "nobody", &net.UDPAddr{IP: net.IPv4(3, 3, 3, 3), Port: 1})
+	if drops := n.Drops(); drops[DropNoRoute] != 1 {
+		t.Fatalf("drops %v", drops)
+	}
+}
+
+// TestNATFiltering 内网先发给server，然后server和other分别往映射的地址发包
+func TestNATFiltering(t *testing.T) {
+	cases := []struct {
+		typ NATType
+		// server换端口发和other发的包能不能进来
+		otherPort, otherIP bool
+	}{
+		{FullCone, true, true},
+		{Restricted, true, false},
+		{PortRestricted, false, false},
+		{Symmetric, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.typ.String(), func(t *testing.T) {
+			n := New(1)
+			server := listen(t, n, "1.1.1.1:1000")
+			serverOtherPort := listen(t, n, "1.1.1.1:1001")
+			other := listen(t, n, "2.2.2.2:1000")
+			nat := mustNAT(t, n, tc.typ, "100.0.0.1")
+			inner := listen(t, nat, "192.168.1.2:5000")
+
+			send(t, inner, "out", server.LocalAddr())
+			_, mapped := recv(t, server)
+			if mapped == nil || !mapped.IP.Equal(nat.IP()) {
+				t.Fatalf("mapped addr %v", mapped)
+			}
+
+			send(t, server, "reply", mapped)
+			if data, _ := recv(t, inner); data != "reply" {
+				t.Fatalf("reply from server not received: %q", data)
+			}
+			send(t, serverOtherPort, "port", mapped)
+			if data, _ := recv(t, inner); (data == "port") != tc.otherPort {
+				t.Fatalf("from other port received %q, want %v", data, tc.otherPort)
+			}
+			send(t, other, "ip", mapped)
+			if data, _ := recv(t, inner); (data == "ip") != tc.otherIP {
+				t.Fatalf("from other ip received %q, want %v", data, tc.otherIP)
+			}
+		})
+	}
+}
+
+func TestSymmetricMapping(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "1.1.1.1:1000")
+	b := listen(t, n, "2.2.2.2:1000")
+
+	for _, typ := range []NATType{FullCone, Restricted, PortRestricted, Symmetric} {
+		nat := mustNAT(t, n, typ, fmt.Sprintf("100.0.0.%d", 1+typ))
+		inner := listen(t, nat, "192.168.1.2:0")
+		send(t, inner, "x", a.LocalAddr())
+		send(t, inner, "x", b.LocalAddr())
+		_, fromA := recv(t, a)
+		_, fromB := recv(t, b)
+		if fromA == nil || fromB == nil {
+			t.Fatalf("%v: not received", typ)
+		}
+		if same := fromA.String() == fromB.String(); same == (typ == Symmetric) {
+			t.Fatalf("%v: mapped %v for a and %v for b", typ, fromA, fromB)
+		}
+	}
+}
+
+func TestMappingTimeout(t *testing.T) {
+	n := New(1)
+	var lock sync.Mutex
+	now := time.Unix(1000, 0)
+	n.SetClock(func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	})
+	advance := func(d time.Duration) {
+		lock.Lock()
+		now = now.Add(d)
+		lock.Unlock()
+	}
+
+	server := listen(t, n, "1.1.1.1:1000")
+	nat := mustNAT(t, n, PortRestricted, "100.0.0.1")
+	nat.SetMappingTimeout(30 * time.Second)
+	inner := listen(t, nat, "192.168.1.2:5000")
+
+	send(t, inner, "out", server.LocalAddr())
+	_, mapped := recv(t, server)
+
+	// 往外发包才续期
+	advance(20 * time.Second)
+	send(t, inner, "keepalive", server.LocalAddr())
+	recv(t, server)
+	advance(20 * time.Second)
+	send(t, server, "in time", mapped)
+	if data, _ := recv(t, inner); data != "in time" {
+		t.Fatalf("mapping expired too early: %q", data)
+	}
+
+	advance(31 * time.Second)
+	send(t, server, "late", mapped)
+	if data, _ := recv(t, inner); data != "" {
+		t.Fatalf("expired mapping received %q", data)
+	}
+	if drops := n.Drops(); drops[DropFiltered] != 1 {
+		t.Fatalf("drops %v", drops)
+	}
+
+	send(t, inner, "again", server.LocalAddr())
+	if _, remapped := recv(t, server); remapped == nil || remapped.String() == mapped.String() {
+		t.Fatalf("remapped %v, old %v", remapped, mapped)
+	}
+}
+
+func TestReset(t *testing.T) {
+	n := New(1)
+	server := listen(t, n, "1.1.1.1:1000")
+	nat := mustNAT(t, n, FullCone, "100.0.0.1")
+	inner := listen(t, nat, "192.168.1.2:5000")
+
+	send(t, inner, "out", server.LocalAddr())
+	_, mapped := recv(t, server)
+	nat.Reset()
+	send(t, server, "old", mapped)
+	if data, _ := recv(t, inner); data != "" {
+		t.Fatalf("received %q after reset", data)
+	}
+	send(t, inner, "out", server.LocalAddr())
+	if _, remapped := recv(t, server); remapped == nil || remapped.String() == mapped.String() {
+		t.Fatalf("remapped %v, old %v", remapped, mapped)
+	}
+}
+
+func lossPattern(seed int64) []bool {
+	n := New(seed)
+	n.SetLoss(0.3)
+	a, _ := n.Listen("1.1.1.1:1000")
+	b, _ := n.Listen("2.2.2.2:1000")
+	defer a.Close()
+	defer b.Close()
+
+	pattern := make([]bool, 200)
+	buf := make([]byte, 16)
+	for i := range pattern {
+		a.WriteToUDP([]byte("x"), b.addr)
+		b.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+		_, _, err := b.ReadFromUDP(buf)
+		pattern[i] = err == nil
+	}
+	return pattern
+}
+
+func TestLossDeterministic(t *testing.T) {
+	p1, p2 := lossPattern(42), lossPattern(42)
+	received := 0
+	for i := range p1 {
+		if p1[i] != p2[i] {
+			t.Fatalf("packet %d differs with same seed", i)
+		}
+		if p1[i] {
+			received++
+		}
+	}
+	if received < 100 || received > 180 {
+		t.Fatalf("received %d of %d with 30%% loss", received, len(p1))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n := New(1)
+	n.SetLatency(30 * time.Millisecond)
+	a := listen(t, n, "1.1.1.1:1000")
+	b := listen(t, n, "2.2.2.2:1000")
+
+	start := time.Now()
+	send(t, a, "slow", b.LocalAddr())
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	if _, _, err := b.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("delivered after %v", d)
+	}
+}
+
+// TestJitter 抖动比发包间隔大时后发的包可能先到
+func TestJitter(t *testing.T) {
+	n := New(1)
+	n.SetJitter(20 * time.Millisecond)
+	a := listen(t, n, "1.1.1.1:1000")
+	b := listen(t, n, "2.2.2.2:1000")
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		send(t, a, strconv.Itoa(i), b.LocalAddr())
+	}
+	reordered := false
+	for i := 0; i < count; i++ {
+		data, _ := recv(t, b)
+		if data != strconv.Itoa(i) {
+			reordered = true
+		}
+	}
+	if !reordered {
+		t.Fatal("no packet reordered")
+	}
+}
+
+func TestDeadlineAndClose(t *testing.T) {
+	n := New(1)
+	a := listen(t, n, "1.1.1.1:1000")
+	buf := make([]byte, 16)
+
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := a.ReadFromUDP(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read err %v", err)
+	}
+
+	// 阻塞中的读被新的deadline唤醒
+	a.SetReadDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := a.ReadFromUDP(buf)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	a.SetReadDeadline(time.Now())
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read err %v", err)
+	}
+
+	a.SetReadDeadline(time.Time{})
+	go func() {
+		_, _, err := a.ReadFromUDP(buf)
+		done <- err
+	}()
+	a.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("read err %v", err)
+	}
+	if _, err := n.Listen("1.1.1.1:1000"); err != nil {
+		t.Fatalf("listen after close: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"udpdemo/netsim"
+	"udpdemo/proto"
+)
+
+// simServer 只实现challenge/login/get/punch/logout和心跳的服务器，不校验登录证明，够测试打洞用
+type simServer struct {
+	conn *netsim.Conn
+
+	lock    sync.Mutex
+	nextID  int
+	clients map[int]*net.UDPAddr
+}
+
+func startSimServer(t *testing.T, n *netsim.Network) *net.UDPAddr {
+	t.Helper()
+	return startSimServerAt(t, n, "1.0.0.1:10086")
+}
+
+func startSimServerAt(t *testing.T, n *netsim.Network, addr string) *net.UDPAddr {
+	t.Helper()
+	conn, err := n.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &simServer{conn: conn, clients: make(map[int]*net.UDPAddr)}
+	done := make(chan struct{})
+	go func() {
+		s.serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (s *simServer) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if proto.IsHeartbeatMsg(string(buf[:n])) {
+			s.conn.WriteToUDP([]byte(proto.BuildHeartbeatReply(0)), addr)
+			continue
+		}
+		reqID, body := proto.SplitRequestID(buf[:n])
+		cmd, args := proto.ParseCmd(body)
+		if resp := s.exec(addr, cmd, args); len(resp) > 0 {
+			s.conn.WriteToUDP(proto.WithRequestID(reqID, []byte(resp)), addr)
+		}
+	}
+}
+
+func (s *simServer) exec(addr *net.UDPAddr, cmd string, args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch cmd {
+	case proto.CmdChallenge:
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return proto.ErrorMsg(cmd, proto.CodeInternal, err.Error())
+		}
+		return proto.SuccessMsg(cmd, base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	case proto.CmdLogin:
+		s.nextID++
+		s.clients[s.nextID] = addr
+		return proto.SuccessMsg(cmd, fmt.Sprintf("%d token%d", s.nextID, s.nextID))
+	case proto.CmdLogout:
+		return proto.SuccessMsg(cmd, "")
+	case proto.CmdGet:
+		id, _ := strconv.Atoi(args[0])
+		if target, ok := s.clients[id]; ok {
+			return proto.SuccessMsg(cmd, target.String())
+		}
+		return proto.ErrorMsg(cmd, proto.CodeNotFound, "not exists")
+	case proto.CmdPunch:
+		user, _ := strconv.Atoi(args[0])
+		target, _ := strconv.Atoi(args[1])
+		if s.clients[user] == nil || s.clients[target] == nil {
+			// 和旧服务器一样不带错误码
+			return proto.FailureMsg(cmd, "not exists")
+		}
+		s.conn.WriteToUDP([]byte(proto.Cmd(proto.CmdGetPunch, s.clients[user].String())), s.clients[target])
+		return proto.SuccessMsg(cmd, "")
+	}
+	return ""
+}
+
+// newSimClient NAT后面的客户端，已经登录
+func newSimClient(t *testing.T, n *netsim.Network, typ netsim.NATType, ip string, server *net.UDPAddr, name string) *ChatClient {
+	t.Helper()
+	nat, err := n.NewNAT(typ, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := nat.Listen("192.168.1.2:10001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := OpenHistoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ChatClient{
+		LocalAddr: conn.LocalAddr().(*net.UDPAddr),
+		conn:      conn,
+		history:   history,
+
+		serverAddr:  server,
+		key:         key,
+		punchCnt:    5,
+		recvTimeout: 3 * time.Second,
+	}
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.DoLogin(context.Background(), name); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// punch a主动向b打洞，返回两边是否都认识了对方
+func punch(t *testing.T, a, b *ChatClient) bool {
+	t.Helper()
+	ctx := context.Background()
+	if err := a.DoGet(ctx, b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DoPunch(ctx, b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	// 被动的一方可能稍后才收到打洞请求
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		_, aKnowsB := a.Peers()[b.ID()]
+		_, bKnowsA := b.Peers()[a.ID()]
+		if aKnowsB && bKnowsA {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func expectChat(t *testing.T, c *ChatClient, from int, text string) {
+	t.Helper()
+	select {
+	case msg := <-c.GetPeerMsg():
+		if msg.ID != from || msg.Msg != text {
+			t.Fatalf("got %q from %d, want %q from %d", msg.Msg, msg.ID, text, from)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no msg from %d", from)
+	}
+}
+
+func chat(t *testing.T, from, to *ChatClient, text string) {
+	t.Helper()
+	if err := from.SendToPeerByID(to.ID(), text); err != nil {
+		t.Fatal(err)
+	}
+	expectChat(t, to, from.ID(), text)
+}
+
+// TestE2EPunchMatrix 各种NAT组合，两边都不是对称NAT才能打洞成功
+func TestE2EPunchMatrix(t *testing.T) {
+	types := []netsim.NATType{netsim.FullCone, netsim.Restricted, netsim.PortRestricted, netsim.Symmetric}
+	for _, ta := range types {
+		for _, tb := range types {
+			ta, tb := ta, tb
+			t.Run(ta.String()+"/"+tb.String(), func(t *testing.T) {
+				t.Parallel()
+				n := netsim.New(1)
+				server := startSimServer(t, n)
+				a := newSimClient(t, n, ta, "100.0.0.1", server, "a")
+				b := newSimClient(t, n, tb, "100.0.0.2", server, "b")
+
+				want := ta != netsim.Symmetric && tb != netsim.Symmetric
+				if got := punch(t, a, b); got != want {
+					t.Fatalf("punch success %v, want %v, drops %v", got, want, n.Drops())
+				}
+				if !want {
+					return
+				}
+				chat(t, a, b, "hi b")
+				chat(t, b, a, "hi a")
+			})
+		}
+	}
+}
+
+// TestE2ESwitchProfile 心跳一直在跑的时候来回切换profile，切换后用新服务器，旧服务器的包丢掉
+func TestE2ESwitchProfile(t *testing.T) {
+	n := netsim.New(1)
+	s1 := startSimServerAt(t, n, "1.0.0.1:10086")
+	s2 := startSimServerAt(t, n, "1.0.0.2:10086")
+	a := newSimClient(t, n, netsim.FullCone, "100.0.0.1", s1, "a")
+
+	config := filepath.Join(t.TempDir(), "p2p-chat.toml")
+	data := fmt.Sprintf(`
+[profiles.one]
+server = "%s"
+name = "a"
+autologin = true
+punch_count = 7
+
+[profiles.two]
+server = "%s"
+name = "a2"
+autologin = true
+punch_count = 9
+timeout = 4
+`, s1, s2)
+	if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := *ConfigFile
+	*ConfigFile = config
+	defer func() { *ConfigFile = old }()
+
+	for i := 0; i < 6; i++ {
+		name := "two"
+		if i%2 == 1 {
+			name = "one"
+		}
+		if _, err := a.SwitchProfile(name); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	if _, err := a.SwitchProfile("two"); err != nil {
+		t.Fatal(err)
+	}
+	if a.server().String() != s2.String() || a.punchCount() != 9 || a.requestTimeout() != 4*time.Second {
+		t.Fatalf("conf not switched: %s %d %s", a.server(), a.punchCount(), a.requestTimeout())
+	}
+	if !a.fromOldServer(s1.String()) || a.fromOldServer(s2.String()) {
+		t.Fatal("old server not remembered")
+	}
+
+	b := newSimClient(t, n, netsim.FullCone, "100.0.0.2", s2, "b")
+	if !punch(t, a, b) {
+		t.Fatal("punch after switch fail")
+	}
+	chat(t, a, b, "hi from two")
+}
+
+// TestE2EPunchWithLoss 丢包时命令靠重发，打洞靠多发几个包
+// 服务器推给对方的getpunch没有重发，丢了只能重新打洞，和用户再输一次#punch一样
+func TestE2EPunchWithLoss(t *testing.T) {
+	n := netsim.New(7)
+	n.SetLatency(5 * time.Millisecond)
+	server := startSimServer(t, n)
+	a := newSimClient(t, n, netsim.PortRestricted, "100.0.0.1", server, "a")
+	b := newSimClient(t, n, netsim.PortRestricted, "100.0.0.2", server, "b")
+	a.punchCnt, b.punchCnt = 30, 30
+	n.SetLoss(0.2)
+
+	ok := false
+	for i := 0; i < 3 && !ok; i++ {
+		ok = punch(t, a, b)
+	}
+	if !ok {
+		t.Fatalf("punch fail, drops %v", n.Drops())
+	}
+	if n.Drops()[netsim.DropLoss] == 0 {
+		t.Fatal("no packet lost")
+	}
+	n.SetLoss(0)
+	chat(t, a, b, "hi b")
+	chat(t, b, a, "hi a")
+}
+
+// TestSubscribeWhilePublish 收消息的同时取消订阅，不会往已经关闭的通道发送
+func TestSubscribeWhilePublish(t *testing.T) {
+	n := netsim.New(1)
+	server := startSimServer(t, n)
+	a := newSimClient(t, n, netsim.FullCone, "100.0.0.1", server, "a")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			a.publishPeerMsg(&PeerMsg{ID: 1, Msg: "hi"})
+		}
+	}()
+	for {
+		// 每收到一条就换一个订阅，取消和下一条消息的发送同时进行
+		_, cancel := a.Subscribe()
+		select {
+		case <-a.GetPeerMsg():
+			cancel()
+		case <-done:
+			cancel()
+			return
+		}
+	}
+}
+
+// TestE2EErrorCodes 失败回复的错误码转换成哨兵错误，没有错误码的不对应任何哨兵
+func TestE2EErrorCodes(t *testing.T) {
+	n := netsim.New(1)
+	server := startSimServer(t, n)
+	a := newSimClient(t, n, netsim.FullCone, "100.0.0.1", server, "a")
+	ctx := context.Background()
+
+	err := a.DoGet(ctx, 100)
+	var serr *ServerError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &serr) || serr.Code != proto.CodeNotFound || serr.Msg != "not exists" {
+		t.Fatalf("get unknown id: %v", err)
+	}
+	rerr := internalError(err)
+	if data, ok := rerr.Data.(*rpcServerErrorData); !ok || data.Code != 404 || data.Reason != "not_found" {
+		t.Fatalf("rpc error data: %+v", rerr.Data)
+	}
+
+	// get失败了，打洞前先记下地址，让punch命令发到服务器
+	a.targetsInfo.Store(100, "100.0.0.9:10001")
+	err = a.DoPunch(ctx, 100)
+	if !errors.As(err, &serr) || serr.Code != proto.CodeUnknown || errors.Unwrap(err) != nil {
+		t.Fatalf("punch unknown id: %v", err)
+	}
+	if rerr := internalError(err); rerr.Data != nil {
+		t.Fatalf("rpc error data without code: %+v", rerr.Data)
+	}
+}
+
+// TestE2EBye 退出时对端收到通知，删掉对应的连接
+func TestE2EBye(t *testing.T) {
+	n := netsim.New(1)
+	server := startSimServer(t, n)
+	a := newSimClient(t, n, netsim.Restricted, "100.0.0.1", server, "a")
+	b := newSimClient(t, n, netsim.FullCone, "100.0.0.2", server, "b")
+	if !punch(t, a, b) {
+		t.Fatal("punch fail")
+	}
+
+	aID := a.ID()
+	a.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := b.Peers()[aID]; !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("peer not removed after bye")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := b.SendToPeerByID(aID, "gone"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("send to closed peer: %v", err)
+	}
+}
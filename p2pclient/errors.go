@@ -0,0 +1,55 @@
+// 服务器的失败回复带错误码，转换成ServerError，调用者用errors.Is判断具体的原因
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"udpdemo/proto"
+)
+
+var (
+	ErrBadArgs         = errors.New("bad args")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrBanned          = errors.New("banned")
+	ErrNotFound        = errors.New("not found")
+	ErrConflict        = errors.New("conflict")
+	ErrTooLarge        = errors.New("too large")
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrRateLimited     = errors.New("rate limited")
+	ErrServerInternal  = errors.New("server internal error")
+	ErrUnavailable     = errors.New("server unavailable")
+)
+
+var codeErrors = map[proto.ErrCode]error{
+	proto.CodeBadArgs:         ErrBadArgs,
+	proto.CodeUnauthorized:    ErrUnauthorized,
+	proto.CodeBanned:          ErrBanned,
+	proto.CodeNotFound:        ErrNotFound,
+	proto.CodeConflict:        ErrConflict,
+	proto.CodeTooLarge:        ErrTooLarge,
+	proto.CodeVersionMismatch: ErrVersionMismatch,
+	proto.CodeRateLimited:     ErrRateLimited,
+	proto.CodeInternal:        ErrServerInternal,
+	proto.CodeUnavailable:     ErrUnavailable,
+}
+
+// ServerError 服务器的失败回复，没有错误码（旧服务器）或者不认识的错误码不对应任何哨兵错误
+type ServerError struct {
+	Cmd  string
+	Code proto.ErrCode
+	Msg  string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s fail: %s", e.Cmd, e.Msg)
+}
+
+func (e *ServerError) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// respError 失败的回复转换成ServerError
+func respError(resp *proto.ServerResponse) error {
+	return &ServerError{Cmd: resp.Cmd, Code: resp.Code, Msg: resp.Data}
+}
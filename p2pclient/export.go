@@ -0,0 +1,246 @@
+// 聊天记录导出导入，支持JSON Lines、纯文本、mbox，导入只支持JSON Lines和mbox，保留消息ID和时间
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ExportJSONL = "jsonl"
+	ExportText  = "text"
+	ExportMbox  = "mbox"
+
+	mboxMsgIDSuffix = "@p2pchat"
+)
+
+// exportFormat 根据扩展名判断格式，默认纯文本
+func exportFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".json":
+		return ExportJSONL
+	case ".mbox":
+		return ExportMbox
+	default:
+		return ExportText
+	}
+}
+
+// ExportHistory 把会话的全部记录写到path，返回条数
+func (c *ChatClient) ExportHistory(conv, path, format string) (int, error) {
+	conv = c.convName(conv)
+	msgs := c.history.Recent(conv, c.history.Len())
+	if len(msgs) == 0 {
+		return 0, fmt.Errorf("no history of %s", conv)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	switch format {
+	case ExportJSONL:
+		err = writeJSONL(w, msgs)
+	case ExportMbox:
+		err = writeMbox(w, msgs)
+	case ExportText:
+		err = writeText(w, msgs)
+	default:
+		err = fmt.Errorf("unknown format %s", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(msgs), f.Sync()
+}
+
+// ImportHistory 合并导出的文件，已有的消息ID跳过，返回新增的条数
+func (c *ChatClient) ImportHistory(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var msgs []*HistoryMsg
+	switch exportFormat(path) {
+	case ExportJSONL:
+		msgs, err = readJSONL(f)
+	case ExportMbox:
+		msgs, err = readMbox(f)
+	default:
+		return 0, fmt.Errorf("only jsonl and mbox can be imported")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return c.history.Merge(msgs)
+}
+
+func writeJSONL(w io.Writer, msgs []*HistoryMsg) error {
+	enc := json.NewEncoder(w)
+	for _, m := range msgs {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJSONL(r io.Reader) ([]*HistoryMsg, error) {
+	var msgs []*HistoryMsg
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		m := &HistoryMsg{}
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(m.ID) == 0 {
+			return nil, fmt.Errorf("line %d: no msg id", line)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, scanner.Err()
+}
+
+func writeText(w io.Writer, msgs []*HistoryMsg) error {
+	for _, m := range msgs {
+		if _, err := fmt.Fprintf(w, "%s [%s] %s\n", m.Time.Format("2006-01-02 15:04:05"), m.From, m.Text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMbox 每条消息一封信，正文里以From 开头的行前面加>
+func writeMbox(w io.Writer, msgs []*HistoryMsg) error {
+	for _, m := range msgs {
+		_, err := fmt.Fprintf(w, "From %s %s\nMessage-ID: <%s%s>\nDate: %s\nX-Time: %s\nFrom: %s\nX-Conversation: %s\nContent-Type: text/plain; charset=utf-8\n\n",
+			mboxName(m.From), m.Time.UTC().Format(time.ANSIC), m.ID, mboxMsgIDSuffix,
+			m.Time.Format(time.RFC1123Z), m.Time.Format(time.RFC3339Nano), m.From, m.Conv)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(m.Text, "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = ">" + line
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprint(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mboxName(name string) string {
+	if len(name) == 0 {
+		return "-"
+	}
+	return strings.ReplaceAll(name, " ", "_")
+}
+
+func readMbox(r io.Reader) ([]*HistoryMsg, error) {
+	var (
+		msgs   []*HistoryMsg
+		cur    *HistoryMsg
+		body   []string
+		inBody bool
+	)
+	finish := func() error {
+		if cur == nil {
+			return nil
+		}
+		if len(cur.ID) == 0 || cur.Time.IsZero() {
+			return fmt.Errorf("mbox msg without Message-ID or Date")
+		}
+		// 去掉每封信最后的空行
+		for len(body) > 0 && len(body[len(body)-1]) == 0 {
+			body = body[:len(body)-1]
+		}
+		cur.Text = strings.Join(body, "\n")
+		msgs = append(msgs, cur)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "From ") {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			cur, body, inBody = &HistoryMsg{}, nil, false
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if inBody {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = line[1:]
+			}
+			body = append(body, line)
+			continue
+		}
+		if len(line) == 0 {
+			inBody = true
+			continue
+		}
+		segs := strings.SplitN(line, ":", 2)
+		if len(segs) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(segs[1])
+		switch strings.ToLower(segs[0]) {
+		case "message-id":
+			cur.ID = strings.TrimSuffix(strings.Trim(value, "<>"), mboxMsgIDSuffix)
+		case "date":
+			// X-Time精度更高，有的话以X-Time为准
+			if !cur.Time.IsZero() {
+				continue
+			}
+			t, err := time.Parse(time.RFC1123Z, value)
+			if err != nil {
+				return nil, fmt.Errorf("bad mbox date %s: %v", value, err)
+			}
+			cur.Time = t
+		case "x-time":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, fmt.Errorf("bad mbox time %s: %v", value, err)
+			}
+			cur.Time = t
+		case "from":
+			cur.From = value
+		case "x-conversation":
+			cur.Conv = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
@@ -0,0 +1,269 @@
+// TCP端口转发，本地监听端口，每个连接在和对端的mux会话上打开一个流，对端负责连接目标地址
+// 流打开后先发一行请求：connect host:port，对端回复一行：OK、FAIL msg 或 DENY msg（不允许连接），之后双向转发
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"udpdemo/mux"
+	"udpdemo/proto"
+)
+
+var AllowForward = flag.Bool("allowforward", false, "允许所有对端通过本机转发TCP连接，目标还要在-exitallow里，转发到本机的端口要写明如 127.0.0.1/32:22")
+
+const (
+	streamCmdConnect    = "connect"
+	streamReplyDeny     = "DENY"
+	forwardDialTimeout  = 10 * time.Second
+	streamHeaderTimeout = 10 * time.Second // 打开流之后等请求行的时间，对端一直不发就断开
+	maxStreamReqLen     = 512
+)
+
+type Forward struct {
+	PeerID    int
+	LocalPort int
+	Target    string // 为空表示SOCKS5代理，目标由代理请求决定
+
+	listener net.Listener
+}
+
+func (c *ChatClient) handleMuxMsg(addr net.Addr, data []byte) {
+	peerID := c.peerIDByAddr(addr)
+	if peerID == 0 {
+		forwardLog.Warn("mux msg from unknown peer", "addr", addr)
+		return
+	}
+	if err := c.muxSession(peerID, addr).Input(data); err != nil {
+		forwardLog.Warn("mux input fail", "addr", addr, "err", err)
+	}
+}
+
+// muxSession 获取和对端的复用会话，没有则创建，ID小的一方为initiator
+func (c *ChatClient) muxSession(peerID int, addr net.Addr) *mux.Session {
+	if v, ok := c.sessions.Load(addr.String()); ok {
+		return v.(*mux.Session)
+	}
+	sess := mux.NewSession(c.conn, addr, c.ID() < peerID, []byte(proto.MuxMsgPrefix))
+	if v, loaded := c.sessions.LoadOrStore(addr.String(), sess); loaded {
+		sess.Close()
+		return v.(*mux.Session)
+	}
+	go c.acceptStreamLoop(peerID, sess)
+	return sess
+}
+
+func (c *ChatClient) peerSession(peerID int) (*mux.Session, error) {
+	client, ok := c.clients.Load(peerID)
+	if !ok {
+		return nil, fmt.Errorf("%d not found", peerID)
+	}
+	return c.muxSession(peerID, client.(ClientInfo).Addr), nil
+}
+
+func (c *ChatClient) acceptStreamLoop(peerID int, sess *mux.Session) {
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			forwardLog.Info("accept stream stop", "peer", peerID, "err", err)
+			return
+		}
+		go c.serveStream(peerID, st)
+	}
+}
+
+func readStreamLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= maxStreamReqLen {
+			return "", fmt.Errorf("stream line too long")
+		}
+		line = append(line, b)
+	}
+}
+
+func replyStream(st *mux.Stream, err error) error {
+	reply := proto.Success
+	if errors.Is(err, errExitNotAllowed) {
+		reply = fmt.Sprintf("%s %v", streamReplyDeny, err)
+	} else if err != nil {
+		reply = fmt.Sprintf("%s %v", proto.Failure, err)
+	}
+	_, werr := io.WriteString(st, reply+"\n")
+	return werr
+}
+
+// serveStream 处理对端打开的流
+func (c *ChatClient) serveStream(peerID int, st *mux.Stream) {
+	r := bufio.NewReader(st)
+	st.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	line, err := readStreamLine(r)
+	if err != nil {
+		forwardLog.Warn("read stream request fail", "peer", peerID, "err", err)
+		st.Reset()
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+	segs := strings.SplitN(line, " ", 2)
+	if len(segs) != 2 {
+		replyStream(st, fmt.Errorf("bad request"))
+		st.Close()
+		return
+	}
+
+	switch segs[0] {
+	case streamCmdConnect:
+		c.serveConnect(peerID, st, r, segs[1])
+	default:
+		replyStream(st, fmt.Errorf("unknown cmd %s", segs[0]))
+		st.Close()
+	}
+}
+
+func (c *ChatClient) serveConnect(peerID int, st *mux.Stream, r *bufio.Reader, target string) {
+	if !c.isExitAllowed(peerID) {
+		forwardLog.Warn("connect refused: forward not allowed", "peer", peerID, "target", target)
+		replyStream(st, fmt.Errorf("forward %w", errExitNotAllowed))
+		st.Close()
+		return
+	}
+	dialAddr, err := checkExitTarget(c.exitRules, target)
+	if err != nil {
+		forwardLog.Warn("connect refused", "peer", peerID, "target", target, "err", err)
+		replyStream(st, err)
+		st.Close()
+		return
+	}
+	conn, err := net.DialTimeout("tcp", dialAddr, forwardDialTimeout)
+	if err != nil {
+		forwardLog.Warn("connect fail", "peer", peerID, "target", target, "err", err)
+		replyStream(st, err)
+		st.Close()
+		return
+	}
+	if err := replyStream(st, nil); err != nil {
+		conn.Close()
+		return
+	}
+	forwardLog.Info("connect", "peer", peerID, "target", target)
+	pipeStream(conn, st, r)
+}
+
+// openConnectStream 打开一个流，让对端连接target
+func (c *ChatClient) openConnectStream(peerID int, target string) (*mux.Stream, *bufio.Reader, error) {
+	sess, err := c.peerSession(peerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := sess.OpenStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.WriteString(st, fmt.Sprintf("%s %s\n", streamCmdConnect, target)); err != nil {
+		st.Reset()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(st)
+	// 对端要先连上目标才回复
+	st.SetReadDeadline(time.Now().Add(forwardDialTimeout + streamHeaderTimeout))
+	reply, err := readStreamLine(r)
+	if err != nil {
+		st.Reset()
+		return nil, nil, err
+	}
+	st.SetReadDeadline(time.Time{})
+	if strings.HasPrefix(reply, streamReplyDeny+" ") {
+		st.Close()
+		return nil, nil, fmt.Errorf("peer refused (%w): %s", errExitNotAllowed, strings.TrimPrefix(reply, streamReplyDeny+" "))
+	}
+	if reply != proto.Success {
+		st.Close()
+		return nil, nil, fmt.Errorf("peer refused: %s", strings.TrimPrefix(reply, proto.Failure+" "))
+	}
+	return st, r, nil
+}
+
+// pipeStream 双向转发，r为包装了st的reader，可能已经缓存了部分数据
+func pipeStream(conn net.Conn, st *mux.Stream, r io.Reader) {
+	done := make(chan struct{})
+	go func() {
+		if _, err := io.Copy(conn, r); err != nil {
+			conn.Close()
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		close(done)
+	}()
+	if _, err := io.Copy(st, conn); err != nil {
+		st.Reset()
+	} else {
+		st.Close()
+	}
+	<-done
+	conn.Close()
+}
+
+// StartForward 监听本地端口，连接通过对端转发到target
+func (c *ChatClient) StartForward(peerID, localPort int, target string) (*Forward, error) {
+	if _, ok := c.clients.Load(peerID); !ok {
+		return nil, fmt.Errorf("%d not found", peerID)
+	}
+	if _, ok := c.forwards.Load(localPort); ok {
+		return nil, fmt.Errorf("port %d already forwarded", localPort)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forward{PeerID: peerID, LocalPort: localPort, Target: target, listener: listener}
+	c.forwards.Store(localPort, f)
+	go c.forwardLoop(f)
+	return f, nil
+}
+
+func (c *ChatClient) forwardLoop(f *Forward) {
+	defer c.forwards.Delete(f.LocalPort)
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			forwardLog.Info("forward stop", "port", f.LocalPort, "err", err)
+			return
+		}
+		if len(f.Target) == 0 {
+			go c.serveSocks(f.PeerID, conn)
+			continue
+		}
+		go func() {
+			st, r, err := c.openConnectStream(f.PeerID, f.Target)
+			if err != nil {
+				forwardLog.Warn("forward fail", "port", f.LocalPort, "peer", f.PeerID, "target", f.Target, "err", err)
+				conn.Close()
+				return
+			}
+			pipeStream(conn, st, r)
+		}()
+	}
+}
+
+func (c *ChatClient) StopForward(localPort int) error {
+	v, ok := c.forwards.Load(localPort)
+	if !ok {
+		return fmt.Errorf("port %d not forwarded", localPort)
+	}
+	return v.(*Forward).listener.Close()
+}
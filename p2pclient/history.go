@@ -0,0 +1,228 @@
+// 本地聊天记录，每条消息一行JSON追加到文件，启动时全部读到内存
+// 会话按对端名字区分，群聊为@room，因为ID每次登录都会变
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var HistoryFile = flag.String("history", "./p2p-chat-history.jsonl", "聊天记录文件，为空则不保存")
+
+const (
+	historyShowOnStart = 50 // 启动时显示最近多少条
+	historySearchLimit = 50
+)
+
+type HistoryMsg struct {
+	ID   string    `json:"id"`
+	Conv string    `json:"conv"` // 对端名字或者@room
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+type HistoryStore struct {
+	lock sync.Mutex
+	file *os.File
+
+	msgs []*HistoryMsg
+	ids  map[string]struct{}
+}
+
+// OpenHistoryStore 读取已有的记录，path为空时只保存在内存
+func OpenHistoryStore(path string) (*HistoryStore, error) {
+	h := &HistoryStore{ids: make(map[string]struct{})}
+	if len(path) == 0 {
+		return h, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		m := &HistoryMsg{}
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			// 最后一行可能没写完就崩溃了，跳过
+			historyLog.Warn("skip bad line", "err", err)
+			continue
+		}
+		h.add(m)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.sort()
+	h.file = f
+	return h, nil
+}
+
+// sort 导入的消息可能比已有的早，按时间排序，需要持有锁
+func (h *HistoryStore) sort() {
+	sort.SliceStable(h.msgs, func(i, j int) bool {
+		return h.msgs[i].Time.Before(h.msgs[j].Time)
+	})
+}
+
+func (h *HistoryStore) add(m *HistoryMsg) bool {
+	if _, ok := h.ids[m.ID]; ok {
+		return false
+	}
+	h.ids[m.ID] = struct{}{}
+	h.msgs = append(h.msgs, m)
+	return true
+}
+
+// Add 保存一条消息，ID重复的忽略
+func (h *HistoryStore) Add(m *HistoryMsg) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.add(m) || h.file == nil {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = h.file.Write(append(b, '\n'))
+	return err
+}
+
+// Merge 合并一批消息，ID重复的忽略，返回新增的条数
+func (h *HistoryStore) Merge(msgs []*HistoryMsg) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n := 0
+	var buf []byte
+	for _, m := range msgs {
+		if !h.add(m) {
+			continue
+		}
+		n++
+		b, err := json.Marshal(m)
+		if err != nil {
+			return n, err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	h.sort()
+	if h.file == nil || len(buf) == 0 {
+		return n, nil
+	}
+	if _, err := h.file.Write(buf); err != nil {
+		return n, err
+	}
+	return n, h.file.Sync()
+}
+
+func (h *HistoryStore) Len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.msgs)
+}
+
+// Recent 最近的n条，conv为空时不区分会话
+func (h *HistoryStore) Recent(conv string, n int) []*HistoryMsg {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var msgs []*HistoryMsg
+	for i := len(h.msgs) - 1; i >= 0 && len(msgs) < n; i-- {
+		if len(conv) == 0 || h.msgs[i].Conv == conv {
+			msgs = append(msgs, h.msgs[i])
+		}
+	}
+	reverseHistory(msgs)
+	return msgs
+}
+
+// Search 不区分大小写查找内容或者发送者包含text的消息，返回最近的limit条
+func (h *HistoryStore) Search(text string, limit int) []*HistoryMsg {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	text = strings.ToLower(text)
+	var msgs []*HistoryMsg
+	for i := len(h.msgs) - 1; i >= 0 && len(msgs) < limit; i-- {
+		m := h.msgs[i]
+		if strings.Contains(strings.ToLower(m.Text), text) || strings.Contains(strings.ToLower(m.From), text) {
+			msgs = append(msgs, m)
+		}
+	}
+	reverseHistory(msgs)
+	return msgs
+}
+
+func (h *HistoryStore) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+func reverseHistory(msgs []*HistoryMsg) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
+
+func (m *HistoryMsg) String() string {
+	return fmt.Sprintf("%s <%s> [%s] %s", m.Time.Format("01-02 15:04"), m.Conv, m.From, m.Text)
+}
+
+// saveHistory 保存一条消息，id为空时生成
+func (c *ChatClient) saveHistory(id, conv, from, text string, t time.Time) {
+	if len(id) == 0 {
+		id = newMsgID()
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if err := c.history.Add(&HistoryMsg{ID: id, Conv: conv, From: from, Text: text, Time: t}); err != nil {
+		historyLog.Error("save fail", "err", err)
+	}
+}
+
+// saveIncomingHistory 保存收到的消息
+func (c *ChatClient) saveIncomingHistory(msg *PeerMsg) {
+	conv := msg.Info.Name
+	if len(msg.Room) > 0 {
+		conv = "@" + msg.Room
+	}
+	c.saveHistory(msg.MsgID, conv, msg.Info.Name, msg.Msg, msg.Time)
+}
+
+// convName 会话名，可以是已打洞的对端ID、名字或者@room
+func (c *ChatClient) convName(s string) string {
+	if id, err := strconv.Atoi(s); err == nil {
+		if client, ok := c.clients.Load(id); ok {
+			return client.(ClientInfo).Name
+		}
+	}
+	return s
+}
+
+// History 会话最近的n条消息
+func (c *ChatClient) History(conv string, n int) []*HistoryMsg {
+	return c.history.Recent(c.convName(conv), n)
+}
+
+func (c *ChatClient) SearchHistory(text string) []*HistoryMsg {
+	return c.history.Search(text, historySearchLimit)
+}
+
+func (c *ChatClient) RecentHistory() []*HistoryMsg {
+	return c.history.Recent("", historyShowOnStart)
+}
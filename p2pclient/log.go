@@ -2,17 +2,41 @@ package main
 
 import (
 	"flag"
-	"log"
-	"os"
+
+	"udpdemo/logging"
+)
+
+var (
+	LogFile       = flag.String("logfile", "./p2p-chat-client.log", "file path")
+	LogLevel      = flag.String("loglevel", "info", "日志级别：debug/info/warn/error")
+	LogFormat     = flag.String("logformat", "logfmt", "日志格式：logfmt/json")
+	LogMaxSize    = flag.Int("logmaxsize", 100, "日志文件超过多少MB轮转，0不轮转")
+	LogMaxBackups = flag.Int("logbackups", 5, "保留几个轮转的旧日志")
 )
 
-var LogFile = flag.String("logfile", "./p2p-chat-client.log", "file path")
+var (
+	clientLog   = logging.New("client")
+	punchLog    = logging.New("punch")
+	transferLog = logging.New("transfer")
+	forwardLog  = logging.New("forward")
+	socksLog    = logging.New("socks")
+	rpcLog      = logging.New("rpc")
+	roomLog     = logging.New("room")
+	historyLog  = logging.New("history")
+	offlineLog  = logging.New("offline")
+	uiLog       = logging.New("ui")
+)
 
+// initLog 界面占用了终端，日志只写文件
 func initLog() {
-	logFile, err := os.OpenFile(*LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	err := logging.Init(logging.Options{
+		File:       *LogFile,
+		Level:      *LogLevel,
+		Format:     *LogFormat,
+		MaxSize:    int64(*LogMaxSize) * 1024 * 1024,
+		MaxBackups: *LogMaxBackups,
+	})
 	if err != nil {
 		panic(err)
 	}
-	log.SetOutput(logFile)
-	log.SetFlags(log.Llongfile | log.Ldate | log.Ltime)
 }
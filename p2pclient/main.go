@@ -1,14 +1,29 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"os"
+)
 
-func init() {
+func main() {
 	flag.Parse()
 	initLog()
-}
-
-func main() {
 	RunP2PChatClient()
 	displayPeerMsg()
-	runUI()
+	displayTransfer()
+	displayRooms()
+	displayNotice()
+	runRPCServer()
+	watchSignals()
+	err := runUI()
+	if err != nil {
+		uiLog.Error("run ui fail", "err", err)
+	}
+	if rpcServer != nil {
+		rpcServer.Close()
+	}
+	p2pChatClient.Close()
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"udpdemo/proto"
+)
+
+var KeyFile = flag.String("key", "./p2p-chat.key", "私钥文件，不存在自动生成，用于收离线消息")
+
+// loadOrCreateKey 读取X25519私钥，不存在则生成并保存
+func loadOrCreateKey(path string) (*ecdh.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		raw, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("bad key file %s: %v", path, err)
+		}
+		return ecdh.X25519().NewPrivateKey(raw)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Bytes())), 0600); err != nil {
+		return nil, fmt.Errorf("save key file %s error: %v", path, err)
+	}
+	return key, nil
+}
+
+func (c *ChatClient) publicKey() string {
+	return base64.StdEncoding.EncodeToString(c.privateKey().PublicKey().Bytes())
+}
+
+// loginProof 用私钥和服务器这次登录的临时公钥算出登录证明
+func (c *ChatClient) loginProof(name, serverKey string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(serverKey)
+	if err != nil {
+		return "", fmt.Errorf("bad challenge: %v", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("bad challenge: %v", err)
+	}
+	shared, err := c.privateKey().ECDH(pub)
+	if err != nil {
+		return "", err
+	}
+	return proto.LoginProof(shared, name, c.publicKey()), nil
+}
+
+// offlineCipher 用共享密钥和两边公钥派生AES-256-GCM
+func offlineCipher(shared, ephPub, peerPub []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephPub)
+	h.Write(peerPub)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptOffline 用临时密钥和接收者公钥协商，输出 base64(临时公钥|nonce|密文)
+func encryptOffline(peerKey string, text string) (string, error) {
+	peerPub, err := base64.StdEncoding.DecodeString(peerKey)
+	if err != nil {
+		return "", fmt.Errorf("bad peer key: %v", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return "", fmt.Errorf("bad peer key: %v", err)
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return "", err
+	}
+	ephPub := eph.PublicKey().Bytes()
+	gcm, err := offlineCipher(shared, ephPub, peerPub)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	out := append(append(ephPub, nonce...), gcm.Seal(nil, nonce, []byte(text), nil)...)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func (c *ChatClient) decryptOffline(payload string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", err
+	}
+	key := c.privateKey()
+	keySize := len(key.PublicKey().Bytes())
+	if len(b) < keySize {
+		return "", fmt.Errorf("payload too short")
+	}
+	eph, err := ecdh.X25519().NewPublicKey(b[:keySize])
+	if err != nil {
+		return "", err
+	}
+	shared, err := key.ECDH(eph)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := offlineCipher(shared, b[:keySize], key.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	b = b[keySize:]
+	if len(b) < gcm.NonceSize() {
+		return "", fmt.Errorf("payload too short")
+	}
+	text, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// DoSendOffline 给name发离线消息，先向服务器要对方公钥，加密后交给服务器保存
+func (c *ChatClient) DoSendOffline(ctx context.Context, name, text string) error {
+	id, selfName, _ := c.identity()
+	if id == 0 {
+		return fmt.Errorf("not login")
+	}
+
+	resp, err := c.request(ctx, proto.Cmd(proto.CmdKey, name, strconv.Itoa(id)))
+	if err != nil {
+		return err
+	}
+	if !resp.Result {
+		return respError(resp)
+	}
+
+	payload, err := encryptOffline(resp.Data, text)
+	if err != nil {
+		return fmt.Errorf("encrypt fail: %+v", err)
+	}
+	if len(payload) > proto.MaxOfflinePayload {
+		return fmt.Errorf("msg too long")
+	}
+
+	resp, err = c.request(ctx, proto.Cmd(proto.CmdStore, strconv.Itoa(id), name, payload))
+	if err != nil {
+		return err
+	}
+	if !resp.Result {
+		return respError(resp)
+	}
+	c.saveHistory("", name, selfName, text, time.Time{})
+	return nil
+}
+
+// handleOfflineMsg 收到服务器推送的离线消息，解密后确认，重复推送的只确认不显示
+func (c *ChatClient) handleOfflineMsg(m *proto.OfflineMsg) {
+	id := c.ID()
+	if id == 0 {
+		return
+	}
+	if err := c.sendCmdToServer(proto.Cmd(proto.CmdOfflineAck, strconv.Itoa(id), m.MsgID)); err != nil {
+		offlineLog.Warn("send ack fail", "msg", m.MsgID, "err", err)
+	}
+	if !c.seenMsgs.Add(proto.CmdOffline + m.MsgID) {
+		return
+	}
+
+	text, err := c.decryptOffline(m.Payload)
+	if err != nil {
+		offlineLog.Warn("decrypt fail", "msg", m.MsgID, "from", m.From, "err", err)
+		return
+	}
+	c.publishPeerMsg(&PeerMsg{
+		Info:    ClientInfo{Name: m.From},
+		UDPAddr: c.server(),
+		Msg:     text,
+		MsgID:   proto.CmdOffline + m.MsgID,
+		Time:    time.Unix(m.Time, 0),
+	})
+}
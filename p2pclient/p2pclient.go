@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdh"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/libp2p/go-reuseport"
-	"log"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"udpdemo/proto"
@@ -22,16 +25,34 @@ var (
 )
 
 type PunchPeerInfo struct {
-	IsDone  bool
+	done    int32 // 1表示打洞成功，收包循环和发打洞包的循环同时访问
 	UDPAddr *net.UDPAddr
 }
 
+func (p *PunchPeerInfo) Done() bool {
+	return atomic.LoadInt32(&p.done) == 1
+}
+
+// markDone 标记打洞成功，第一次标记时返回true
+func (p *PunchPeerInfo) markDone() bool {
+	return atomic.CompareAndSwapInt32(&p.done, 0, 1)
+}
+
+func (p *PunchPeerInfo) reset() {
+	atomic.StoreInt32(&p.done, 0)
+}
+
 type PeerMsg struct {
 	ID   int
 	Info ClientInfo
 
 	UDPAddr net.Addr
 	Msg     string
+
+	Room  string // 群消息的房间名，私聊为空
+	MsgID string
+
+	Time time.Time // 离线消息的发送时间，实时消息为零值
 }
 
 type ClientInfo struct {
@@ -42,14 +63,21 @@ type ClientInfo struct {
 type ChatClient struct {
 	onceHeartbeat sync.Once
 	LocalAddr     *net.UDPAddr
-	ServerAddr    *net.UDPAddr
 
-	id   int
-	name string
-	conn net.PacketConn
+	// Close时取消，所有循环都跟着退出
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	wg        sync.WaitGroup // 收包的循环
 
-	serverRecvChan chan *proto.ServerResponse
-	punchChan      chan *net.UDPAddr // addr
+	identLock sync.RWMutex // 保护id、name、token，登录登出时写，收包和心跳的循环一直在读
+	id        int
+	name      string
+	token     string // 登录时服务器给的，心跳时带上，地址变化时服务器用来确认身份
+	conn      net.PacketConn
+
+	pending   *pendingRequests
+	punchChan chan *net.UDPAddr // addr
 
 	targetsInfo        *sync.Map // id -> addr
 	punchTargetsInfo   *sync.Map // 主动要打洞的地址信息和状态 map[string]*PunchPeerInfo
@@ -58,76 +86,251 @@ type ChatClient struct {
 	clients *sync.Map // ID -> ClientInfo
 
 	peerMsgChan chan *PeerMsg
+	subLock     sync.Mutex                 // 发送和取消订阅互斥，取消时关闭的通道不会再被发送
+	subscribers map[chan *PeerMsg]struct{} // 外部订阅者（如本地控制接口）
+
+	transfers    *sync.Map // fileID -> *FileTransfer
+	recvParts    *sync.Map // 正在接收的.part路径 -> fileID，同一个临时文件同时只能有一个传输在写
+	transferChan chan *TransferEvent
+
+	sessions *sync.Map // addr -> *mux.Session
+	forwards *sync.Map // localPort -> *Forward
+
+	exitPeers *sync.Map // 允许把本机作为出口的对端 ID -> struct{}
+	exitRules []exitRule
+
+	rooms    *sync.Map // name -> *Room
+	roomChan chan string
+	seenMsgs *msgSeenSet
+
+	history *HistoryStore
+
+	relogging  int32 // 正在自动重新登录
+	noticeChan chan string
+
+	confLock    sync.RWMutex // 保护下面的字段，切换profile时写，收包、心跳、打洞和离线消息一直在读
+	serverAddr  *net.UDPAddr
+	oldServers  map[string]struct{} // 切换profile之前的服务器，它们的包不能当成对端的消息
+	key         *ecdh.PrivateKey    // 离线消息的私钥，公钥登录时上报
+	profile     string              // 当前使用的profile
+	punchCnt    int
+	recvTimeout time.Duration
+}
+
+// GetNotice 需要提示用户的状态变化，如自动重新登录
+func (c *ChatClient) GetNotice() chan string {
+	return c.noticeChan
+}
+
+func (c *ChatClient) notice(text string) {
+	clientLog.Info("notice", "text", text)
+	select {
+	case c.noticeChan <- text:
+	default:
+	}
 }
 
 func (c *ChatClient) GetPeerMsg() chan *PeerMsg {
 	return c.peerMsgChan
 }
 
-func (c *ChatClient) Destroy() {
-	close(c.punchChan)
-	c.conn.Close()
-	close(c.peerMsgChan)
-	close(c.serverRecvChan)
-	log.Printf("Destroy...")
+// Subscribe 订阅收到的聊天消息，返回的函数用于取消订阅
+// 订阅者处理太慢时消息会被丢弃，不会阻塞接收循环
+func (c *ChatClient) Subscribe() (<-chan *PeerMsg, func()) {
+	ch := make(chan *PeerMsg, 16)
+	c.subLock.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.subLock.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.subLock.Lock()
+			delete(c.subscribers, ch)
+			close(ch)
+			c.subLock.Unlock()
+		})
+	}
+}
+
+func (c *ChatClient) publishPeerMsg(msg *PeerMsg) {
+	c.saveIncomingHistory(msg)
+	c.subLock.Lock()
+	for ch := range c.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			clientLog.Warn("subscriber too slow, drop msg", "from", msg.ID)
+		}
+	}
+	c.subLock.Unlock()
+	select {
+	case c.peerMsgChan <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+// Peers 返回已打洞成功的对端信息
+func (c *ChatClient) Peers() map[int]ClientInfo {
+	peers := make(map[int]ClientInfo)
+	c.clients.Range(func(key, value interface{}) bool {
+		peers[key.(int)] = value.(ClientInfo)
+		return true
+	})
+	return peers
+}
+
+// ID 返回登录后服务器分配的ID，未登录为0
+func (c *ChatClient) ID() int {
+	id, _, _ := c.identity()
+	return id
+}
+
+// identity 当前登录的ID、名字和token
+func (c *ChatClient) identity() (int, string, string) {
+	c.identLock.RLock()
+	defer c.identLock.RUnlock()
+	return c.id, c.name, c.token
+}
+
+func (c *ChatClient) setIdentity(id int, name, token string) {
+	c.identLock.Lock()
+	c.id, c.name, c.token = id, name, token
+	c.identLock.Unlock()
+}
+
+// clearID 登出或者被踢之后不再心跳，名字留着
+func (c *ChatClient) clearID() {
+	c.identLock.Lock()
+	c.id, c.token = 0, ""
+	c.identLock.Unlock()
+}
+
+// server 当前服务器的地址
+func (c *ChatClient) server() *net.UDPAddr {
+	c.confLock.RLock()
+	defer c.confLock.RUnlock()
+	return c.serverAddr
+}
+
+// fromOldServer addr是不是切换profile之前的服务器
+func (c *ChatClient) fromOldServer(addr string) bool {
+	c.confLock.RLock()
+	defer c.confLock.RUnlock()
+	_, ok := c.oldServers[addr]
+	return ok
+}
+
+func (c *ChatClient) privateKey() *ecdh.PrivateKey {
+	c.confLock.RLock()
+	defer c.confLock.RUnlock()
+	return c.key
+}
+
+func (c *ChatClient) punchCount() int {
+	c.confLock.RLock()
+	defer c.confLock.RUnlock()
+	return c.punchCnt
+}
+
+// requestTimeout 等服务器回复的超时时间
+func (c *ChatClient) requestTimeout() time.Duration {
+	c.confLock.RLock()
+	defer c.confLock.RUnlock()
+	return c.recvTimeout
 }
 
 func (c *ChatClient) init() error {
-	c.serverRecvChan = make(chan *proto.ServerResponse)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.pending = newPendingRequests()
 	c.punchChan = make(chan *net.UDPAddr)
 	c.targetsInfo = new(sync.Map)
 	c.punchTargetsInfo = new(sync.Map)
 	c.wantPunchPeersInfo = new(sync.Map)
 	c.peerMsgChan = make(chan *PeerMsg, 2)
 	c.clients = new(sync.Map)
+	c.subscribers = make(map[chan *PeerMsg]struct{})
+	c.transfers = new(sync.Map)
+	c.recvParts = new(sync.Map)
+	c.transferChan = make(chan *TransferEvent, 64)
+	c.sessions = new(sync.Map)
+	c.forwards = new(sync.Map)
+	c.exitPeers = new(sync.Map)
+	c.rooms = new(sync.Map)
+	c.roomChan = make(chan string, 16)
+	c.seenMsgs = newMsgSeenSet()
+	c.noticeChan = make(chan string, 16)
 
 	return c.listen()
 }
 
-// listen 客户端之间的连接
+// listen 客户端之间的连接，已经设置了conn（比如测试里的模拟网络）时直接用
 func (c *ChatClient) listen() (err error) {
+	if c.conn != nil {
+		return nil
+	}
 	c.conn, err = reuseport.ListenPacket("udp", c.LocalAddr.String())
 	return
 }
 
 func (c *ChatClient) recvMsgLoop() {
-	b := make([]byte, 1024)
+	defer c.wg.Done()
+	b := make([]byte, 2048)
 
-	log.Printf("start recv")
+	clientLog.Info("start recv", "laddr", c.LocalAddr)
 	for {
 		n, addr, err := c.conn.ReadFrom(b)
 		if err != nil {
-			log.Printf("read error: %+v\n", err)
+			if c.ctx.Err() != nil {
+				clientLog.Info("stop recv")
+				return
+			}
+			clientLog.Error("read fail", "err", err)
 			break
 		}
-		if addr.String() == c.ServerAddr.String() {
+		if addr.String() == c.server().String() {
 			if err := c.handleServerMsg(b[:n]); err != nil {
-				log.Printf("handle server msg error: %+v", err)
+				clientLog.Warn("handle server msg fail", "err", err)
 			}
 			continue
 		}
+		if c.fromOldServer(addr.String()) {
+			clientLog.Debug("drop msg from old server", "addr", addr)
+			continue
+		}
 		c.handleClientMsg(addr, b[:n])
 	}
 }
 
 func (c *ChatClient) handleClientMsg(addr net.Addr, data []byte) {
 	msg := string(data)
-	log.Printf("recv [%s] %s\n", addr, msg)
+	if proto.IsMuxMsg(msg) {
+		c.handleMuxMsg(addr, data[len(proto.MuxMsgPrefix):])
+		return
+	}
+	clientLog.Debug("recv from peer", "addr", addr, "data", msg)
 
 	if proto.IsPunchReply(msg) {
 		// 主动打洞，收到了回复，说明打洞成功了
 		if val, ok := c.punchTargetsInfo.Load(addr.String()); ok {
-			val.(*PunchPeerInfo).IsDone = true
+			if !val.(*PunchPeerInfo).markDone() {
+				// 已经成功了，这是对方对后面的打洞请求的回复
+				return
+			}
 			if id, name, err := proto.ParsePunchReplyInfo(msg); err == nil {
 				// 保存对方的个人信息
 				c.clients.Store(id, ClientInfo{Name: name, Addr: addr})
-				log.Printf("save info: %d %s", id, name)
+				punchLog.Info("save peer info", "id", id, "name", name)
 			} else {
-				log.Printf("parse info err: %v", err)
+				punchLog.Warn("parse peer info fail", "addr", addr, "err", err)
+			}
+			punchLog.Info("主动打洞，收到了回应", "addr", addr)
+			// 对方的NAT可能过滤了之前的打洞请求，再发一个，对方收到才知道打洞成功，停止回应
+			id, name, _ := c.identity()
+			if err := c.sendToPeer(addr, proto.BuildPunchReq(strconv.Itoa(id), name)); err != nil {
+				punchLog.Warn("send punch req fail", "addr", addr, "err", err)
 			}
-			log.Printf("[%s] 主动打洞，收到了回应\n", addr)
 		} else {
-			log.Printf("bad punch reply, addr %s not found\n", addr)
+			punchLog.Warn("bad punch reply, addr not found", "addr", addr)
 		}
 		return
 	}
@@ -137,55 +340,155 @@ func (c *ChatClient) handleClientMsg(addr net.Addr, data []byte) {
 		if !ok {
 			return
 		}
-		val.(*PunchPeerInfo).IsDone = true
-		if id, name, err := proto.ParsePunchReqInfo(msg); err == nil {
-			c.clients.Store(id, ClientInfo{Name: name, Addr: addr})
-			log.Printf("save info: %d %s", id, name)
-		} else {
-			log.Printf("parse info err: %v", err)
+		if val.(*PunchPeerInfo).markDone() {
+			if id, name, err := proto.ParsePunchReqInfo(msg); err == nil {
+				c.clients.Store(id, ClientInfo{Name: name, Addr: addr})
+				punchLog.Info("save peer info", "id", id, "name", name)
+			} else {
+				punchLog.Warn("parse peer info fail", "addr", addr, "err", err)
+			}
+			punchLog.Info("被动打洞，收到了打洞请求", "addr", addr)
+		}
+		// 之前的回复可能被对方的NAT过滤了，每个请求都回复，主动的一方收到回复才知道打洞成功
+		// 它只对第一个回复再发请求，不会来回发个没完
+		id, name, _ := c.identity()
+		if err := c.sendToPeer(addr, proto.BuildPunchReply(strconv.Itoa(id), name)); err != nil {
+			punchLog.Warn("send punch reply fail", "addr", addr, "err", err)
 		}
-		log.Printf("[%s] 被动打洞，收到了打洞请求\n", addr)
+		return
+	}
+	if proto.IsFileMsg(msg) {
+		c.handleFileMsg(addr, msg)
+		return
+	}
+	if proto.IsGroupMsg(msg) {
+		c.handleGroupMsg(addr, c.peerIDByAddr(addr), msg)
+		return
+	}
+	if proto.IsByeMsg(msg) {
+		c.handleBye(addr, msg)
 		return
 	}
 
-	log.Printf("recv peer msg: <%s> %s", addr, msg)
+	clientLog.Debug("recv peer msg", "addr", addr, "msg", msg)
 	id, msg, err := proto.ParseChatMsg(msg)
 	if err != nil {
-		log.Printf("bad char msg: %s", msg)
+		clientLog.Warn("bad chat msg", "addr", addr, "msg", msg)
 		return
 	}
 	client, ok := c.clients.Load(id)
 	if !ok {
-		log.Printf("%d not found in clients", id)
+		clientLog.Warn("peer not found in clients", "id", id)
 		return
 	}
 	// 普通消息
-	c.peerMsgChan <- &PeerMsg{
+	c.publishPeerMsg(&PeerMsg{
 		UDPAddr: addr,
 		Msg:     msg,
 		ID:      id,
 		Info:    client.(ClientInfo),
-	}
+	})
 	return
 }
 
 func (c *ChatClient) handleServerMsg(data []byte) error {
-	log.Printf("recv from server: %s\n", data)
+	clientLog.Debug("recv from server", "data", string(data))
 
 	// 心跳
 	if proto.IsHeartbeatReply(string(data)) {
-		log.Printf("get heartbeat reply: %s", data)
+		clientLog.Debug("heartbeat reply")
+		return nil
+	}
+
+	// 服务器不认识自己了，重新登录，登录要等回复，不能阻塞接收循环
+	if proto.IsReloginMsg(string(data)) {
+		if c.ID() != 0 && atomic.CompareAndSwapInt32(&c.relogging, 0, 1) {
+			go c.relogin()
+		}
+		return nil
+	}
+
+	// 管理员的通知
+	if isNotice, text, err := proto.TryParseNoticeMsg(data); isNotice {
+		if err != nil {
+			return err
+		}
+		c.notice("[server] " + text)
+		return nil
+	}
+
+	// 服务器要停止了，重启后心跳会触发重新登录
+	if isShutdown, seconds, err := proto.TryParseShutdownMsg(data); isShutdown {
+		if err != nil {
+			return err
+		}
+		c.notice(fmt.Sprintf("server shutting down in %ds", seconds))
+		return nil
+	}
+
+	// 被管理员踢下线，不再心跳，也就不会自动重新登录
+	if isKicked, reason, err := proto.TryParseKickedMsg(data); isKicked {
+		if err != nil {
+			return err
+		}
+		c.clearID()
+		c.notice(fmt.Sprintf("kicked by server: %s, #login to login again", reason))
 		return nil
 	}
 
 	// 看看是不是打洞消息
-	isPunch, addr := proto.TryParsePunchMsg(data)
-	if isPunch {
+	if isPunch, addr, err := proto.TryParsePunchMsg(data); isPunch {
+		if err != nil {
+			return err
+		}
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
 			return fmt.Errorf("resolve punch addr error: %+v", err)
 		}
-		c.punchChan <- udpAddr
+		select {
+		case c.punchChan <- udpAddr:
+		case <-c.ctx.Done():
+		}
+		return nil
+	}
+
+	// 房间成员变化
+	if isUpdate, room, members, err := proto.TryParseRoomUpdate(data); isUpdate {
+		if err != nil {
+			return err
+		}
+		if _, err := c.loadRoom(room); err == nil {
+			c.updateRoom(room, members)
+		}
+		return nil
+	}
+
+	// 离线消息
+	if isOffline, m, err := proto.TryParseOfflineMsg(data); isOffline {
+		if err != nil {
+			return err
+		}
+		c.handleOfflineMsg(m)
+		return nil
+	}
+
+	// 对端换了地址
+	if isChange, id, addr, err := proto.TryParseAddrChange(data); isChange {
+		if err != nil {
+			return err
+		}
+		go c.handleAddrChange(id, addr)
+		return nil
+	}
+
+	// 服务器中转的消息
+	if isRelay, srcID, payload, err := proto.TryParseRelayMsg(data); isRelay {
+		if err != nil {
+			return err
+		}
+		if proto.IsGroupMsg(payload) {
+			c.handleGroupMsg(c.server(), srcID, payload)
+		}
 		return nil
 	}
 
@@ -194,29 +497,42 @@ func (c *ChatClient) handleServerMsg(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("parse server resp error: %+v\n", err)
 	}
-	log.Printf("server resp: %+v\n", resp)
-	c.serverRecvChan <- resp
+	clientLog.Debug("server resp", "cmd", resp.Cmd, "ok", resp.Result, "code", resp.Code, "data", resp.Data)
+	if !c.pending.deliver(resp) {
+		clientLog.Debug("drop unexpected resp", "id", resp.ReqID, "cmd", resp.Cmd)
+	}
 
 	return nil
 }
 
 // recvPunchLoop 接收来自p2p server的打洞请求
 func (c *ChatClient) recvPunchLoop() {
-	for addr := range c.punchChan {
-		log.Printf("do punch addr: %s\n", addr)
+	defer c.wg.Done()
+	for {
+		var addr *net.UDPAddr
+		select {
+		case addr = <-c.punchChan:
+		case <-c.ctx.Done():
+			return
+		}
+		punchLog.Info("punch back", "addr", addr)
 
-		addr := addr
-		c.wantPunchPeersInfo.Store(addr.String(), &PunchPeerInfo{UDPAddr: addr})
+		info := &PunchPeerInfo{UDPAddr: addr}
+		c.wantPunchPeersInfo.Store(addr.String(), info)
 		// 需要主动发送打洞消息
-		for i := 0; i < *PunchCnt; i++ {
-			v, _ := c.wantPunchPeersInfo.Load(addr.String())
-			if v.(*PunchPeerInfo).IsDone {
-				log.Printf("被动打洞还没发完10次就成功了 %s\n", addr)
+		for i, n := 0, c.punchCount(); i < n; i++ {
+			if v, ok := c.wantPunchPeersInfo.Load(addr.String()); !ok || v != info {
+				// 对端退出了，或者又来了新的打洞请求
+				break
+			}
+			if info.Done() {
+				punchLog.Info("被动打洞还没发完就成功了", "addr", addr)
 				break
 			}
-			log.Printf("send punch reply to %s OK\n", addr)
-			if err := c.sendToPeer(addr, proto.BuildPunchReply(strconv.Itoa(c.id), c.name)); err != nil {
-				log.Printf("send to peer error: %+v\n", err)
+			punchLog.Debug("send punch reply", "addr", addr)
+			id, name, _ := c.identity()
+			if err := c.sendToPeer(addr, proto.BuildPunchReply(strconv.Itoa(id), name)); err != nil {
+				punchLog.Warn("send punch reply fail", "addr", addr, "err", err)
 				break
 			}
 			time.Sleep(time.Duration(100) * time.Millisecond)
@@ -224,123 +540,177 @@ func (c *ChatClient) recvPunchLoop() {
 	}
 }
 
-func (c *ChatClient) recvServerData() (*proto.ServerResponse, error) {
-	select {
-	case data := <-c.serverRecvChan:
-		return data, nil
-	case <-time.After(time.Duration(*RecvServerTimeout) * time.Second):
-		return nil, fmt.Errorf("recv data timeout\n")
+func (c *ChatClient) sendToPeer(addr net.Addr, msg string) error {
+	if err := c.writeToPeer(addr, []byte(msg)); err != nil {
+		return err
 	}
+	clientLog.Debug("send to peer", "addr", addr, "data", msg)
+	return nil
 }
-func (c *ChatClient) sendToPeer(addr net.Addr, msg string) error {
-	b := []byte(msg)
+
+func (c *ChatClient) writeToPeer(addr net.Addr, b []byte) error {
 	n, err := c.conn.WriteTo(b, addr)
-	if err != nil || n != len(b) {
+	if err != nil {
 		return err
 	}
-	log.Printf("send to peer <%s> %s OK", addr, msg)
+	if n != len(b) {
+		return fmt.Errorf("short write: %d/%d", n, len(b))
+	}
 	return nil
 }
 
+// peerIDByAddr 根据地址找到已打洞的对端ID，找不到返回0
+func (c *ChatClient) peerIDByAddr(addr net.Addr) int {
+	id := 0
+	c.clients.Range(func(key, value interface{}) bool {
+		if value.(ClientInfo).Addr.String() == addr.String() {
+			id = key.(int)
+			return false
+		}
+		return true
+	})
+	return id
+}
+
 func (c *ChatClient) SendToPeerByID(id int, msg string) error {
 	client, ok := c.clients.Load(id)
 	if !ok {
 		return fmt.Errorf("%d not found", id)
 	}
-	return c.sendToPeer(client.(ClientInfo).Addr, proto.BuildChatMsg(c.id, msg))
-}
-
-func (c *ChatClient) sendCmdToServer(cmd string) error {
-	b := []byte(cmd)
-	n, err := c.conn.WriteTo(b, c.ServerAddr)
-	if err != nil || n != len(b) {
+	id, name, _ := c.identity()
+	if err := c.sendToPeer(client.(ClientInfo).Addr, proto.BuildChatMsg(id, msg)); err != nil {
 		return err
 	}
+	c.saveHistory("", client.(ClientInfo).Name, name, msg, time.Time{})
 	return nil
 }
 
+func (c *ChatClient) sendCmdToServer(cmd string) error {
+	return c.writeToPeer(c.server(), []byte(cmd))
+}
+
 func (c *ChatClient) sendHeartbeatToServerLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		// has login
-		if c.id != 0 {
-			if err := c.sendCmdToServer(proto.BuildHeartbeatMsg(c.id)); err != nil {
-				log.Printf("send heartbeat fail: %+v", err)
+		if id, _, token := c.identity(); id != 0 {
+			if err := c.sendCmdToServer(proto.BuildHeartbeatMsg(id, token)); err != nil {
+				clientLog.Warn("send heartbeat fail", "err", err)
 			}
 		}
 
-		time.Sleep(time.Duration(1) * time.Second)
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
 	}
 }
 
-func (c *ChatClient) login(name string) error {
-	c.name = name
-	return c.sendCmdToServer(proto.Cmd(proto.CmdLogin, name))
+// relogin 用原来的名字和公钥重新登录，账号的ID不变，然后重新加入之前的房间
+func (c *ChatClient) relogin() {
+	defer atomic.StoreInt32(&c.relogging, 0)
+
+	oldID, name, _ := c.identity()
+	c.notice("server asks to relogin")
+	if err := c.DoLogin(c.ctx, name); err != nil {
+		c.notice(fmt.Sprintf("relogin fail: %+v", err))
+		return
+	}
+	if id := c.ID(); id != oldID {
+		c.notice(fmt.Sprintf("relogin success, ID changed: %d -> %d", oldID, id))
+	} else {
+		c.notice(fmt.Sprintf("relogin success, ID: %d", id))
+	}
+
+	for _, room := range c.Rooms() {
+		err := c.DoJoinRoom(c.ctx, room.Name)
+		if errors.Is(err, ErrNotFound) {
+			// 服务器上房间已经没了，重新创建
+			err = c.DoCreateRoom(c.ctx, room.Name)
+		}
+		if err != nil {
+			c.notice(fmt.Sprintf("rejoin %s fail: %+v", room.Name, err))
+		}
+	}
 }
 
-func (c *ChatClient) DoLogin(name string) error {
-	if err := c.login(name); err != nil {
-		return fmt.Errorf("send cmd error: %+v", err)
+// login 先要挑战，再带上公钥和证明登录
+func (c *ChatClient) login(ctx context.Context, name string) (*proto.ServerResponse, error) {
+	resp, err := c.request(ctx, proto.Cmd(proto.CmdChallenge, name))
+	if err != nil || !resp.Result {
+		return resp, err
+	}
+	proof, err := c.loginProof(name, resp.Data)
+	if err != nil {
+		return nil, err
 	}
-	resp, err := c.recvServerData()
+	return c.request(ctx, proto.Cmd(proto.CmdLogin, name, c.publicKey(), proof))
+}
+
+func (c *ChatClient) DoLogin(ctx context.Context, name string) error {
+	resp, err := c.login(ctx, name)
 	if err != nil {
-		return fmt.Errorf("recv server resp fail: %+v", err)
+		return err
 	}
-	if resp == nil || !resp.Result {
-		return fmt.Errorf("login fail: %s, try again", resp.Data)
+	if !resp.Result {
+		return respError(resp)
 	}
-	id, err := strconv.Atoi(resp.Data)
+	segs := strings.Fields(resp.Data)
+	if len(segs) == 0 {
+		return fmt.Errorf("bad login resp: %s", resp.Data)
+	}
+	id, err := strconv.Atoi(segs[0])
 	if err != nil {
 		return fmt.Errorf("atoi fail, id must be int: %+v", err)
 	}
-	c.id = id
+	token := ""
+	if len(segs) > 1 {
+		token = segs[1]
+	}
+	c.setIdentity(id, name, token)
 	c.onceHeartbeat.Do(func() {
 		go c.sendHeartbeatToServerLoop()
 	})
 	return nil
 }
 
-func (c *ChatClient) logout() error {
-	c.name = ""
-	return c.sendCmdToServer(proto.Cmd(proto.CmdLogout, strconv.Itoa(c.id)))
+func (c *ChatClient) logout(ctx context.Context) (*proto.ServerResponse, error) {
+	return c.request(ctx, proto.Cmd(proto.CmdLogout, strconv.Itoa(c.ID())))
 }
 
-func (c *ChatClient) DoLogout() error {
-	if c.id == 0 {
+func (c *ChatClient) DoLogout(ctx context.Context) error {
+	if c.ID() == 0 {
 		return fmt.Errorf("not login")
 	}
 
-	if err := c.logout(); err != nil {
-		return fmt.Errorf("send cmd error: %+v", err)
-	}
-	resp, err := c.recvServerData()
+	resp, err := c.logout(ctx)
 	if err != nil {
-		return fmt.Errorf("recv server resp fail: %+v", err)
+		return err
 	}
-	if resp == nil || !resp.Result {
-		return fmt.Errorf("logout fail: %s, try again", resp.Data)
+	if !resp.Result {
+		return respError(resp)
 	}
-	c.id = 0
+	c.setIdentity(0, "", "")
 	return nil
 }
 
-func (c *ChatClient) getPeerClientAddr(peerID int) error {
-	return c.sendCmdToServer(proto.Cmd(proto.CmdGet, strconv.Itoa(peerID)))
+func (c *ChatClient) getPeerClientAddr(ctx context.Context, peerID int) (*proto.ServerResponse, error) {
+	return c.request(ctx, proto.Cmd(proto.CmdGet, strconv.Itoa(peerID)))
 }
 
-func (c *ChatClient) DoGet(peerID int) error {
-	if c.id == 0 {
+func (c *ChatClient) DoGet(ctx context.Context, peerID int) error {
+	if c.ID() == 0 {
 		return fmt.Errorf("not login")
 	}
 
-	if err := c.getPeerClientAddr(peerID); err != nil {
-		return fmt.Errorf("send cmd error: %+v", err)
-	}
-	resp, err := c.recvServerData()
+	resp, err := c.getPeerClientAddr(ctx, peerID)
 	if err != nil {
-		return fmt.Errorf("recv server resp fail: %+v", err)
+		return err
 	}
-	if resp == nil || !resp.Result {
-		return fmt.Errorf("get fail: %s, try again", resp.Data)
+	if !resp.Result {
+		return respError(resp)
 	}
 
 	addr, err := net.ResolveUDPAddr("udp", resp.Data)
@@ -353,42 +723,49 @@ func (c *ChatClient) DoGet(peerID int) error {
 	return nil
 }
 
-func (c *ChatClient) punch(targetID int) error {
-	return c.sendCmdToServer(proto.Cmd(proto.CmdPunch, strconv.Itoa(c.id), strconv.Itoa(targetID)))
+func (c *ChatClient) punch(ctx context.Context, targetID int) (*proto.ServerResponse, error) {
+	return c.request(ctx, proto.Cmd(proto.CmdPunch, strconv.Itoa(c.ID()), strconv.Itoa(targetID)))
 }
 
-func (c *ChatClient) DoPunch(targetID int) error {
+func (c *ChatClient) DoPunch(ctx context.Context, targetID int) error {
 	addr, ok := c.targetsInfo.Load(targetID)
 	if !ok {
 		return fmt.Errorf("not get peer %d addr now", targetID)
 	}
 
-	if err := c.punch(targetID); err != nil {
-		return fmt.Errorf("send cmd error: %+v", err)
-	}
-	resp, err := c.recvServerData()
+	resp, err := c.punch(ctx, targetID)
 	if err != nil {
-		return fmt.Errorf("recv server resp fail: %+v", err)
+		return err
 	}
-	if resp == nil || !resp.Result {
-		return fmt.Errorf("punch fail: %s, try again", resp.Data)
+	if !resp.Result {
+		return respError(resp)
 	}
 
 	v, ok := c.punchTargetsInfo.Load(addr.(string))
-	for i := 0; i < *PunchCnt; i++ {
-		if ok && v.(*PunchPeerInfo).IsDone {
+	if !ok {
+		// 对端已经退出了
+		return fmt.Errorf("not get peer %d addr now", targetID)
+	}
+	info := v.(*PunchPeerInfo)
+	for i, n := 0, c.punchCount(); i < n; i++ {
+		if info.Done() {
 			// 提前结束
-			log.Printf("%d %s getPunchDone when send punch\n", targetID, addr)
+			punchLog.Info("punch done early", "id", targetID, "addr", addr)
 			break
 		}
-		if err := c.sendToPeer(v.(*PunchPeerInfo).UDPAddr, proto.BuildPunchReq(strconv.Itoa(c.id), c.name)); err != nil {
+		id, name, _ := c.identity()
+		if err := c.sendToPeer(info.UDPAddr, proto.BuildPunchReq(strconv.Itoa(id), name)); err != nil {
 			return fmt.Errorf("send to peer fail: %+v\n", err)
 		}
-		time.Sleep(time.Duration(100) * time.Millisecond)
+		select {
+		case <-time.After(time.Duration(100) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	v.(*PunchPeerInfo).IsDone = false
-	log.Printf("send all punch req\n")
+	info.reset()
+	punchLog.Debug("send all punch req", "id", targetID)
 	return nil
 }
 
@@ -409,15 +786,31 @@ func (c *ChatClient) ExecInput(text string) string {
 		if len(args) != 1 {
 			return "bad login cmd"
 		}
-		if err := c.DoLogin(args[0]); err != nil {
+		if err := c.DoLogin(c.ctx, args[0]); err != nil {
 			return fmt.Sprintf("exec cmd error: %+v", err)
 		}
-		return fmt.Sprintf("login success, ID: %d", c.id)
+		return fmt.Sprintf("login success, ID: %d", c.ID())
+	case "profile":
+		if len(args) == 0 {
+			profiles, err := c.Profiles()
+			if err != nil {
+				return fmt.Sprintf("exec cmd error: %+v", err)
+			}
+			return profiles
+		}
+		if len(args) != 1 {
+			return "bad profile cmd"
+		}
+		hint, err := c.SwitchProfile(args[0])
+		if err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return hint
 	case "logout":
-		if err := c.DoLogout(); err != nil {
+		if err := c.DoLogout(c.ctx); err != nil {
 			return fmt.Sprintf("exec cmd error: %+v", err)
 		}
-		log.Printf("logout success")
+		clientLog.Info("logout")
 	case "get":
 		if len(args) != 1 {
 			return "bad get cmd"
@@ -426,7 +819,7 @@ func (c *ChatClient) ExecInput(text string) string {
 		if err != nil {
 			return fmt.Sprintf("%s: bad id format, must be int", args[0])
 		}
-		if err := c.DoGet(v); err != nil {
+		if err := c.DoGet(c.ctx, v); err != nil {
 			return fmt.Sprintf("exec cmd error: %+v", err)
 		}
 		addr, _ := c.targetsInfo.Load(v)
@@ -439,11 +832,147 @@ func (c *ChatClient) ExecInput(text string) string {
 		if err != nil {
 			return fmt.Sprintf("%s: bad id format, must be int", args[0])
 		}
-		if err := c.DoPunch(v); err != nil {
+		if err := c.DoPunch(c.ctx, v); err != nil {
 			return fmt.Sprintf("exec cmd error: %+v", err)
 		}
 		addr, _ := c.targetsInfo.Load(v)
 		return fmt.Sprintf("punch %d success, addr: %s", v, addr)
+	case "send":
+		if len(args) < 2 {
+			return "bad send cmd"
+		}
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Sprintf("%s: bad id format, must be int", args[0])
+		}
+		t, err := c.SendFile(v, strings.Join(args[1:], " "))
+		if err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("offer %s to %d, waiting for accept", t.Name, v)
+	case "accept":
+		if len(args) != 1 {
+			return "bad accept cmd"
+		}
+		t, err := c.AcceptFile(args[0])
+		if err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("accept %s from %d", t.Name, t.PeerID)
+	case "reject":
+		if len(args) != 1 {
+			return "bad reject cmd"
+		}
+		if err := c.RejectFile(args[0]); err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("reject %s", args[0])
+	case "forward":
+		if len(args) != 3 {
+			return "bad forward cmd"
+		}
+		v, err1 := strconv.Atoi(args[0])
+		port, err2 := strconv.Atoi(args[1])
+		if err1 != nil || err2 != nil {
+			return "bad id or port format, must be int"
+		}
+		if _, err := c.StartForward(v, port, args[2]); err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("forward 127.0.0.1:%d -> %d -> %s", port, v, args[2])
+	case "unforward":
+		if len(args) != 1 {
+			return "bad unforward cmd"
+		}
+		port, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Sprintf("%s: bad port format, must be int", args[0])
+		}
+		if err := c.StopForward(port); err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("unforward %d", port)
+	case "create", "join", "leave", "members":
+		if len(args) != 1 {
+			return fmt.Sprintf("bad %s cmd", cmd)
+		}
+		var err error
+		switch cmd {
+		case "create":
+			err = c.DoCreateRoom(c.ctx, args[0])
+		case "join":
+			err = c.DoJoinRoom(c.ctx, args[0])
+		case "leave":
+			err = c.DoLeaveRoom(c.ctx, args[0])
+		default:
+			var room *Room
+			if room, err = c.DoMembers(c.ctx, args[0]); err == nil {
+				return fmt.Sprintf("%s: %s", room.Name, proto.BuildMembers(room.Members))
+			}
+		}
+		if err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("%s %s success", cmd, args[0])
+	case "offline":
+		if len(args) < 2 {
+			return "bad offline cmd"
+		}
+		if err := c.DoSendOffline(c.ctx, args[0], strings.Join(args[1:], " ")); err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("offline msg to %s saved", args[0])
+	case "export":
+		if len(args) != 2 && len(args) != 3 {
+			return "bad export cmd"
+		}
+		format := exportFormat(args[1])
+		if len(args) == 3 {
+			format = args[2]
+		}
+		n, err := c.ExportHistory(args[0], args[1], format)
+		if err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("export %d msgs to %s", n, args[1])
+	case "import":
+		if len(args) != 1 {
+			return "bad import cmd"
+		}
+		n, err := c.ImportHistory(args[0])
+		if err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("import %d msgs from %s", n, args[0])
+	case "socks":
+		if len(args) != 2 {
+			return "bad socks cmd"
+		}
+		v, err1 := strconv.Atoi(args[0])
+		port, err2 := strconv.Atoi(args[1])
+		if err1 != nil || err2 != nil {
+			return "bad id or port format, must be int"
+		}
+		if _, err := c.StartSocks(v, port); err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("socks5 proxy on 127.0.0.1:%d via %d", port, v)
+	case "allow", "disallow":
+		if len(args) != 1 {
+			return fmt.Sprintf("bad %s cmd", cmd)
+		}
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Sprintf("%s: bad id format, must be int", args[0])
+		}
+		if cmd == "disallow" {
+			c.DisallowPeer(v)
+			return fmt.Sprintf("%d can not use this client as exit", v)
+		}
+		if err := c.AllowPeer(v); err != nil {
+			return fmt.Sprintf("exec cmd error: %+v", err)
+		}
+		return fmt.Sprintf("%d can use this client as exit", v)
 	default:
 		return "unknown cmd"
 	}
@@ -454,6 +983,7 @@ func (c *ChatClient) Run() (err error) {
 	if err := c.init(); err != nil {
 		return err
 	}
+	c.wg.Add(2)
 	go c.recvPunchLoop()
 	go c.recvMsgLoop()
 
@@ -466,6 +996,9 @@ func (c *ChatClient) Run() (err error) {
 var p2pChatClient *ChatClient
 
 func RunP2PChatClient() {
+	if err := applyProfileFlags(); err != nil {
+		panic(err)
+	}
 	localUDPAddr, err := net.ResolveUDPAddr("udp", *LocalAddr)
 	if err != nil {
 		panic(err)
@@ -475,11 +1008,33 @@ func RunP2PChatClient() {
 		panic(err)
 	}
 
+	exitRules, err := parseExitRules(*ExitAllow)
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := loadOrCreateKey(*KeyFile)
+	if err != nil {
+		panic(err)
+	}
+	history, err := OpenHistoryStore(*HistoryFile)
+	if err != nil {
+		panic(err)
+	}
+
 	p2pChatClient = &ChatClient{
-		LocalAddr:  localUDPAddr,
-		ServerAddr: serverUDPAddr,
+		LocalAddr: localUDPAddr,
+		exitRules: exitRules,
+		history:   history,
+
+		serverAddr:  serverUDPAddr,
+		key:         key,
+		profile:     startProfileName,
+		punchCnt:    *PunchCnt,
+		recvTimeout: time.Duration(*RecvServerTimeout) * time.Second,
 	}
 	if err := p2pChatClient.Run(); err != nil {
 		panic(err)
 	}
+	go p2pChatClient.autoLogin(startProfile)
 }
@@ -0,0 +1,274 @@
+// 配置文件里的多个profile，每个profile是一个服务器和身份，启动时用-profile选择，运行时用#profile切换
+//
+// default = "home"
+//
+// [profiles.home]
+// server = "1.2.3.4:10086"
+// laddr = "0.0.0.0:10001"
+// name = "alice"
+// autologin = true
+// punch_count = 30
+// timeout = 15
+// key = "~/.p2p-chat/home.key"
+//
+// [profiles.work]
+// server = "5.6.7.8:10086"
+// name = "alice-work"
+// key = "~/.p2p-chat/work.key"
+package main
+
+import (
+	"crypto/ecdh"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var (
+	ConfigFile  = flag.String("config", "~/.p2p-chat.toml", "配置文件，不存在时只用命令行参数")
+	ProfileName = flag.String("profile", "", "使用配置文件里的哪个profile，为空用default")
+)
+
+type Profile struct {
+	Server     string `toml:"server"`
+	LocalAddr  string `toml:"laddr"`
+	Name       string `toml:"name"`
+	AutoLogin  bool   `toml:"autologin"` // 启动或者切换后用name自动登录
+	PunchCount int    `toml:"punch_count"`
+	Timeout    int    `toml:"timeout"` // 收服务器的包超时时间，单位秒
+	Key        string `toml:"key"`
+}
+
+type ProfileConfig struct {
+	Default  string              `toml:"default"`
+	Profiles map[string]*Profile `toml:"profiles"`
+}
+
+// expandHome 把开头的~换成家目录
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// loadProfiles 配置文件不存在时返回空的配置
+func loadProfiles(path string) (*ProfileConfig, error) {
+	pc := &ProfileConfig{}
+	if len(path) == 0 {
+		return pc, nil
+	}
+	md, err := toml.DecodeFile(expandHome(path), pc)
+	if os.IsNotExist(err) {
+		return pc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown config keys: %v", undecoded)
+	}
+	for name, p := range pc.Profiles {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	return pc, nil
+}
+
+func (p *Profile) validate() error {
+	if len(p.Server) > 0 {
+		if _, err := net.ResolveUDPAddr("udp", p.Server); err != nil {
+			return fmt.Errorf("bad server: %v", err)
+		}
+	}
+	if len(p.LocalAddr) > 0 {
+		if _, err := net.ResolveUDPAddr("udp", p.LocalAddr); err != nil {
+			return fmt.Errorf("bad laddr: %v", err)
+		}
+	}
+	if p.PunchCount < 0 || p.Timeout < 0 {
+		return fmt.Errorf("punch_count and timeout must not be negative")
+	}
+	if p.AutoLogin && len(p.Name) == 0 {
+		return fmt.Errorf("autologin needs name")
+	}
+	return nil
+}
+
+// Get name为空时用default，都为空时返回nil
+func (pc *ProfileConfig) Get(name string) (*Profile, string, error) {
+	if len(name) == 0 {
+		name = pc.Default
+	}
+	if len(name) == 0 {
+		return nil, "", nil
+	}
+	p, ok := pc.Profiles[name]
+	if !ok {
+		return nil, "", fmt.Errorf("profile %s not found", name)
+	}
+	return p, name, nil
+}
+
+func (pc *ProfileConfig) Names() []string {
+	names := make([]string, 0, len(pc.Profiles))
+	for name := range pc.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startProfile 启动时选中的profile，没有配置时为nil
+var (
+	startProfile     *Profile
+	startProfileName string
+)
+
+// applyProfileFlags 用profile填充命令行里没有指定的参数，命令行优先
+func applyProfileFlags() error {
+	pc, err := loadProfiles(*ConfigFile)
+	if err != nil {
+		return fmt.Errorf("load config %s error: %v", *ConfigFile, err)
+	}
+	p, name, err := pc.Get(*ProfileName)
+	if err != nil || p == nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	values := map[string]string{"raddr": p.Server, "laddr": p.LocalAddr, "key": expandHome(p.Key)}
+	if p.PunchCount > 0 {
+		values["n"] = strconv.Itoa(p.PunchCount)
+	}
+	if p.Timeout > 0 {
+		values["t"] = strconv.Itoa(p.Timeout)
+	}
+	for k, v := range values {
+		if set[k] || len(v) == 0 {
+			continue
+		}
+		if err := flag.Set(k, v); err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	startProfile, startProfileName = p, name
+	return nil
+}
+
+// autoLogin 启动时按profile自动登录
+func (c *ChatClient) autoLogin(p *Profile) {
+	if p == nil || !p.AutoLogin {
+		return
+	}
+	if err := c.DoLogin(c.ctx, p.Name); err != nil {
+		c.notice(fmt.Sprintf("auto login as %s fail: %+v", p.Name, err))
+		return
+	}
+	c.notice(fmt.Sprintf("auto login as %s, ID: %d", p.Name, c.ID()))
+}
+
+// SwitchProfile 退出当前服务器，换成profile的服务器和身份，本地地址需要重启才能换
+func (c *ChatClient) SwitchProfile(name string) (string, error) {
+	pc, err := loadProfiles(*ConfigFile)
+	if err != nil {
+		return "", err
+	}
+	p, ok := pc.Profiles[name]
+	if !ok {
+		return "", fmt.Errorf("profile %s not found", name)
+	}
+
+	serverAddr := c.server()
+	if len(p.Server) > 0 {
+		if serverAddr, err = net.ResolveUDPAddr("udp", p.Server); err != nil {
+			return "", err
+		}
+	}
+	key := c.privateKey()
+	if len(p.Key) > 0 {
+		if key, err = loadOrCreateKey(expandHome(p.Key)); err != nil {
+			return "", err
+		}
+	}
+
+	if c.ID() != 0 {
+		if err := c.DoLogout(c.ctx); err != nil {
+			c.notice(fmt.Sprintf("logout before switch fail: %+v", err))
+		}
+	}
+	c.clearID()
+	c.switchServer(name, p, serverAddr, key)
+
+	var hints []string
+	hints = append(hints, fmt.Sprintf("switch to %s, server: %s", name, serverAddr))
+	if len(p.LocalAddr) > 0 && p.LocalAddr != c.LocalAddr.String() {
+		hints = append(hints, "laddr needs restart")
+	}
+	if p.AutoLogin {
+		if err := c.DoLogin(c.ctx, p.Name); err != nil {
+			return "", fmt.Errorf("login as %s fail: %+v", p.Name, err)
+		}
+		hints = append(hints, fmt.Sprintf("login as %s, ID: %d", p.Name, c.ID()))
+	}
+	return strings.Join(hints, ", "), nil
+}
+
+// switchServer 换成新的服务器和身份，旧服务器记下来，之后它发来的包直接丢掉
+func (c *ChatClient) switchServer(name string, p *Profile, serverAddr *net.UDPAddr, key *ecdh.PrivateKey) {
+	c.confLock.Lock()
+	defer c.confLock.Unlock()
+	if old := c.serverAddr.String(); old != serverAddr.String() {
+		if c.oldServers == nil {
+			c.oldServers = make(map[string]struct{})
+		}
+		c.oldServers[old] = struct{}{}
+	}
+	delete(c.oldServers, serverAddr.String())
+	c.serverAddr = serverAddr
+	c.key = key
+	if p.PunchCount > 0 {
+		c.punchCnt = p.PunchCount
+	}
+	if p.Timeout > 0 {
+		c.recvTimeout = time.Duration(p.Timeout) * time.Second
+	}
+	c.profile = name
+}
+
+// Profiles 配置文件里的profile，当前使用的前面加*
+func (c *ChatClient) Profiles() (string, error) {
+	pc, err := loadProfiles(*ConfigFile)
+	if err != nil {
+		return "", err
+	}
+	names := pc.Names()
+	if len(names) == 0 {
+		return "no profiles in " + *ConfigFile, nil
+	}
+	c.confLock.RLock()
+	current := c.profile
+	c.confLock.RUnlock()
+	for i, name := range names {
+		if name == current {
+			names[i] = "*" + name
+		}
+	}
+	return strings.Join(names, " "), nil
+}
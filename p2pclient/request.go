@@ -0,0 +1,104 @@
+// 发给服务器的命令都带请求ID，回复按ID交给等待的调用，并发的命令不会收到别人的回复
+// 没收到回复时用同一个ID重发，间隔翻倍，服务器对重复的请求直接重发之前的回复
+// 服务器按地址和ID缓存回复，客户端用固定的本地地址重启后ID要和上次不一样，所以从随机数开始
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"udpdemo/proto"
+)
+
+const (
+	requestRetryInterval    = 500 * time.Millisecond
+	requestMaxRetryInterval = 4 * time.Second
+)
+
+type pendingRequests struct {
+	lock sync.Mutex
+	next uint64
+	reqs map[string]chan *proto.ServerResponse // 请求ID -> 等回复的调用
+}
+
+func newPendingRequests() *pendingRequests {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return &pendingRequests{
+		next: binary.BigEndian.Uint64(b[:]),
+		reqs: make(map[string]chan *proto.ServerResponse),
+	}
+}
+
+func (p *pendingRequests) add() (uint64, chan *proto.ServerResponse) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.next++
+	ch := make(chan *proto.ServerResponse, 1)
+	p.reqs[strconv.FormatUint(p.next, 10)] = ch
+	return p.next, ch
+}
+
+func (p *pendingRequests) remove(id uint64) {
+	p.lock.Lock()
+	delete(p.reqs, strconv.FormatUint(id, 10))
+	p.lock.Unlock()
+}
+
+// deliver 把回复交给等待的调用，没人等（超时了或者不带ID）返回false
+func (p *pendingRequests) deliver(resp *proto.ServerResponse) bool {
+	p.lock.Lock()
+	ch, ok := p.reqs[resp.ReqID]
+	p.lock.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- resp:
+	default:
+		// 重发导致的重复回复，已经有一个了
+	}
+	return true
+}
+
+// request 发送命令并等待回复，ctx没有deadline时用-t的超时时间
+func (c *ChatClient) request(ctx context.Context, cmd string) (*proto.ServerResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout())
+		defer cancel()
+	}
+	id, ch := c.pending.add()
+	defer c.pending.remove(id)
+
+	msg := proto.BuildRequest(id, cmd)
+	interval := requestRetryInterval
+	for {
+		if err := c.sendCmdToServer(msg); err != nil {
+			return nil, fmt.Errorf("send cmd error: %+v", err)
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case resp := <-ch:
+			timer.Stop()
+			return resp, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("recv server resp fail: %w", ctx.Err())
+		case <-c.ctx.Done():
+			timer.Stop()
+			return nil, errClosed
+		case <-timer.C:
+		}
+		if interval *= 2; interval > requestMaxRetryInterval {
+			interval = requestMaxRetryInterval
+		}
+	}
+}
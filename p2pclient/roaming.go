@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"udpdemo/mux"
+)
+
+// handleAddrChange 打过洞的对端换了公网地址，旧的复用会话已经不通了，关掉后向新地址重新打洞
+func (c *ChatClient) handleAddrChange(id int, addr string) {
+	client, ok := c.clients.Load(id)
+	if !ok {
+		punchLog.Warn("addr change of unknown peer", "id", id)
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		punchLog.Warn("resolve changed addr fail", "id", id, "addr", addr, "err", err)
+		return
+	}
+	oldAddr := client.(ClientInfo).Addr
+	if oldAddr.String() == udpAddr.String() {
+		return
+	}
+	c.notice(fmt.Sprintf("%d %s moved: %s -> %s", id, client.(ClientInfo).Name, oldAddr, udpAddr))
+
+	if sess, ok := c.sessions.LoadAndDelete(oldAddr.String()); ok {
+		sess.(*mux.Session).Close()
+	}
+	c.targetsInfo.Store(id, udpAddr.String())
+	c.punchTargetsInfo.Store(udpAddr.String(), &PunchPeerInfo{UDPAddr: udpAddr})
+	if err := c.DoPunch(c.ctx, id); err != nil {
+		c.notice(fmt.Sprintf("re-punch %d fail: %+v", id, err))
+		return
+	}
+	// 打洞成功时会用新地址更新对端信息
+	if client, ok := c.clients.Load(id); ok && client.(ClientInfo).Addr.String() == udpAddr.String() {
+		c.notice(fmt.Sprintf("re-punch %d success", id))
+		return
+	}
+	c.notice(fmt.Sprintf("re-punch %d no reply", id))
+}
@@ -0,0 +1,270 @@
+// 群聊房间，成员由服务器维护并在变化时推送，消息由发送者发给每个成员，没打洞的成员通过服务器中转
+// 成员收到新消息后再转发给自己打洞成功的其他成员（gossip），服务器挂了或者有成员只能连上部分人时房间仍然可用
+// 每条消息带有唯一ID和ttl，收到重复的消息直接丢弃
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"udpdemo/proto"
+)
+
+const (
+	seenMsgKeep    = 10 * time.Minute
+	seenMsgMaxSize = 10000
+
+	groupMsgTTL = 6 // 最多转发几跳
+)
+
+// Room 房间成员的快照，更新时整体替换
+type Room struct {
+	Name    string
+	Members map[int]string // ID -> name
+}
+
+// msgSeenSet 已经收到过的消息ID，用于去重
+// ID按收到的时间顺序放在环形队列里，Add时从队头删掉过期的，满了删最老的，Add均摊O(1)
+type msgSeenSet struct {
+	lock  sync.Mutex
+	msgs  map[string]struct{}
+	ring  []seenMsg
+	head  int // 最老的一条
+	count int
+}
+
+type seenMsg struct {
+	id string
+	t  time.Time
+}
+
+func newMsgSeenSet() *msgSeenSet {
+	return &msgSeenSet{msgs: make(map[string]struct{}), ring: make([]seenMsg, seenMsgMaxSize)}
+}
+
+// Add 返回true表示第一次见到
+func (s *msgSeenSet) Add(msgID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.msgs[msgID]; ok {
+		return false
+	}
+	now := time.Now()
+	for s.count > 0 && (s.count == len(s.ring) || now.Sub(s.ring[s.head].t) > seenMsgKeep) {
+		delete(s.msgs, s.ring[s.head].id)
+		s.ring[s.head] = seenMsg{}
+		s.head = (s.head + 1) % len(s.ring)
+		s.count--
+	}
+	s.ring[(s.head+s.count)%len(s.ring)] = seenMsg{id: msgID, t: now}
+	s.count++
+	s.msgs[msgID] = struct{}{}
+	return true
+}
+
+func newMsgID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *ChatClient) GetRoomEvent() chan string {
+	return c.roomChan
+}
+
+func (c *ChatClient) updateRoom(name string, members map[int]string) {
+	c.rooms.Store(name, &Room{Name: name, Members: members})
+	select {
+	case c.roomChan <- name:
+	default:
+	}
+}
+
+func (c *ChatClient) deleteRoom(name string) {
+	c.rooms.Delete(name)
+	select {
+	case c.roomChan <- name:
+	default:
+	}
+}
+
+// Rooms 已加入的房间，按名字排序
+func (c *ChatClient) Rooms() []*Room {
+	var rooms []*Room
+	c.rooms.Range(func(key, value interface{}) bool {
+		rooms = append(rooms, value.(*Room))
+		return true
+	})
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+func (c *ChatClient) loadRoom(name string) (*Room, error) {
+	v, ok := c.rooms.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("not in room %s", name)
+	}
+	return v.(*Room), nil
+}
+
+func (c *ChatClient) doRoomCmd(ctx context.Context, cmd, name string) (map[int]string, error) {
+	id := c.ID()
+	if id == 0 {
+		return nil, fmt.Errorf("not login")
+	}
+	resp, err := c.request(ctx, proto.Cmd(cmd, name, strconv.Itoa(id)))
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Result {
+		return nil, respError(resp)
+	}
+	if cmd == proto.CmdLeave {
+		return nil, nil
+	}
+	return proto.ParseMembers(resp.Data)
+}
+
+func (c *ChatClient) DoCreateRoom(ctx context.Context, name string) error {
+	members, err := c.doRoomCmd(ctx, proto.CmdCreate, name)
+	if err != nil {
+		return err
+	}
+	c.updateRoom(name, members)
+	return nil
+}
+
+func (c *ChatClient) DoJoinRoom(ctx context.Context, name string) error {
+	members, err := c.doRoomCmd(ctx, proto.CmdJoin, name)
+	if err != nil {
+		return err
+	}
+	c.updateRoom(name, members)
+	return nil
+}
+
+func (c *ChatClient) DoLeaveRoom(ctx context.Context, name string) error {
+	if _, err := c.doRoomCmd(ctx, proto.CmdLeave, name); err != nil {
+		return err
+	}
+	c.deleteRoom(name)
+	return nil
+}
+
+func (c *ChatClient) DoMembers(ctx context.Context, name string) (*Room, error) {
+	members, err := c.doRoomCmd(ctx, proto.CmdMembers, name)
+	if err != nil {
+		return nil, err
+	}
+	c.updateRoom(name, members)
+	return c.loadRoom(name)
+}
+
+// SendToRoom 发给房间里打洞成功的成员，其他的通过服务器中转，服务器不可用时依靠其他成员转发
+func (c *ChatClient) SendToRoom(name, text string) error {
+	room, err := c.loadRoom(name)
+	if err != nil {
+		return err
+	}
+	selfID, selfName, _ := c.identity()
+	m := &proto.GroupMsg{Room: name, MsgID: newMsgID(), SrcID: selfID, TTL: groupMsgTTL, Name: selfName, Text: text}
+	c.seenMsgs.Add(m.MsgID)
+	payload := proto.BuildGroupMsg(m)
+
+	sent := c.gossipGroupMsg(room, payload, 0, selfID)
+	for id := range room.Members {
+		if id == selfID {
+			continue
+		}
+		if _, ok := c.clients.Load(id); ok {
+			continue
+		}
+		if err := c.sendCmdToServer(proto.Cmd(proto.CmdRelay, strconv.Itoa(selfID), strconv.Itoa(id), payload)); err != nil {
+			roomLog.Warn("relay group msg fail", "room", name, "id", id, "err", err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && len(room.Members) > 1 {
+		return fmt.Errorf("no member reachable in %s", name)
+	}
+	c.saveHistory(m.MsgID, "@"+name, selfName, text, time.Time{})
+	return nil
+}
+
+// gossipGroupMsg 转发给打洞成功的房间成员，跳过消息来源和原始发送者，返回发送成功的数量
+func (c *ChatClient) gossipGroupMsg(room *Room, payload string, fromID, srcID int) int {
+	sent := 0
+	selfID := c.ID()
+	c.clients.Range(func(key, value interface{}) bool {
+		id := key.(int)
+		if id == fromID || id == srcID || id == selfID {
+			return true
+		}
+		if _, ok := room.Members[id]; !ok {
+			return true
+		}
+		if err := c.sendToPeer(value.(ClientInfo).Addr, payload); err != nil {
+			roomLog.Warn("send group msg fail", "room", room.Name, "id", id, "err", err)
+			return true
+		}
+		sent++
+		return true
+	})
+	return sent
+}
+
+// handleGroupMsg 处理直接收到或者服务器中转的群消息，fromID为确认过的上一跳
+// 上一跳必须是房间成员，原始发送者可能是本地成员列表里还没有的人（服务器不可用时加入的推送收不到）
+func (c *ChatClient) handleGroupMsg(addr net.Addr, fromID int, msg string) {
+	m, err := proto.ParseGroupMsg(msg)
+	if err != nil {
+		roomLog.Warn("bad group msg", "addr", addr, "err", err)
+		return
+	}
+	room, err := c.loadRoom(m.Room)
+	if err != nil {
+		roomLog.Warn("group msg of unknown room", "from", fromID, "err", err)
+		return
+	}
+	if _, ok := room.Members[fromID]; !ok {
+		roomLog.Warn("group msg from non-member", "from", fromID, "room", m.Room)
+		return
+	}
+	if !c.seenMsgs.Add(m.MsgID) {
+		return
+	}
+
+	if m.TTL > 1 {
+		m.TTL--
+		c.gossipGroupMsg(room, proto.BuildGroupMsg(m), fromID, m.SrcID)
+	}
+
+	name, ok := room.Members[m.SrcID]
+	if !ok {
+		name = m.Name
+	}
+	info := ClientInfo{Name: name, Addr: addr}
+	if client, ok := c.clients.Load(m.SrcID); ok {
+		info = client.(ClientInfo)
+	}
+	c.publishPeerMsg(&PeerMsg{
+		ID:      m.SrcID,
+		Info:    info,
+		UDPAddr: addr,
+		Msg:     m.Text,
+		Room:    m.Room,
+		MsgID:   m.MsgID,
+	})
+}
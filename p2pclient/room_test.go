@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMsgSeenSet 去重，满了淘汰最老的，过期的在下次Add时删掉
+func TestMsgSeenSet(t *testing.T) {
+	s := newMsgSeenSet()
+	if !s.Add("a") || s.Add("a") {
+		t.Fatal("dedup fail")
+	}
+	for i := 0; i < seenMsgMaxSize; i++ {
+		s.Add(strconv.Itoa(i))
+	}
+	if len(s.msgs) != seenMsgMaxSize || s.count != seenMsgMaxSize {
+		t.Fatalf("size %d/%d, want %d", len(s.msgs), s.count, seenMsgMaxSize)
+	}
+	if !s.Add("a") {
+		t.Fatal("oldest not evicted")
+	}
+	if s.Add(strconv.Itoa(seenMsgMaxSize - 1)) {
+		t.Fatal("newest evicted")
+	}
+
+	// 把所有记录改成过期的，下一次Add全部清掉
+	for i := range s.ring {
+		s.ring[i].t = time.Now().Add(-seenMsgKeep - time.Second)
+	}
+	s.Add("b")
+	if len(s.msgs) != 1 || s.count != 1 {
+		t.Fatalf("expired not pruned: %d/%d", len(s.msgs), s.count)
+	}
+}
@@ -0,0 +1,299 @@
+// 本地控制接口，通过unix socket提供JSON-RPC 2.0服务，每行一个请求
+// 方法：login/connect/send/peers/subscribe，subscribe之后收到的消息以message通知推送
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"udpdemo/proto"
+)
+
+var RPCSocket = flag.String("rpc", "", "本地控制接口unix socket路径，为空则不开启")
+
+const (
+	rpcVersion = "2.0"
+
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcServerErrorData 服务器失败回复的错误码，放在error.data里
+type rpcServerErrorData struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcPeer struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+type rpcMessage struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	Msg  string `json:"msg"`
+	Room string `json:"room,omitempty"`
+}
+
+type RPCServer struct {
+	Path   string
+	Client *ChatClient
+
+	listener net.Listener
+}
+
+func (s *RPCServer) ListenAndServe() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen 创建socket，只有当前用户可以连接
+func (s *RPCServer) Listen() error {
+	// 上次异常退出可能残留socket文件，只删socket，路径写错时不能删掉别的文件
+	if fi, err := os.Lstat(s.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", s.Path)
+		}
+		if err := os.Remove(s.Path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// 先在只有自己能进的临时目录里创建socket并改好权限再移过去，否则创建和chmod之间别的用户可以连进来
+	dir, err := ioutil.TempDir(filepath.Dir(s.Path), ".rpc")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return err
+	}
+	// 移走之后关闭时自己删除s.Path
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+	rpcLog.Info("listen", "path", s.Path)
+	return nil
+}
+
+func (s *RPCServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *RPCServer) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	os.Remove(s.Path)
+	return err
+}
+
+// rpcConn 一个控制连接，写操作需要加锁，因为订阅推送和请求回复会并发写
+type rpcConn struct {
+	conn net.Conn
+	lock sync.Mutex
+	enc  *json.Encoder
+
+	unsubscribe func()
+}
+
+func (rc *rpcConn) write(resp *rpcResponse) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	resp.JSONRPC = rpcVersion
+	if err := rc.enc.Encode(resp); err != nil {
+		rpcLog.Warn("write fail", "err", err)
+	}
+}
+
+func (s *RPCServer) serveConn(conn net.Conn) {
+	rc := &rpcConn{conn: conn, enc: json.NewEncoder(conn)}
+	defer func() {
+		if rc.unsubscribe != nil {
+			rc.unsubscribe()
+		}
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req rpcRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			rc.write(&rpcResponse{Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		if req.JSONRPC != rpcVersion || len(req.Method) == 0 {
+			rc.write(&rpcResponse{ID: req.ID, Error: &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}})
+			continue
+		}
+		result, rerr := s.call(rc, &req)
+		// 没有id的是通知，不需要回复
+		if len(req.ID) == 0 {
+			continue
+		}
+		if rerr != nil {
+			rc.write(&rpcResponse{ID: req.ID, Error: rerr})
+			continue
+		}
+		rc.write(&rpcResponse{ID: req.ID, Result: result})
+	}
+	if err := scanner.Err(); err != nil {
+		rpcLog.Warn("read fail", "err", err)
+	}
+}
+
+func invalidParams(err error) *rpcError {
+	return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+}
+
+func internalError(err error) *rpcError {
+	rerr := &rpcError{Code: rpcInternalError, Message: err.Error()}
+	var serr *ServerError
+	if errors.As(err, &serr) && serr.Code != proto.CodeUnknown {
+		rerr.Data = &rpcServerErrorData{Code: int(serr.Code), Reason: serr.Code.String()}
+	}
+	return rerr
+}
+
+func (s *RPCServer) call(rc *rpcConn, req *rpcRequest) (interface{}, *rpcError) {
+	switch req.Method {
+	case "login":
+		var params struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params.Name) == 0 {
+			return nil, invalidParams(fmt.Errorf("name is required"))
+		}
+		if err := s.Client.DoLogin(s.Client.ctx, params.Name); err != nil {
+			return nil, internalError(err)
+		}
+		return map[string]int{"id": s.Client.ID()}, nil
+	case "connect":
+		var params struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.ID == 0 {
+			return nil, invalidParams(fmt.Errorf("id is required"))
+		}
+		if err := s.Client.DoGet(s.Client.ctx, params.ID); err != nil {
+			return nil, internalError(err)
+		}
+		if err := s.Client.DoPunch(s.Client.ctx, params.ID); err != nil {
+			return nil, internalError(err)
+		}
+		addr, _ := s.Client.targetsInfo.Load(params.ID)
+		return map[string]interface{}{"id": params.ID, "addr": addr}, nil
+	case "send":
+		var params struct {
+			ID  int    `json:"id"`
+			Msg string `json:"msg"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.ID == 0 {
+			return nil, invalidParams(fmt.Errorf("id and msg are required"))
+		}
+		if err := s.Client.SendToPeerByID(params.ID, params.Msg); err != nil {
+			return nil, internalError(err)
+		}
+		return true, nil
+	case "peers":
+		peers := make([]rpcPeer, 0)
+		for id, info := range s.Client.Peers() {
+			peers = append(peers, rpcPeer{ID: id, Name: info.Name, Addr: info.Addr.String()})
+		}
+		return peers, nil
+	case "subscribe":
+		if rc.unsubscribe != nil {
+			return true, nil
+		}
+		ch, cancel := s.Client.Subscribe()
+		rc.unsubscribe = cancel
+		go func() {
+			for msg := range ch {
+				rc.write(&rpcResponse{Method: "message", Params: rpcMessage{
+					ID:   msg.ID,
+					Name: msg.Info.Name,
+					Addr: msg.UDPAddr.String(),
+					Msg:  msg.Msg,
+					Room: msg.Room,
+				}})
+			}
+		}()
+		return true, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %s not found", req.Method)}
+}
+
+var rpcServer *RPCServer
+
+func runRPCServer() {
+	if len(*RPCSocket) == 0 {
+		return
+	}
+	rpcServer = &RPCServer{Path: *RPCSocket, Client: p2pChatClient}
+	if err := rpcServer.Listen(); err != nil {
+		rpcLog.Error("listen fail", "path", *RPCSocket, "err", err)
+		rpcServer = nil
+		return
+	}
+	go func() {
+		if err := rpcServer.Serve(); err != nil {
+			rpcLog.Error("server stop", "err", err)
+		}
+	}()
+}
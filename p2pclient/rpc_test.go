@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"udpdemo/netsim"
+)
+
+type rpcTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Scanner
+}
+
+func dialRPC(t *testing.T, path string) *rpcTestConn {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rpcTestConn{t: t, conn: conn, r: bufio.NewScanner(conn)}
+}
+
+// next 读下一行回复或者通知
+func (c *rpcTestConn) next() map[string]json.RawMessage {
+	c.t.Helper()
+	if !c.r.Scan() {
+		c.t.Fatalf("read rpc: %v", c.r.Err())
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(c.r.Bytes(), &resp); err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// call 发请求，返回result，失败时测试失败
+func (c *rpcTestConn) call(method string, params interface{}) json.RawMessage {
+	c.t.Helper()
+	req := map[string]interface{}{"jsonrpc": rpcVersion, "id": 1, "method": method, "params": params}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		c.t.Fatal(err)
+	}
+	resp := c.next()
+	if e, ok := resp["error"]; ok {
+		c.t.Fatalf("%s: %s", method, e)
+	}
+	return resp["result"]
+}
+
+// TestRPCRoundTrip 通过socket调用peers/send/subscribe
+func TestRPCRoundTrip(t *testing.T) {
+	n := netsim.New(1)
+	server := startSimServer(t, n)
+	a := newSimClient(t, n, netsim.FullCone, "100.0.0.1", server, "a")
+	b := newSimClient(t, n, netsim.FullCone, "100.0.0.2", server, "b")
+	if !punch(t, a, b) {
+		t.Fatal("punch fail")
+	}
+
+	s := &RPCServer{Path: filepath.Join(t.TempDir(), "a.sock"), Client: a}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	if fi, err := os.Lstat(s.Path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode: %v %v", fi.Mode(), err)
+	}
+
+	c := dialRPC(t, s.Path)
+	var peers []rpcPeer
+	if err := json.Unmarshal(c.call("peers", nil), &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != b.ID() || peers[0].Name != "b" {
+		t.Fatalf("peers: %+v", peers)
+	}
+
+	c.call("send", map[string]interface{}{"id": b.ID(), "msg": "hi b"})
+	expectChat(t, b, a.ID(), "hi b")
+
+	c.call("subscribe", nil)
+	if err := b.SendToPeerByID(a.ID(), "hi a"); err != nil {
+		t.Fatal(err)
+	}
+	note := c.next()
+	var msg rpcMessage
+	if string(note["method"]) != `"message"` || json.Unmarshal(note["params"], &msg) != nil {
+		t.Fatalf("notification: %v", note)
+	}
+	if msg.ID != b.ID() || msg.Msg != "hi a" {
+		t.Fatalf("message: %+v", msg)
+	}
+}
+
+// TestRPCListenPath 残留的socket可以覆盖，不是socket的文件不能删
+func TestRPCListenPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "notsock")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &RPCServer{Path: file}
+	if err := s.Listen(); err == nil {
+		s.Close()
+		t.Fatal("listen over regular file")
+	}
+	if b, err := ioutil.ReadFile(file); err != nil || string(b) != "data" {
+		t.Fatalf("file removed: %v", err)
+	}
+
+	path := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	s = &RPCServer{Path: path}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left after close: %v", err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temp dir left: %d entries", len(entries))
+	}
+}
@@ -0,0 +1,113 @@
+// 退出：Esc或者收到SIGINT/SIGTERM时通知对端、登出，然后停止所有循环
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"udpdemo/mux"
+	"udpdemo/proto"
+)
+
+// exitLogoutTimeout 退出时等登出回复的时间，服务器没回复也照样退出
+const exitLogoutTimeout = time.Second
+
+var errClosed = errors.New("client closed")
+
+// Close 通知打过洞的对端，登出，停止所有循环，只有第一次调用有效
+func (c *ChatClient) Close() {
+	c.closeOnce.Do(func() {
+		c.sayBye()
+		if c.ID() != 0 {
+			if err := c.logoutOnExit(); err != nil {
+				clientLog.Warn("logout on exit fail", "err", err)
+			}
+		}
+		c.cancel()
+		c.forwards.Range(func(key, value interface{}) bool {
+			value.(*Forward).listener.Close()
+			return true
+		})
+		c.sessions.Range(func(key, value interface{}) bool {
+			value.(*mux.Session).Close()
+			return true
+		})
+		c.conn.Close()
+		c.wg.Wait()
+		if err := c.history.Close(); err != nil {
+			historyLog.Error("close fail", "err", err)
+		}
+		clientLog.Info("closed")
+	})
+}
+
+// sayBye 告诉打过洞的对端自己要退出了，不等回复
+func (c *ChatClient) sayBye() {
+	id := c.ID()
+	if id == 0 {
+		return
+	}
+	bye := proto.BuildByeMsg(id)
+	c.clients.Range(func(key, value interface{}) bool {
+		if err := c.sendToPeer(value.(ClientInfo).Addr, bye); err != nil {
+			clientLog.Warn("send bye fail", "id", key, "err", err)
+		}
+		return true
+	})
+}
+
+func (c *ChatClient) logoutOnExit() error {
+	ctx, cancel := context.WithTimeout(c.ctx, exitLogoutTimeout)
+	defer cancel()
+	resp, err := c.logout(ctx)
+	if err != nil {
+		return err
+	}
+	if !resp.Result {
+		return respError(resp)
+	}
+	c.clearID()
+	return nil
+}
+
+// handleBye 对端退出了，删掉和它的连接，地址不对的忽略，防止冒充
+func (c *ChatClient) handleBye(addr net.Addr, msg string) {
+	id, err := proto.ParseByeMsg(msg)
+	if err != nil {
+		clientLog.Warn("bad bye msg", "addr", addr, "err", err)
+		return
+	}
+	v, ok := c.clients.Load(id)
+	if !ok || v.(ClientInfo).Addr.String() != addr.String() {
+		clientLog.Warn("bye from unknown peer", "id", id, "addr", addr)
+		return
+	}
+	c.clients.Delete(id)
+	c.targetsInfo.Delete(id)
+	c.punchTargetsInfo.Delete(addr.String())
+	c.wantPunchPeersInfo.Delete(addr.String())
+	if sess, ok := c.sessions.LoadAndDelete(addr.String()); ok {
+		sess.(*mux.Session).Close()
+	}
+	c.notice(fmt.Sprintf("%d %s left", id, v.(ClientInfo).Name))
+}
+
+// watchSignals 收到信号时和Esc一样退出界面，退出后main里关闭客户端
+func watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		signal.Stop(ch)
+		uiLog.Info("recv signal, quit")
+		if chatUI != nil {
+			chatUI.UI.Update(chatUI.Quit)
+		}
+	}()
+}
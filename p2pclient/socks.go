@@ -0,0 +1,287 @@
+// SOCKS5代理，本地监听，CONNECT请求通过对端转发，对端作为出口
+// 出口端需要授权请求的对端（-allowforward或#allow ID），并且目标要在-exitallow白名单里，端口转发也一样
+// 白名单为空时什么都不允许；本机、链路本地和内网地址只能被明确写出的IP或者网段允许，*和域名规则不包括它们
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ExitAllow = flag.String("exitallow", "", "作为出口时允许连接的目标（端口转发和SOCKS5），逗号分隔，如 *.corp.com:443,127.0.0.1/32:22,10.0.0.0/8；为空不允许任何目标，*只包括公网地址，本机和内网地址要明确写出IP或者网段")
+
+// errExitNotAllowed 出口拒绝连接目标，请求方回复SOCKS的not allowed
+var errExitNotAllowed = errors.New("not allowed")
+
+const (
+	socksVersion = 5
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSuccess         = 0
+	socksRepFailure         = 1
+	socksRepNotAllowed      = 2
+	socksRepCmdUnsupported  = 7
+	socksRepAtypUnsupported = 8
+)
+
+// exitRule 出口白名单规则，host为*、域名、*.后缀或者CIDR，port为空表示任意端口
+type exitRule struct {
+	host    string
+	network *net.IPNet
+	port    string
+}
+
+func parseExitRules(text string) ([]exitRule, error) {
+	var rules []exitRule
+	for _, item := range strings.Split(text, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		rule := exitRule{host: item}
+		if host, port, err := net.SplitHostPort(item); err == nil {
+			rule.host, rule.port = host, port
+			if port == "*" {
+				rule.port = ""
+			}
+		}
+		if strings.Contains(rule.host, "/") {
+			_, network, err := net.ParseCIDR(rule.host)
+			if err != nil {
+				return nil, fmt.Errorf("bad exit rule %s: %v", item, err)
+			}
+			rule.network = network
+		} else if ip := net.ParseIP(rule.host); ip != nil {
+			rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *exitRule) matchHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern := strings.ToLower(r.host)
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// isInternalIP 本机、链路本地、内网、组播和未指定地址
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+// matchIP 有按IP或者网段的规则明确允许ip
+func matchIP(rules []exitRule, ip net.IP, port string) bool {
+	for i := range rules {
+		if rules[i].network != nil && (len(rules[i].port) == 0 || rules[i].port == port) && rules[i].network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName 有按域名的规则允许host，IP只能被*匹配
+func matchName(rules []exitRule, host, port string) bool {
+	isIP := net.ParseIP(host) != nil
+	for i := range rules {
+		rule := &rules[i]
+		if rule.network != nil || (len(rule.port) > 0 && rule.port != port) || (isIP && rule.host != "*") {
+			continue
+		}
+		if rule.matchHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExitTarget 检查目标是否允许连接，返回实际要连接的地址
+// 域名先解析，检查并连接解析出来的IP，避免检查之后域名指向变化，也避免用域名绕过内网地址的限制
+func checkExitTarget(rules []exitRule, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return "", err
+		}
+	}
+	for _, ip := range ips {
+		if matchIP(rules, ip, port) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+		if !isInternalIP(ip) && matchName(rules, host, port) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", fmt.Errorf("%s %w by -exitallow", target, errExitNotAllowed)
+}
+
+// AllowPeer 授权对端把本机作为出口
+func (c *ChatClient) AllowPeer(peerID int) error {
+	if _, ok := c.clients.Load(peerID); !ok {
+		return fmt.Errorf("%d not found", peerID)
+	}
+	c.exitPeers.Store(peerID, struct{}{})
+	return nil
+}
+
+func (c *ChatClient) DisallowPeer(peerID int) {
+	c.exitPeers.Delete(peerID)
+}
+
+func (c *ChatClient) isExitAllowed(peerID int) bool {
+	if *AllowForward {
+		return true
+	}
+	_, ok := c.exitPeers.Load(peerID)
+	return ok
+}
+
+// StartSocks 监听本地端口作为SOCKS5代理，经对端连接目标
+func (c *ChatClient) StartSocks(peerID, localPort int) (*Forward, error) {
+	return c.StartForward(peerID, localPort, "")
+}
+
+func (c *ChatClient) serveSocks(peerID int, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	target, err := socksHandshake(r, conn)
+	if err != nil {
+		socksLog.Warn("handshake fail", "err", err)
+		conn.Close()
+		return
+	}
+
+	st, sr, err := c.openConnectStream(peerID, target)
+	if err != nil {
+		socksLog.Warn("connect fail", "target", target, "peer", peerID, "err", err)
+		rep := byte(socksRepFailure)
+		if errors.Is(err, errExitNotAllowed) {
+			rep = socksRepNotAllowed
+		}
+		socksReply(conn, rep)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksRepSuccess); err != nil {
+		st.Reset()
+		conn.Close()
+		return
+	}
+	socksLog.Info("connect", "target", target, "peer", peerID)
+	// 客户端可能在收到回复之前就发了数据，已经在r里
+	pipeStream(&bufferedConn{Conn: conn, r: r}, st, sr)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *bufferedConn) CloseWrite() error {
+	if tcpConn, ok := b.Conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+// socksHandshake 只支持无认证和CONNECT，返回目标地址host:port
+func socksHandshake(r *bufio.Reader, w io.Writer) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("bad socks version: %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == 0 {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		w.Write([]byte{socksVersion, 0xff})
+		return "", fmt.Errorf("no acceptable auth method")
+	}
+	if _, err := w.Write([]byte{socksVersion, 0}); err != nil {
+		return "", err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(w, socksRepCmdUnsupported)
+		return "", fmt.Errorf("unsupported socks cmd: %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, n)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(w, socksRepAtypUnsupported)
+		return "", fmt.Errorf("unsupported socks atyp: %d", req[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply 绑定地址固定回复0.0.0.0:0
+func socksReply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckExitTarget(t *testing.T) {
+	cases := []struct {
+		rules  string
+		target string
+		want   string // 为空表示不允许
+	}{
+		{"", "8.8.8.8:53", ""},
+		{"", "127.0.0.1:22", ""},
+		{"", "localhost:22", ""},
+		{"", "10.1.2.3:80", ""},
+		{"", "192.168.1.1:80", ""},
+		{"", "169.254.169.254:80", ""},
+		{"", "[::1]:22", ""},
+		{"", "0.0.0.0:22", ""},
+		{"*", "8.8.8.8:53", "8.8.8.8:53"},
+		{"*", "localhost:22", ""},
+		{"*", "10.1.2.3:80", ""},
+		{"127.0.0.1/32:22", "localhost:22", "127.0.0.1:22"},
+		{"localhost", "localhost:22", ""},
+		{"10.0.0.0/8", "10.1.2.3:80", "10.1.2.3:80"},
+		{"10.0.0.0/8", "8.8.8.8:53", ""},
+		{"127.0.0.1:8080", "localhost:8080", "127.0.0.1:8080"},
+		{"127.0.0.1:8080", "127.0.0.1:22", ""},
+		{"8.8.8.8:53", "8.8.4.4:53", ""},
+	}
+	for _, tc := range cases {
+		rules, err := parseExitRules(tc.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := checkExitTarget(rules, tc.target)
+		if len(tc.want) == 0 {
+			if !errors.Is(err, errExitNotAllowed) {
+				t.Errorf("rules %q target %s: got %q %v, want not allowed", tc.rules, tc.target, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("rules %q target %s: got %q %v, want %s", tc.rules, tc.target, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,646 @@
+// 文件传输，走打洞之后的UDP通路
+// 发送方发offer，接收方#accept之后回复已有的偏移量（断点续传），发送方按窗口发送分片，
+// 接收方对每个分片回复累计确认，窗口按慢启动/拥塞避免调整，超时则回退重传
+// 全部确认之后发送方发done，接收方校验sha256后回复结果
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"udpdemo/proto"
+)
+
+var DownloadDir = flag.String("dir", "./downloads", "接收文件的保存目录")
+
+const (
+	fileOfferTimeout  = 60 * time.Second // 等待对方同意的时间，接收方超过这个时间没同意就删掉
+	fileRetryInterval = time.Second
+	fileMaxRetries    = 10 // 连续超时次数，超过则认为对方断开，下次发送同一文件可以续传
+
+	fileInitWindow = 4  // 初始窗口，单位分片
+	fileMaxWindow  = 64 // 最大窗口
+	fileInitRTO    = 500 * time.Millisecond
+	fileMinRTO     = 100 * time.Millisecond
+	fileMaxRTO     = 3 * time.Second
+
+	fileKeepFinished = time.Minute      // 接收完成后保留状态的时间，用于回复重传的done
+	fileIdleTimeout  = 60 * time.Second // 同意之后超过这个时间没收到分片就删掉，.part留着下次续传
+)
+
+type FileTransfer struct {
+	ID       string
+	PeerID   int
+	Name     string
+	Size     int64
+	Hash     string
+	IsSender bool
+
+	addr net.Addr
+	done int64 // 发送方为已确认字节数，接收方为已连续接收字节数，原子操作
+
+	// 接收方的file在#accept时打开，和收分片的循环并发，path、file和下面的状态都由lock保护
+	// 发送方的在创建时就确定了，不需要加锁
+	lock     sync.Mutex
+	path     string // 发送方为源文件，接收方为.part临时文件
+	file     *os.File
+	expired  bool      // 接收方超时没有同意或者同意之后一直没收到分片，已经删掉
+	lastRecv time.Time // 接收方最后收到分片的时间
+	finished bool
+	result   bool
+
+	acceptChan chan int64 // 发送方等待对方同意，-1表示拒绝
+	ackChan    chan int64
+	resultChan chan bool
+}
+
+func (t *FileTransfer) Progress() float64 {
+	if t.Size == 0 {
+		return 100
+	}
+	return float64(atomic.LoadInt64(&t.done)) * 100 / float64(t.Size)
+}
+
+func (t *FileTransfer) String() string {
+	direction := "recv"
+	if t.IsSender {
+		direction = "send"
+	}
+	return fmt.Sprintf("%s %s [%s] %.1f%%", direction, t.Name, t.ID, t.Progress())
+}
+
+// TransferEvent 文件传输事件，Text为空表示进度更新
+type TransferEvent struct {
+	Transfer *FileTransfer
+	Text     string
+}
+
+func (c *ChatClient) GetTransferEvent() chan *TransferEvent {
+	return c.transferChan
+}
+
+// emitTransfer 通知UI，UI处理不过来时丢弃，避免阻塞接收循环
+func (c *ChatClient) emitTransfer(t *FileTransfer, text string) {
+	select {
+	case c.transferChan <- &TransferEvent{Transfer: t, Text: text}:
+	default:
+		transferLog.Warn("event dropped", "transfer", t, "text", text)
+	}
+}
+
+func newFileID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashFile(f *os.File) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func isValidHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+func (c *ChatClient) sendFileMsg(t *FileTransfer, m *proto.FileMsg) error {
+	m.SrcID = c.ID()
+	m.FileID = t.ID
+	return c.sendToPeer(t.addr, proto.BuildFileMsg(m))
+}
+
+// SendFile 向已打洞的对端发送文件，后台进行，进度通过TransferEvent通知
+func (c *ChatClient) SendFile(peerID int, path string) (*FileTransfer, error) {
+	client, ok := c.clients.Load(peerID)
+	if !ok {
+		return nil, fmt.Errorf("%d not found", peerID)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	hash, size, err := hashFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("hash file error: %+v", err)
+	}
+
+	t := &FileTransfer{
+		ID:         newFileID(),
+		PeerID:     peerID,
+		Name:       filepath.Base(path),
+		Size:       size,
+		Hash:       hash,
+		IsSender:   true,
+		addr:       client.(ClientInfo).Addr,
+		path:       path,
+		file:       f,
+		acceptChan: make(chan int64, 1),
+		ackChan:    make(chan int64, fileMaxWindow),
+		resultChan: make(chan bool, 1),
+	}
+	c.transfers.Store(t.ID, t)
+	go c.runSendFile(t)
+	return t, nil
+}
+
+func (c *ChatClient) runSendFile(t *FileTransfer) {
+	defer func() {
+		t.file.Close()
+		c.transfers.Delete(t.ID)
+	}()
+
+	if err := c.doSendFile(t); err != nil {
+		transferLog.Error("send file fail", "transfer", t, "err", err)
+		c.emitTransfer(t, fmt.Sprintf("send %s to %d fail: %v", t.Name, t.PeerID, err))
+		return
+	}
+	c.emitTransfer(t, fmt.Sprintf("send %s to %d success", t.Name, t.PeerID))
+}
+
+func (c *ChatClient) doSendFile(t *FileTransfer) error {
+	offset, err := c.waitFileAccept(t)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&t.done, offset)
+	if offset > 0 {
+		c.emitTransfer(t, fmt.Sprintf("resume %s from %d bytes", t.Name, offset))
+	}
+	if err := c.sendFileData(t, offset); err != nil {
+		return err
+	}
+	return c.waitFileResult(t)
+}
+
+func (c *ChatClient) waitFileAccept(t *FileTransfer) (int64, error) {
+	offer := &proto.FileMsg{Type: proto.FileOffer, Size: t.Size, Hash: t.Hash, Name: t.Name}
+	deadline := time.After(fileOfferTimeout)
+	for {
+		if err := c.sendFileMsg(t, offer); err != nil {
+			return 0, err
+		}
+		select {
+		case offset := <-t.acceptChan:
+			if offset < 0 {
+				return 0, fmt.Errorf("rejected")
+			}
+			if offset > t.Size {
+				offset = 0
+			}
+			return offset, nil
+		case <-time.After(fileRetryInterval):
+		case <-deadline:
+			return 0, fmt.Errorf("wait accept timeout")
+		case <-c.ctx.Done():
+			return 0, errClosed
+		}
+	}
+}
+
+// sendFileData 按拥塞窗口发送分片，窗口内的发送按srtt/cwnd间隔平滑
+func (c *ChatClient) sendFileData(t *FileTransfer, offset int64) error {
+	var (
+		next, acked = offset, offset
+		cwnd        = float64(fileInitWindow)
+		ssthresh    = float64(fileMaxWindow)
+		rto         = fileInitRTO
+		srtt        time.Duration
+		retries     = 0
+		lastReport  = time.Now()
+		buf         = make([]byte, proto.FileChunkSize)
+		sendTimes   = make(map[int64]time.Time) // 分片结束偏移 -> 首次发送时间，用于计算rtt
+	)
+
+	for acked < t.Size {
+		for next < t.Size && next < acked+int64(cwnd)*proto.FileChunkSize {
+			n, err := t.file.ReadAt(buf, next)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("read file error: %+v", err)
+			}
+			if n == 0 {
+				return fmt.Errorf("file changed while sending")
+			}
+			if err := c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileChunk, Offset: next, Data: buf[:n]}); err != nil {
+				return err
+			}
+			next += int64(n)
+			if _, ok := sendTimes[next]; !ok {
+				sendTimes[next] = time.Now()
+			}
+			if srtt > 0 {
+				time.Sleep(srtt / time.Duration(cwnd))
+			}
+		}
+
+		select {
+		case ack := <-t.ackChan:
+			if ack <= acked || ack > next {
+				continue
+			}
+			if sentAt, ok := sendTimes[ack]; ok {
+				rtt := time.Since(sentAt)
+				if srtt == 0 {
+					srtt = rtt
+				} else {
+					srtt = (srtt*7 + rtt) / 8
+				}
+				rto = srtt * 2
+				if rto < fileMinRTO {
+					rto = fileMinRTO
+				}
+			}
+			for end := range sendTimes {
+				if end <= ack {
+					delete(sendTimes, end)
+				}
+			}
+			acked = ack
+			atomic.StoreInt64(&t.done, acked)
+			retries = 0
+			if cwnd < ssthresh {
+				cwnd++
+			} else {
+				cwnd += 1 / cwnd
+			}
+			if cwnd > fileMaxWindow {
+				cwnd = fileMaxWindow
+			}
+			if time.Since(lastReport) > 200*time.Millisecond {
+				lastReport = time.Now()
+				c.emitTransfer(t, "")
+			}
+		case <-time.After(rto):
+			retries++
+			if retries > fileMaxRetries {
+				return fmt.Errorf("peer not responding at %d bytes, send again to resume", acked)
+			}
+			ssthresh = cwnd / 2
+			if ssthresh < 2 {
+				ssthresh = 2
+			}
+			cwnd = 1
+			next = acked
+			rto *= 2
+			if rto > fileMaxRTO {
+				rto = fileMaxRTO
+			}
+			// 重传的分片不参与rtt计算
+			sendTimes = make(map[int64]time.Time)
+		case <-c.ctx.Done():
+			return errClosed
+		}
+	}
+	c.emitTransfer(t, "")
+	return nil
+}
+
+func (c *ChatClient) waitFileResult(t *FileTransfer) error {
+	for i := 0; i < fileMaxRetries; i++ {
+		if err := c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileDone, Result: true}); err != nil {
+			return err
+		}
+		select {
+		case ok := <-t.resultChan:
+			if !ok {
+				return fmt.Errorf("sha256 mismatch on peer side")
+			}
+			return nil
+		case <-time.After(fileRetryInterval):
+		case <-c.ctx.Done():
+			return errClosed
+		}
+	}
+	return fmt.Errorf("wait result timeout")
+}
+
+func (c *ChatClient) loadTransfer(fileID string, isSender bool) (*FileTransfer, error) {
+	v, ok := c.transfers.Load(fileID)
+	if !ok {
+		return nil, fmt.Errorf("transfer %s not found", fileID)
+	}
+	t := v.(*FileTransfer)
+	if t.IsSender != isSender {
+		return nil, fmt.Errorf("transfer %s direction mismatch", fileID)
+	}
+	return t, nil
+}
+
+// AcceptFile 同意接收文件，如果下载目录里有同一文件未完成的部分，则从断点继续
+func (c *ChatClient) AcceptFile(fileID string) (*FileTransfer, error) {
+	t, err := c.loadTransfer(fileID, false)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.expired {
+		return nil, fmt.Errorf("transfer %s not found", fileID)
+	}
+	if t.file != nil {
+		return t, fmt.Errorf("transfer %s already accepted", fileID)
+	}
+	if err := os.MkdirAll(*DownloadDir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := partPath(t)
+	if v, loaded := c.recvParts.LoadOrStore(path, t.ID); loaded {
+		return nil, fmt.Errorf("%s from %d is being received by transfer %s", t.Name, t.PeerID, v)
+	}
+	f, offset, err := openPartFile(path, t.Size)
+	if err != nil {
+		c.recvParts.Delete(path)
+		return nil, err
+	}
+	t.path, t.file, t.lastRecv = path, f, time.Now()
+	atomic.StoreInt64(&t.done, offset)
+	time.AfterFunc(fileIdleTimeout, func() {
+		c.expireIdleTransfer(t)
+	})
+
+	return t, c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileAccept, Offset: offset})
+}
+
+// partPath 接收中的临时文件，按内容和发送方区分，同一个人重新发送可以续传，不同的人发同一个文件互不影响
+func partPath(t *FileTransfer) string {
+	return filepath.Join(*DownloadDir, fmt.Sprintf("%s.%d.part", t.Hash, t.PeerID))
+}
+
+// openPartFile 打开临时文件，返回已有的长度，比文件还长的说明不对，从头开始
+func openPartFile(path string, size int64) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	offset := st.Size()
+	if offset > size {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		offset = 0
+	}
+	return f, offset, nil
+}
+
+// closeRecvFile 关闭接收的临时文件，之后别的传输可以再打开它，需要持有t.lock
+func (c *ChatClient) closeRecvFile(t *FileTransfer) {
+	if t.file == nil {
+		return
+	}
+	t.file.Close()
+	c.recvParts.CompareAndDelete(t.path, t.ID)
+}
+
+func (c *ChatClient) RejectFile(fileID string) error {
+	t, err := c.loadTransfer(fileID, false)
+	if err != nil {
+		return err
+	}
+	c.transfers.Delete(fileID)
+	t.lock.Lock()
+	c.closeRecvFile(t)
+	t.lock.Unlock()
+	return c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileReject})
+}
+
+func (c *ChatClient) handleFileMsg(addr net.Addr, msg string) {
+	m, err := proto.ParseFileMsg(msg)
+	if err != nil {
+		transferLog.Warn("bad file msg", "addr", addr, "err", err)
+		return
+	}
+	client, ok := c.clients.Load(m.SrcID)
+	if !ok || client.(ClientInfo).Addr.String() != addr.String() {
+		transferLog.Warn("file msg from unknown peer", "id", m.SrcID, "addr", addr)
+		return
+	}
+
+	if m.Type == proto.FileOffer {
+		c.handleFileOffer(addr, m, client.(ClientInfo))
+		return
+	}
+
+	v, ok := c.transfers.Load(m.FileID)
+	if !ok {
+		transferLog.Warn("transfer not found", "file", m.FileID)
+		return
+	}
+	t := v.(*FileTransfer)
+	if t.PeerID != m.SrcID {
+		transferLog.Warn("transfer peer mismatch", "file", m.FileID, "id", m.SrcID)
+		return
+	}
+
+	if t.IsSender {
+		switch m.Type {
+		case proto.FileAccept:
+			notifyTransfer(t.acceptChan, m.Offset)
+		case proto.FileReject:
+			notifyTransfer(t.acceptChan, -1)
+		case proto.FileAck:
+			select {
+			case t.ackChan <- m.Offset:
+			default:
+			}
+		case proto.FileDone:
+			select {
+			case t.resultChan <- m.Result:
+			default:
+			}
+		}
+		return
+	}
+
+	switch m.Type {
+	case proto.FileChunk:
+		c.handleFileChunk(t, m)
+	case proto.FileDone:
+		c.finishRecvFile(t)
+	}
+}
+
+func notifyTransfer(ch chan int64, v int64) {
+	select {
+	case ch <- v:
+	default:
+	}
+}
+
+func (c *ChatClient) handleFileOffer(addr net.Addr, m *proto.FileMsg, info ClientInfo) {
+	if v, ok := c.transfers.Load(m.FileID); ok {
+		// 重传的offer，已经同意过则再回复一次
+		t := v.(*FileTransfer)
+		t.lock.Lock()
+		accepted := t.file != nil
+		t.lock.Unlock()
+		if !t.IsSender && accepted {
+			if err := c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileAccept, Offset: atomic.LoadInt64(&t.done)}); err != nil {
+				transferLog.Warn("resend accept fail", "err", err)
+			}
+		}
+		return
+	}
+
+	name := filepath.Base(strings.TrimSpace(m.Name))
+	if !isValidHash(m.Hash) || m.Size < 0 || name == "." || name == ".." || name == string(filepath.Separator) {
+		transferLog.Warn("bad file offer", "msg", m)
+		return
+	}
+	t := &FileTransfer{
+		ID:     m.FileID,
+		PeerID: m.SrcID,
+		Name:   name,
+		Size:   m.Size,
+		Hash:   m.Hash,
+		addr:   addr,
+	}
+	c.transfers.Store(t.ID, t)
+	time.AfterFunc(fileOfferTimeout, func() {
+		c.expireFileOffer(t)
+	})
+	c.emitTransfer(t, fmt.Sprintf("[%d %s] offers file %s (%d bytes), #accept %s or #reject %s",
+		m.SrcID, info.Name, t.Name, t.Size, t.ID, t.ID))
+}
+
+// expireFileOffer 超时还没同意的offer删掉，否则一直留在transfers里
+// 同时回复拒绝，发送方不再重发offer
+func (c *ChatClient) expireFileOffer(t *FileTransfer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file != nil || !c.transfers.CompareAndDelete(t.ID, t) {
+		return
+	}
+	t.expired = true
+	if err := c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileReject}); err != nil {
+		transferLog.Warn("send file reject fail", "err", err)
+	}
+	c.emitTransfer(t, fmt.Sprintf("offer %s from %d expired", t.Name, t.PeerID))
+}
+
+// expireIdleTransfer 同意之后发送方一直没发分片（断开或者退出了），关闭临时文件并删掉，
+// 否则一直留在transfers里占着文件句柄，.part留着，对方重新发送时续传
+func (c *ChatClient) expireIdleTransfer(t *FileTransfer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finished || t.expired {
+		return
+	}
+	if idle := time.Since(t.lastRecv); idle < fileIdleTimeout {
+		time.AfterFunc(fileIdleTimeout-idle, func() {
+			c.expireIdleTransfer(t)
+		})
+		return
+	}
+	if !c.transfers.CompareAndDelete(t.ID, t) {
+		// 已经拒绝了
+		return
+	}
+	t.expired = true
+	c.closeRecvFile(t)
+	c.emitTransfer(t, fmt.Sprintf("recv %s from %d stalled at %d bytes, send again to resume", t.Name, t.PeerID, atomic.LoadInt64(&t.done)))
+}
+
+func (c *ChatClient) handleFileChunk(t *FileTransfer, m *proto.FileMsg) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil || t.finished || t.expired {
+		return
+	}
+	t.lastRecv = time.Now()
+	done := atomic.LoadInt64(&t.done)
+	// 只接收连续的分片，乱序的丢掉，回复当前确认位置让发送方重传
+	if m.Offset == done && done+int64(len(m.Data)) <= t.Size {
+		if _, err := t.file.WriteAt(m.Data, m.Offset); err != nil {
+			transferLog.Error("write file fail", "path", t.path, "err", err)
+			return
+		}
+		done += int64(len(m.Data))
+		atomic.StoreInt64(&t.done, done)
+		if done == t.Size || done/proto.FileChunkSize%64 == 0 {
+			c.emitTransfer(t, "")
+		}
+	}
+	if err := c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileAck, Offset: done}); err != nil {
+		transferLog.Warn("send file ack fail", "err", err)
+	}
+}
+
+func (c *ChatClient) finishRecvFile(t *FileTransfer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil || t.expired {
+		return
+	}
+	if !t.finished {
+		t.finished = true
+		t.result = c.saveRecvFile(t)
+		time.AfterFunc(fileKeepFinished, func() {
+			c.transfers.Delete(t.ID)
+		})
+	}
+	if err := c.sendFileMsg(t, &proto.FileMsg{Type: proto.FileDone, Result: t.result}); err != nil {
+		transferLog.Warn("send file done fail", "err", err)
+	}
+}
+
+// saveRecvFile 校验sha256，通过则改名为原文件名，重名的加序号，需要持有t.lock
+func (c *ChatClient) saveRecvFile(t *FileTransfer) bool {
+	defer c.closeRecvFile(t)
+
+	if atomic.LoadInt64(&t.done) != t.Size {
+		c.emitTransfer(t, fmt.Sprintf("recv %s incomplete", t.Name))
+		return false
+	}
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		transferLog.Error("seek file fail", "path", t.path, "err", err)
+		return false
+	}
+	hash, _, err := hashFile(t.file)
+	if err != nil || hash != t.Hash {
+		transferLog.Error("hash mismatch", "path", t.path, "hash", hash, "err", err)
+		os.Remove(t.path)
+		c.emitTransfer(t, fmt.Sprintf("recv %s fail: sha256 mismatch", t.Name))
+		return false
+	}
+
+	dst := filepath.Join(*DownloadDir, t.Name)
+	ext := filepath.Ext(t.Name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(*DownloadDir, fmt.Sprintf("%s(%d)%s", strings.TrimSuffix(t.Name, ext), i, ext))
+	}
+	if err := os.Rename(t.path, dst); err != nil {
+		transferLog.Error("rename fail", "path", t.path, "err", err)
+		c.emitTransfer(t, fmt.Sprintf("recv %s fail: %v", t.Name, err))
+		return false
+	}
+	c.emitTransfer(t, fmt.Sprintf("recv %s from %d success, saved to %s", t.Name, t.PeerID, dst))
+	return true
+}
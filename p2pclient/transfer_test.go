@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"udpdemo/netsim"
+)
+
+// waitTransfer 等到文本包含want的传输事件，跳过进度更新
+func waitTransfer(t *testing.T, c *ChatClient, want string) *FileTransfer {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-c.GetTransferEvent():
+			if strings.Contains(ev.Text, want) {
+				return ev.Transfer
+			}
+		case <-timeout:
+			t.Fatalf("no transfer event %q", want)
+		}
+	}
+}
+
+func TestE2EFileTransfer(t *testing.T) {
+	dir := t.TempDir()
+	old := *DownloadDir
+	*DownloadDir = filepath.Join(dir, "downloads")
+	defer func() { *DownloadDir = old }()
+
+	n := netsim.New(1)
+	server := startSimServer(t, n)
+	a := newSimClient(t, n, netsim.FullCone, "100.0.0.1", server, "a")
+	b := newSimClient(t, n, netsim.FullCone, "100.0.0.2", server, "b")
+	if !punch(t, a, b) {
+		t.Fatal("punch fail")
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	src := filepath.Join(dir, "a.txt")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同意的同时还在收重传的offer
+	if _, err := a.SendFile(b.ID(), src); err != nil {
+		t.Fatal(err)
+	}
+	offer := waitTransfer(t, b, "offers file")
+	if _, err := b.AcceptFile(offer.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitTransfer(t, b, "success")
+	waitTransfer(t, a, "success")
+	got, err := ioutil.ReadFile(filepath.Join(*DownloadDir, "a.txt"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("recv file mismatch: %v", err)
+	}
+
+	// 没同意的offer超时后删掉并回复拒绝，不能再同意
+	if _, err := a.SendFile(b.ID(), src); err != nil {
+		t.Fatal(err)
+	}
+	offer = waitTransfer(t, b, "offers file")
+	b.expireFileOffer(offer)
+	waitTransfer(t, b, "expired")
+	if _, ok := b.transfers.Load(offer.ID); ok {
+		t.Fatal("expired offer still in transfers")
+	}
+	if _, err := b.AcceptFile(offer.ID); err == nil {
+		t.Fatal("accept expired offer")
+	}
+	if _, err := os.Stat(partPath(offer)); !os.IsNotExist(err) {
+		t.Fatalf("part file created for expired offer: %v", err)
+	}
+	// 发送方收到拒绝，不再重发offer
+	waitTransfer(t, a, "rejected")
+
+	// 同一个人发的同一个文件只能有一个在收；同意之后一直收不到分片的，超时关闭临时文件并删掉
+	first, err := a.SendFile(b.ID(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer = waitTransfer(t, b, "offers file")
+	if _, err := a.SendFile(b.ID(), src); err != nil {
+		t.Fatal(err)
+	}
+	second := waitTransfer(t, b, "offers file")
+	n.SetLoss(1)
+	if _, err := b.AcceptFile(offer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AcceptFile(second.ID); err == nil {
+		t.Fatal("accept two transfers into one part file")
+	}
+	offer.lock.Lock()
+	offer.lastRecv = time.Now().Add(-fileIdleTimeout)
+	file := offer.file
+	offer.lock.Unlock()
+	b.expireIdleTransfer(offer)
+	waitTransfer(t, b, "stalled")
+	if _, ok := b.transfers.Load(offer.ID); ok {
+		t.Fatal("stalled transfer still in transfers")
+	}
+	if _, err := file.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("part file not closed: %v", err)
+	}
+	if _, err := os.Stat(partPath(offer)); err != nil {
+		t.Fatalf("part file removed: %v", err)
+	}
+
+	// 临时文件放出来之后另一个传输可以接着收
+	if _, err := b.AcceptFile(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	n.SetLoss(0)
+	waitTransfer(t, b, "success")
+	if tr := waitTransfer(t, a, "success"); tr == first {
+		t.Fatal("stalled transfer finished")
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/marcusolsson/tui-go"
-	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +21,9 @@ type ChatUI struct {
 	hintLabel *tui.Label
 	hintBox   *tui.Box
 
+	roomLabel *tui.Label
+	roomBox   *tui.Box
+
 	root *tui.Box
 	UI   tui.UI
 }
@@ -49,7 +52,13 @@ func (c *ChatUI) Init() (err error) {
 	c.hintLabel = tui.NewLabel("")
 	c.hintBox = tui.NewHBox(c.hintLabel)
 
-	c.root = tui.NewVBox(c.chatBox, c.hintBox)
+	c.roomLabel = tui.NewLabel("")
+	c.roomBox = tui.NewVBox(c.roomLabel, tui.NewSpacer())
+	c.roomBox.SetBorder(true)
+	c.roomBox.SetTitle("rooms")
+	c.roomBox.SetSizePolicy(tui.Maximum, tui.Expanding)
+
+	c.root = tui.NewVBox(tui.NewHBox(c.roomBox, c.chatBox), c.hintBox)
 
 	c.UI, err = tui.New(c.root)
 	if err != nil {
@@ -64,6 +73,23 @@ func (c *ChatUI) SetHint(text string) {
 	c.hintLabel.SetText(text)
 }
 
+// SetRooms 显示已加入的房间和成员
+func (c *ChatUI) SetRooms(rooms []*Room) {
+	var lines []string
+	for _, room := range rooms {
+		lines = append(lines, "@"+room.Name)
+		ids := make([]int, 0, len(room.Members))
+		for id := range room.Members {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			lines = append(lines, fmt.Sprintf("  %d %s", id, room.Members[id]))
+		}
+	}
+	c.roomLabel.SetText(strings.Join(lines, "\n"))
+}
+
 func (c *ChatUI) Quit() {
 	c.UI.Quit()
 }
@@ -73,8 +99,19 @@ func (c *ChatUI) Run() error {
 }
 
 func (c *ChatUI) AppendMsg(prefix, text string) {
+	c.appendLine(time.Now().Format("15:04"), prefix, text)
+}
+
+// AppendHistory 显示本地保存的聊天记录
+func (c *ChatUI) AppendHistory(msgs []*HistoryMsg) {
+	for _, m := range msgs {
+		c.appendLine(m.Time.Format("01-02 15:04"), m.Conv, fmt.Sprintf("[%s] %s", m.From, m.Text))
+	}
+}
+
+func (c *ChatUI) appendLine(t, prefix, text string) {
 	c.history.Append(tui.NewHBox(
-		tui.NewLabel(time.Now().Format("15:04")),
+		tui.NewLabel(t),
 		tui.NewPadder(1, 0, tui.NewLabel(fmt.Sprintf("<%s>", prefix))),
 		tui.NewLabel(text),
 		tui.NewSpacer(),
@@ -83,20 +120,34 @@ func (c *ChatUI) AppendMsg(prefix, text string) {
 
 var chatUI *ChatUI
 
-func runUI() {
+// runUI 阻塞到界面退出
+func runUI() error {
 	chatUI = &ChatUI{}
 	if err := chatUI.Init(); err != nil {
-		panic(err)
-	}
-	if err := chatUI.Run(); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	chatUI.AppendHistory(p2pChatClient.RecentHistory())
+	return chatUI.Run()
 }
 
 func onSubmit(e *tui.Entry) {
 	text := e.Text()
 	e.SetText("")
 
+	if text[0] == '@' {
+		// 群消息：@room msg
+		segs := strings.SplitN(text[1:], " ", 2)
+		if len(segs) != 2 {
+			chatUI.SetHint("bad room msg")
+			return
+		}
+		if err := p2pChatClient.SendToRoom(segs[0], segs[1]); err != nil {
+			chatUI.SetHint(fmt.Sprintf("send fail: %+v", err))
+		}
+		chatUI.AppendMsg(*LocalAddr, text)
+		return
+	}
+
 	if text[0] != '#' {
 		segs := strings.SplitN(text, " ", 2)
 		if len(segs) != 2 {
@@ -120,9 +171,45 @@ func onSubmit(e *tui.Entry) {
 		e.SetText("")
 		return
 	}
+	if onHistoryCmd(input) {
+		return
+	}
 	chatUI.SetHint(p2pChatClient.ExecInput(input))
 }
 
+// onHistoryCmd 查询聊天记录，结果显示在聊天框
+// #search text
+// #history ID N，ID可以是已打洞的对端ID、名字或者@room
+func onHistoryCmd(input string) bool {
+	cmd, args := parseInput(input)
+	var msgs []*HistoryMsg
+	switch cmd {
+	case "search":
+		if len(args) == 0 {
+			chatUI.SetHint("bad search cmd")
+			return true
+		}
+		msgs = p2pChatClient.SearchHistory(strings.Join(args, " "))
+	case "history":
+		if len(args) != 2 {
+			chatUI.SetHint("bad history cmd")
+			return true
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			chatUI.SetHint(fmt.Sprintf("%s: bad count", args[1]))
+			return true
+		}
+		msgs = p2pChatClient.History(args[0], n)
+	default:
+		return false
+	}
+	chatUI.AppendHistory(msgs)
+	chatUI.SetHint(fmt.Sprintf("%s: %d msgs", cmd, len(msgs)))
+	return true
+}
+
+// onQuit 只退出界面，main里接着关闭客户端
 func onQuit() {
 	chatUI.Quit()
 }
@@ -134,9 +221,66 @@ func displayPeerMsg() {
 			if chatUI == nil {
 				continue
 			}
-			log.Printf("================ [%d %s] %s", data.ID, data.Info.Name, data.Msg)
+			uiLog.Debug("display peer msg", "id", data.ID, "name", data.Info.Name, "msg", data.Msg)
+			prefix := data.UDPAddr.String()
+			if len(data.Room) > 0 {
+				prefix = "@" + data.Room
+			}
+			if !data.Time.IsZero() {
+				prefix = "offline " + data.Time.Format("01-02 15:04")
+			}
+			chatUI.UI.Update(func() {
+				chatUI.AppendMsg(prefix, fmt.Sprintf("[%d %s] %s", data.ID, data.Info.Name, data.Msg))
+			})
+		}
+	}()
+}
+
+func displayTransfer() {
+	go func() {
+		c := p2pChatClient.GetTransferEvent()
+		for e := range c {
+			if chatUI == nil {
+				continue
+			}
+			e := e
+			chatUI.UI.Update(func() {
+				if len(e.Text) == 0 {
+					chatUI.SetHint(e.Transfer.String())
+					return
+				}
+				chatUI.AppendMsg("file", e.Text)
+			})
+		}
+	}()
+}
+
+func displayNotice() {
+	go func() {
+		c := p2pChatClient.GetNotice()
+		for text := range c {
+			if chatUI == nil {
+				continue
+			}
+			text := text
+			chatUI.UI.Update(func() {
+				chatUI.SetHint(text)
+				chatUI.AppendMsg("server", text)
+			})
+		}
+	}()
+}
+
+func displayRooms() {
+	go func() {
+		c := p2pChatClient.GetRoomEvent()
+		for range c {
+			if chatUI == nil {
+				continue
+			}
+			rooms := p2pChatClient.Rooms()
 			chatUI.UI.Update(func() {
-				chatUI.AppendMsg(data.UDPAddr.String(), fmt.Sprintf("[%d %s] %s", data.ID, data.Info.Name, data.Msg))
+				chatUI.SetRooms(rooms)
 			})
 		}
 	}()
@@ -0,0 +1,439 @@
+// 管理接口，-admin指定地址后开启，HTTP+JSON，请求需要带 Authorization: Bearer <-admintoken>
+// GET    /admin/sessions   在线会话
+// POST   /admin/kick       {"id": 1, "reason": "..."} 踢下线
+// GET    /admin/bans       封禁列表
+// POST   /admin/bans       {"ip": "1.2.3.4"} 或 {"name": "bob"} 封禁，在线的会话一起踢掉
+// DELETE /admin/bans       同上，解封
+// POST   /admin/broadcast  {"text": "..."} 通知所有在线客户端
+// GET    /admin/punches    最近的打洞请求
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"udpdemo/proto"
+)
+
+var (
+	AdminAddr  = flag.String("admin", "", "管理接口的HTTP监听地址，比如127.0.0.1:9101，为空不开启")
+	AdminToken = flag.String("admintoken", "", "管理接口的访问token，开启管理接口时必须设置，可以在配置文件里修改")
+)
+
+const (
+	bucketBans = "bans"
+
+	maxNoticeLen   = 512
+	recentPunchMax = 100
+	kickedKeep     = 10 * time.Minute // 记住被踢的会话多久，期间它的心跳都回复kicked
+
+	DropBanned = "banned"
+)
+
+type Ban struct {
+	IP   string    `json:"ip,omitempty"`
+	Name string    `json:"name,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+func (b *Ban) key() string {
+	if len(b.IP) > 0 {
+		return "ip:" + b.IP
+	}
+	return "name:" + b.Name
+}
+
+// BanList 封禁的IP和名字，保存在store里
+type BanList struct {
+	lock  sync.RWMutex
+	store Store
+	bans  map[string]*Ban
+}
+
+func NewBanList(store Store) (*BanList, error) {
+	l := &BanList{store: store, bans: make(map[string]*Ban)}
+	err := store.ForEach(bucketBans, func(key string, value []byte) error {
+		b := &Ban{}
+		if err := json.Unmarshal(value, b); err != nil {
+			return fmt.Errorf("bad ban %s: %v", key, err)
+		}
+		l.bans[key] = b
+		return nil
+	})
+	return l, err
+}
+
+func (l *BanList) Add(b *Ban) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.store.Put(bucketBans, b.key(), b); err != nil {
+		return err
+	}
+	l.bans[b.key()] = b
+	return nil
+}
+
+func (l *BanList) Remove(b *Ban) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.store.Delete(bucketBans, b.key()); err != nil {
+		return err
+	}
+	delete(l.bans, b.key())
+	return nil
+}
+
+func (l *BanList) IPBanned(ip net.IP) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.bans["ip:"+ip.String()]
+	return ok
+}
+
+func (l *BanList) NameBanned(name string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.bans["name:"+name]
+	return ok
+}
+
+func (l *BanList) List() []*Ban {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	bans := make([]*Ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Time.Before(bans[j].Time) })
+	return bans
+}
+
+type PunchAttempt struct {
+	Time       time.Time `json:"time"`
+	UserID     int       `json:"userID"`
+	TargetID   int       `json:"targetID"`
+	UserAddr   string    `json:"userAddr"`
+	TargetAddr string    `json:"targetAddr,omitempty"`
+	Result     string    `json:"result"` // ok或者失败原因
+}
+
+// PunchLog 最近的打洞请求，环形缓冲
+type PunchLog struct {
+	lock     sync.Mutex
+	attempts []*PunchAttempt
+	next     int
+}
+
+func NewPunchLog() *PunchLog {
+	return &PunchLog{attempts: make([]*PunchAttempt, 0, recentPunchMax)}
+}
+
+func (p *PunchLog) Add(a *PunchAttempt) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.attempts) < recentPunchMax {
+		p.attempts = append(p.attempts, a)
+		return
+	}
+	p.attempts[p.next] = a
+	p.next = (p.next + 1) % recentPunchMax
+}
+
+// Recent 从新到旧
+func (p *PunchLog) Recent() []*PunchAttempt {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	attempts := make([]*PunchAttempt, 0, len(p.attempts))
+	for i := len(p.attempts) - 1; i >= 0; i-- {
+		attempts = append(attempts, p.attempts[(p.next+i)%len(p.attempts)])
+	}
+	return attempts
+}
+
+// recordPunch 记录一次打洞请求，targetAddr不存在时为空
+func (s *Server) recordPunch(addr *net.UDPAddr, userID, targetID int, result string) {
+	a := &PunchAttempt{Time: time.Now(), UserID: userID, TargetID: targetID, UserAddr: addr.String(), Result: result}
+	if target, ok := s.Clients.Load(targetID); ok {
+		a.TargetAddr = target.(*ClientInfo).UDPAddr.String()
+	}
+	s.Punches.Add(a)
+}
+
+// KickedList 最近被踢掉的会话，按ID和token记录
+// 踢下线的推送丢了时客户端还会带着旧的token发心跳，回复kicked而不是让它重新登录
+type KickedList struct {
+	lock  sync.Mutex
+	items map[string]*kickedSession // id token -> 原因
+}
+
+type kickedSession struct {
+	reason  string
+	expires time.Time
+}
+
+func NewKickedList() *KickedList {
+	return &KickedList{items: make(map[string]*kickedSession)}
+}
+
+func kickedKey(id int, token string) string {
+	return strconv.Itoa(id) + " " + token
+}
+
+func (k *KickedList) Add(id int, token, reason string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.items[kickedKey(id, token)] = &kickedSession{reason: reason, expires: time.Now().Add(kickedKeep)}
+}
+
+// Reason 会话是否最近被踢掉，返回原因
+func (k *KickedList) Reason(id int, token string) (string, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	item, ok := k.items[kickedKey(id, token)]
+	if !ok || time.Now().After(item.expires) {
+		return "", false
+	}
+	return item.reason, true
+}
+
+// Expire 删除过期的记录，返回删除的个数
+func (k *KickedList) Expire() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	now := time.Now()
+	n := 0
+	for key, item := range k.items {
+		if now.After(item.expires) {
+			delete(k.items, key)
+			n++
+		}
+	}
+	return n
+}
+
+// kickClient 通知客户端后删除会话，客户端收到后不会自动重新登录
+func (s *Server) kickClient(id int, reason string) bool {
+	client, ok := s.Clients.Load(id)
+	if !ok {
+		return false
+	}
+	s.Kicked.Add(id, client.(*ClientInfo).Token, reason)
+	if err := s.sendTo(client.(*ClientInfo).UDPAddr, []byte(proto.BuildKickedMsg(reason))); err != nil {
+		adminLog.Warn("send kicked fail", "id", id, "err", err)
+	}
+	s.deleteClient(id)
+	adminLog.Info("kicked", "id", id, "reason", reason)
+	return true
+}
+
+// kickMatched 踢掉所有匹配的会话，返回踢掉的ID
+func (s *Server) kickMatched(match func(*ClientInfo) bool, reason string) []int {
+	var ids []int
+	s.Clients.Range(func(key, value interface{}) bool {
+		if match(value.(*ClientInfo)) {
+			ids = append(ids, key.(int))
+		}
+		return true
+	})
+	kicked := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if s.kickClient(id, reason) {
+			kicked = append(kicked, id)
+		}
+	}
+	return kicked
+}
+
+// broadcast 通知所有在线的客户端，返回发送成功的个数
+func (s *Server) broadcast(text string) int {
+	msg := []byte(proto.BuildNoticeMsg(text))
+	n := 0
+	s.Clients.Range(func(key, value interface{}) bool {
+		if err := s.sendTo(value.(*ClientInfo).UDPAddr, msg); err != nil {
+			adminLog.Warn("broadcast fail", "id", key, "err", err)
+		} else {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+type sessionInfo struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	Addr          string    `json:"addr"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	HasKey        bool      `json:"hasKey"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		adminLog.Warn("write response fail", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("bad json: %v", err))
+		return false
+	}
+	return true
+}
+
+// adminAuth 校验token，比较时间固定，防止按时间猜token，token可以重新加载配置修改
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := conf().Auth.AdminToken
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// method 限制请求方法
+func method(m string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) adminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := make([]*sessionInfo, 0)
+	s.Clients.Range(func(key, value interface{}) bool {
+		client := value.(*ClientInfo)
+		sessions = append(sessions, &sessionInfo{
+			ID:            client.ID,
+			Name:          client.Name,
+			Addr:          client.UDPAddr.String(),
+			LastHeartbeat: time.Unix(atomic.LoadInt64(&client.LastHeartbeatTime), 0),
+			HasKey:        len(client.Key) > 0,
+		})
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     int    `json:"id"`
+		Reason string `json:"reason"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if len(req.Reason) == 0 {
+		req.Reason = "kicked by admin"
+	}
+	if !s.kickClient(req.ID, req.Reason) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%d is not exists", req.ID))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": req.ID})
+}
+
+func (s *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, s.Bans.List())
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	b := &Ban{}
+	if !readJSON(w, r, b) {
+		return
+	}
+	if (len(b.IP) == 0) == (len(b.Name) == 0) {
+		writeError(w, http.StatusBadRequest, "need one of ip or name")
+		return
+	}
+	if len(b.IP) > 0 {
+		ip := net.ParseIP(b.IP)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "bad ip")
+			return
+		}
+		b.IP = ip.String()
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.Bans.Remove(b); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		adminLog.Info("unban", "ban", b.key())
+		writeJSON(w, http.StatusOK, map[string]string{"unbanned": b.key()})
+		return
+	}
+
+	b.Time = time.Now()
+	if err := s.Bans.Add(b); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	adminLog.Info("ban", "ban", b.key())
+	kicked := s.kickMatched(func(client *ClientInfo) bool {
+		if len(b.IP) > 0 {
+			return client.UDPAddr.IP.String() == b.IP
+		}
+		return client.Name == b.Name
+	}, "banned")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ban": b, "kicked": kicked})
+}
+
+func (s *Server) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if len(req.Text) == 0 || len(req.Text) > maxNoticeLen {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("text length must be 1-%d", maxNoticeLen))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"sent": s.broadcast(req.Text)})
+}
+
+func (s *Server) adminPunches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Punches.Recent())
+}
+
+// listenAdmin 阻塞，出错时只打日志，不影响服务器
+func (s *Server) listenAdmin(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", adminAuth(method(http.MethodGet, s.adminSessions)))
+	mux.HandleFunc("/admin/kick", adminAuth(method(http.MethodPost, s.adminKick)))
+	mux.HandleFunc("/admin/bans", adminAuth(s.adminBans))
+	mux.HandleFunc("/admin/broadcast", adminAuth(method(http.MethodPost, s.adminBroadcast)))
+	mux.HandleFunc("/admin/punches", adminAuth(method(http.MethodGet, s.adminPunches)))
+	serveHTTP(ctx, addr, mux, adminLog)
+}
@@ -0,0 +1,108 @@
+// 带公钥登录的挑战应答，见proto/auth.go
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"sync"
+	"time"
+
+	"udpdemo/proto"
+)
+
+const challengeTTL = 30 * time.Second
+
+type challenge struct {
+	name    string
+	key     *ecdh.PrivateKey
+	expires time.Time
+}
+
+// Challenges 还没用掉的挑战，每个地址最多一个，新的覆盖旧的
+type Challenges struct {
+	lock  sync.Mutex
+	items map[string]*challenge // addr -> challenge
+}
+
+func NewChallenges() *Challenges {
+	return &Challenges{items: make(map[string]*challenge)}
+}
+
+// New 给addr生成新的挑战，返回服务器的临时公钥
+func (c *Challenges) New(addr *net.UDPAddr, name string) (*ecdh.PublicKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.items[addr.String()] = &challenge{name: name, key: key, expires: time.Now().Add(challengeTTL)}
+	c.lock.Unlock()
+	return key.PublicKey(), nil
+}
+
+// Take 取出addr给name的挑战，不管校验结果都删掉，没有或者过期了返回nil
+func (c *Challenges) Take(addr *net.UDPAddr, name string) *ecdh.PrivateKey {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch, ok := c.items[addr.String()]
+	if !ok {
+		return nil
+	}
+	delete(c.items, addr.String())
+	if ch.name != name || time.Now().After(ch.expires) {
+		return nil
+	}
+	return ch.key
+}
+
+// Expire 删除过期的挑战，返回删除的个数
+func (c *Challenges) Expire() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	n := 0
+	for addr, ch := range c.items {
+		if now.After(ch.expires) {
+			delete(c.items, addr)
+			n++
+		}
+	}
+	return n
+}
+
+// challenge 带公钥登录前先要一个挑战
+// request: challenge name
+// response: challenge OK serverPub/FAIL msg
+func (s *Server) challenge(addr *net.UDPAddr, name string) error {
+	if s.draining() {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdChallenge, proto.CodeUnavailable, "server shutting down")))
+	}
+	pub, err := s.Challenges.New(addr, name)
+	if err != nil {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdChallenge, proto.CodeInternal, err.Error())))
+	}
+	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdChallenge, base64.StdEncoding.EncodeToString(pub.Bytes()))))
+}
+
+// verifyLogin 校验登录证明，addr必须先要过name的挑战
+func (s *Server) verifyLogin(addr *net.UDPAddr, name, key, proof string) bool {
+	priv := s.Challenges.Take(addr, name)
+	if priv == nil {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return false
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return false
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return false
+	}
+	return proto.CheckLoginProof(shared, name, key, proof)
+}
@@ -0,0 +1,267 @@
+// 配置文件，TOML格式，-config指定，文件里的值覆盖命令行参数
+// 收到SIGHUP时重新加载，超时、限流、中转、token、日志立即生效，监听地址、worker、存储需要重启
+//
+// [listen]
+// udp = "0.0.0.0:10086"
+// metrics = ":9100"
+// admin = "127.0.0.1:9101"
+//
+// [server]
+// workers = 8
+// queue = 1024
+//
+// [store]
+// type = "file"
+// path = "./p2p-server.db"
+//
+// [timeouts]
+// client = "10s"
+// offline_ttl = "168h"
+// drain = "3s"
+//
+// [limits]
+// ip_rate = 50
+// user_rate = 20
+// login_rate = 1
+// punch_rate = 0.5
+// max_sessions = 10000
+// offline_per_user = 100
+//
+// [relay]
+// enabled = true
+// max_payload = 1024
+//
+// [auth]
+// admin_token = "xxx"
+//
+// [log]
+// file = "./p2p-server.log"
+// level = "info"
+// format = "logfmt"
+// max_size = 100
+// max_backups = 5
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"udpdemo/logging"
+)
+
+var ConfigFile = flag.String("config", "", "TOML配置文件，为空只用命令行参数")
+
+// duration 配置里写"10s"这样的字符串
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type Config struct {
+	Listen struct {
+		UDP     string `toml:"udp"`
+		Metrics string `toml:"metrics"`
+		Admin   string `toml:"admin"`
+	} `toml:"listen"`
+	Server struct {
+		Workers int `toml:"workers"`
+		Queue   int `toml:"queue"`
+	} `toml:"server"`
+	Store struct {
+		Type string `toml:"type"`
+		Path string `toml:"path"`
+	} `toml:"store"`
+	Timeouts struct {
+		Client     duration `toml:"client"`      // 多久没心跳删除
+		OfflineTTL duration `toml:"offline_ttl"` // 离线消息保存多久
+		Drain      duration `toml:"drain"`       // 退出前等待客户端处理停止通知的时间
+	} `toml:"timeouts"`
+	Limits struct {
+		IPRate         float64 `toml:"ip_rate"`
+		UserRate       float64 `toml:"user_rate"`
+		LoginRate      float64 `toml:"login_rate"`
+		PunchRate      float64 `toml:"punch_rate"`
+		MaxSessions    int     `toml:"max_sessions"`
+		OfflinePerUser int     `toml:"offline_per_user"`
+	} `toml:"limits"`
+	Relay struct {
+		Enabled    bool `toml:"enabled"`
+		MaxPayload int  `toml:"max_payload"`
+	} `toml:"relay"`
+	Auth struct {
+		AdminToken string `toml:"admin_token"`
+	} `toml:"auth"`
+	Log struct {
+		File       string `toml:"file"`
+		Level      string `toml:"level"`    // debug/info/warn/error
+		Format     string `toml:"format"`   // logfmt/json
+		MaxSize    int    `toml:"max_size"` // MB
+		MaxBackups int    `toml:"max_backups"`
+	} `toml:"log"`
+}
+
+// configFromFlags 命令行参数和默认值
+func configFromFlags() *Config {
+	c := &Config{}
+	c.Listen.UDP = fmt.Sprintf("0.0.0.0:%d", *Port)
+	c.Listen.Metrics = *MetricsAddr
+	c.Listen.Admin = *AdminAddr
+	c.Server.Workers = *Workers
+	c.Server.Queue = *QueueSize
+	c.Store.Type = *StoreType
+	c.Store.Path = *StorePath
+	c.Timeouts.Client.Duration = ClientTimeoutSec * time.Second
+	c.Timeouts.OfflineTTL.Duration = offlineMsgTTL * time.Second
+	c.Timeouts.Drain.Duration = *DrainTime
+	c.Limits.IPRate = *IPRate
+	c.Limits.UserRate = *UserRate
+	c.Limits.LoginRate = *LoginRate
+	c.Limits.PunchRate = *PunchRate
+	c.Limits.MaxSessions = *MaxSessions
+	c.Limits.OfflinePerUser = maxOfflineMsgsPerUser
+	c.Relay.Enabled = true
+	c.Relay.MaxPayload = maxPacketSize
+	c.Auth.AdminToken = *AdminToken
+	c.Log.File = *LogFile
+	c.Log.Level = *LogLevel
+	c.Log.Format = *LogFormat
+	c.Log.MaxSize = *LogMaxSize
+	c.Log.MaxBackups = *LogMaxBackups
+	return c
+}
+
+// loadConfig 在base的基础上读取配置文件
+func loadConfig(path string, base *Config) (*Config, error) {
+	c := *base
+	md, err := toml.DecodeFile(path, &c)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown config keys: %v", undecoded)
+	}
+	return &c, c.Validate()
+}
+
+func (c *Config) Validate() error {
+	if _, err := net.ResolveUDPAddr("udp", c.Listen.UDP); err != nil {
+		return fmt.Errorf("listen.udp: %v", err)
+	}
+	if len(c.Listen.Admin) > 0 && len(c.Auth.AdminToken) == 0 {
+		return fmt.Errorf("auth.admin_token is required when listen.admin is set")
+	}
+	if c.Server.Workers < 1 || c.Server.Queue < 1 {
+		return fmt.Errorf("server.workers and server.queue must be positive")
+	}
+	if c.Store.Type != "file" && c.Store.Type != "memory" {
+		return fmt.Errorf("store.type must be file or memory")
+	}
+	if c.Store.Type == "file" && len(c.Store.Path) == 0 {
+		return fmt.Errorf("store.path is required for file store")
+	}
+	if c.Timeouts.Client.Duration < time.Second {
+		return fmt.Errorf("timeouts.client must be at least 1s")
+	}
+	if c.Timeouts.OfflineTTL.Duration <= 0 {
+		return fmt.Errorf("timeouts.offline_ttl must be positive")
+	}
+	if c.Timeouts.Drain.Duration < 0 {
+		return fmt.Errorf("timeouts.drain must not be negative")
+	}
+	if c.Limits.IPRate < 0 || c.Limits.UserRate < 0 || c.Limits.LoginRate < 0 || c.Limits.PunchRate < 0 {
+		return fmt.Errorf("limits rates must not be negative")
+	}
+	if c.Limits.MaxSessions < 0 || c.Limits.OfflinePerUser < 0 {
+		return fmt.Errorf("limits.max_sessions and limits.offline_per_user must not be negative")
+	}
+	if c.Relay.MaxPayload < 1 || c.Relay.MaxPayload > maxPacketSize {
+		return fmt.Errorf("relay.max_payload must be 1-%d", maxPacketSize)
+	}
+	if len(c.Log.File) == 0 {
+		return fmt.Errorf("log.file is required")
+	}
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %v", err)
+	}
+	if c.Log.Format != "logfmt" && c.Log.Format != "json" {
+		return fmt.Errorf("log.format must be logfmt or json")
+	}
+	if c.Log.MaxSize < 0 || c.Log.MaxBackups < 0 {
+		return fmt.Errorf("log.max_size and log.max_backups must not be negative")
+	}
+	return nil
+}
+
+var currentConfig atomic.Value // *Config
+
+// conf 当前生效的配置，没有加载过时用命令行参数
+func conf() *Config {
+	if c, ok := currentConfig.Load().(*Config); ok {
+		return c
+	}
+	return configFromFlags()
+}
+
+func setConfig(c *Config) {
+	currentConfig.Store(c)
+}
+
+// keepStatic 不能运行时修改的配置保持原来的值
+func keepStatic(old, c *Config) {
+	if c.Listen != old.Listen || c.Server != old.Server || c.Store != old.Store {
+		configLog.Warn("listen/server/store config changed, restart to apply")
+	}
+	c.Listen = old.Listen
+	c.Server = old.Server
+	c.Store = old.Store
+}
+
+// reloadConfig 重新读取配置文件，出错时保留原来的配置
+func (s *Server) reloadConfig(path string) error {
+	c, err := loadConfig(path, configFromFlags())
+	if err != nil {
+		return err
+	}
+	old := conf()
+	keepStatic(old, c)
+	if c.Log != old.Log {
+		if err := openLog(c); err != nil {
+			return err
+		}
+	}
+	setConfig(c)
+	s.Limiters.SetRates(c)
+	configLog.Info("reloaded", "path", path)
+	return nil
+}
+
+// watchReload 收到SIGHUP时重新加载配置
+func (s *Server) watchReload(ctx context.Context, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+		if err := s.reloadConfig(path); err != nil {
+			configLog.Error("reload fail", "path", path, "err", err)
+		}
+	}
+}
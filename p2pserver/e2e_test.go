@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"udpdemo/netsim"
+	"udpdemo/proto"
+)
+
+const e2eWait = time.Second
+
+// startSimServer 在模拟网络的公网地址上运行服务器，测试结束时停止
+func startSimServer(t *testing.T, n *netsim.Network) (*Server, *net.UDPAddr) {
+	t.Helper()
+	c := configFromFlags()
+	c.Listen.Metrics = ""
+	c.Listen.Admin = ""
+	c.Timeouts.Drain.Duration = 0
+	setConfig(c)
+
+	conn, err := n.Listen("1.0.0.1:10086")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newMemServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Serve(ctx, conn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, conn.LocalAddr().(*net.UDPAddr)
+}
+
+// simPeer 协议层面的客户端，直接收发原始消息
+type simPeer struct {
+	t      *testing.T
+	nat    *netsim.NAT
+	conn   *netsim.Conn
+	server *net.UDPAddr
+
+	id    int
+	token string
+}
+
+func newSimPeer(t *testing.T, n *netsim.Network, typ netsim.NATType, ip string, server *net.UDPAddr) *simPeer {
+	t.Helper()
+	nat, err := n.NewNAT(typ, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := nat.Listen("192.168.1.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &simPeer{t: t, nat: nat, conn: conn, server: server}
+}
+
+func (p *simPeer) send(to *net.UDPAddr, msg string) {
+	p.t.Helper()
+	if _, err := p.conn.WriteToUDP([]byte(msg), to); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// expect 等来自from并且以prefix开头的消息，其他消息丢弃，超时返回false
+func (p *simPeer) expect(from *net.UDPAddr, prefix string) (string, bool) {
+	p.t.Helper()
+	deadline := time.Now().Add(e2eWait)
+	buf := make([]byte, 1500)
+	for {
+		p.conn.SetReadDeadline(deadline)
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", false
+		}
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		msg := string(buf[:n])
+		if addr.String() == from.String() && strings.HasPrefix(msg, prefix) {
+			return msg, true
+		}
+	}
+}
+
+func (p *simPeer) mustExpect(from *net.UDPAddr, prefix string) string {
+	p.t.Helper()
+	msg, ok := p.expect(from, prefix)
+	if !ok {
+		p.t.Fatalf("no %q from %s", prefix, from)
+	}
+	return msg
+}
+
+// request 发命令等回复，回复失败时测试失败
+func (p *simPeer) request(cmd string) *proto.ServerResponse {
+	p.t.Helper()
+	p.send(p.server, cmd)
+	name, _ := proto.ParseCmd([]byte(cmd))
+	resp, err := proto.ParseServerResponse([]byte(p.mustExpect(p.server, name+" ")))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if !resp.Result {
+		p.t.Fatalf("%s: %s", cmd, resp.Data)
+	}
+	return resp
+}
+
+func (p *simPeer) login(name string) {
+	p.t.Helper()
+	segs := strings.Split(p.request(proto.Cmd(proto.CmdLogin, name)).Data, " ")
+	if len(segs) != 2 {
+		p.t.Fatalf("bad login resp: %v", segs)
+	}
+	p.id, _ = strconv.Atoi(segs[0])
+	p.token = segs[1]
+}
+
+// keyLogin 带公钥登录，proofKey是算证明用的私钥，冒充别人时和pub对不上
+func (p *simPeer) keyLogin(name, pub string, proofKey *ecdh.PrivateKey) *proto.ServerResponse {
+	p.t.Helper()
+	p.send(p.server, proto.Cmd(proto.CmdChallenge, name))
+	resp, err := proto.ParseServerResponse([]byte(p.mustExpect(p.server, proto.CmdChallenge+" ")))
+	if err != nil || !resp.Result {
+		p.t.Fatalf("challenge: %+v %v", resp, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(resp.Data)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	serverKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	shared, err := proofKey.ECDH(serverKey)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.send(p.server, proto.Cmd(proto.CmdLogin, name, pub, proto.LoginProof(shared, name, pub)))
+	resp, err = proto.ParseServerResponse([]byte(p.mustExpect(p.server, proto.CmdLogin+" ")))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return resp
+}
+
+func TestE2ELoginGetPunchChat(t *testing.T) {
+	n := netsim.New(1)
+	_, server := startSimServer(t, n)
+	a := newSimPeer(t, n, netsim.PortRestricted, "100.0.0.1", server)
+	b := newSimPeer(t, n, netsim.PortRestricted, "100.0.0.2", server)
+	a.login("a")
+	b.login("b")
+	if a.id == b.id {
+		t.Fatalf("same id %d", a.id)
+	}
+
+	// 带请求ID的命令回复也带ID
+	a.send(server, proto.BuildRequest(7, proto.Cmd(proto.CmdGet, strconv.Itoa(b.id))))
+	resp, err := proto.ParseServerResponse([]byte(a.mustExpect(server, "@7 get OK")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bAddr, err := net.ResolveUDPAddr("udp", resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bAddr.IP.Equal(b.nat.IP()) {
+		t.Fatalf("get %d returned %s, want nat ip %s", b.id, bAddr, b.nat.IP())
+	}
+
+	a.request(proto.Cmd(proto.CmdPunch, strconv.Itoa(a.id), strconv.Itoa(b.id)))
+	ok, addr, err := proto.TryParsePunchMsg([]byte(b.mustExpect(server, proto.CmdGetPunch)))
+	if !ok || err != nil {
+		t.Fatalf("bad getpunch: %v", err)
+	}
+	aAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 端口限制NAT：b先发的包被a的NAT过滤，a发过去之后b再发才能到
+	b.send(aAddr, proto.BuildPunchReq(strconv.Itoa(b.id), "b"))
+	if _, ok := a.expect(bAddr, proto.PunchRequest); ok {
+		t.Fatal("first punch passed a port-restricted nat")
+	}
+	a.send(bAddr, proto.BuildPunchReq(strconv.Itoa(a.id), "a"))
+	b.mustExpect(aAddr, proto.PunchRequest)
+	b.send(aAddr, proto.BuildPunchReply(strconv.Itoa(b.id), "b"))
+	a.mustExpect(bAddr, proto.PunchReply)
+
+	a.send(bAddr, proto.BuildChatMsg(a.id, "hi b"))
+	if msg := b.mustExpect(aAddr, strconv.Itoa(a.id)+"|"); msg != proto.BuildChatMsg(a.id, "hi b") {
+		t.Fatalf("b got %q", msg)
+	}
+	b.send(aAddr, proto.BuildChatMsg(b.id, "hi a"))
+	a.mustExpect(bAddr, proto.BuildChatMsg(b.id, "hi a"))
+
+	a.request(proto.Cmd(proto.CmdLogout, strconv.Itoa(a.id)))
+	b.send(server, proto.Cmd(proto.CmdGet, strconv.Itoa(a.id)))
+	resp, err = proto.ParseServerResponse([]byte(b.mustExpect(server, "get FAIL")))
+	if err != nil || resp.Code != proto.CodeNotFound {
+		t.Fatalf("get logged out user: %+v %v", resp, err)
+	}
+
+	// 不认识的命令只有带请求ID时才回复
+	b.send(server, proto.BuildRequest(8, "whoami"))
+	resp, err = proto.ParseServerResponse([]byte(b.mustExpect(server, "@8 whoami FAIL")))
+	if err != nil || resp.Code != proto.CodeVersionMismatch {
+		t.Fatalf("unknown cmd: %+v %v", resp, err)
+	}
+}
+
+// TestE2EKeyLogin 只知道公钥登录不了别人的账号，持有私钥的换了地址也能登录，ID不变
+func TestE2EKeyLogin(t *testing.T) {
+	n := netsim.New(1)
+	_, server := startSimServer(t, n)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	resp := a.keyLogin("a", pub, key)
+	if !resp.Result {
+		t.Fatalf("login: %+v", resp)
+	}
+	segs := strings.Fields(resp.Data)
+	id, _ := strconv.Atoi(segs[0])
+
+	b := newSimPeer(t, n, netsim.FullCone, "100.0.0.2", server)
+	b.send(server, proto.Cmd(proto.CmdLogin, "a", pub))
+	if resp, err := proto.ParseServerResponse([]byte(b.mustExpect(server, "login FAIL"))); err != nil || resp.Code != proto.CodeUnauthorized {
+		t.Fatalf("login without proof: %+v %v", resp, err)
+	}
+	if resp := b.keyLogin("a", pub, evil); resp.Result || resp.Code != proto.CodeUnauthorized {
+		t.Fatalf("login with wrong key: %+v", resp)
+	}
+	// 挑战用过一次就没了
+	b.send(server, proto.Cmd(proto.CmdLogin, "a", pub, "00"))
+	if resp, err := proto.ParseServerResponse([]byte(b.mustExpect(server, "login FAIL"))); err != nil || resp.Code != proto.CodeUnauthorized {
+		t.Fatalf("login without challenge: %+v %v", resp, err)
+	}
+	// a的会话没有被顶掉
+	a.send(server, proto.BuildHeartbeatMsg(id, segs[1]))
+	a.mustExpect(server, proto.HeartbeatReply)
+
+	c := newSimPeer(t, n, netsim.FullCone, "100.0.0.3", server)
+	resp = c.keyLogin("a", pub, key)
+	if !resp.Result || !strings.HasPrefix(resp.Data, strconv.Itoa(id)+" ") {
+		t.Fatalf("login from new addr: %+v, want id %d", resp, id)
+	}
+}
+
+// TestE2EExpireRelogin 心跳超时检查之后另一个worker已经重新登录，不能删掉新的会话
+func TestE2EExpireRelogin(t *testing.T) {
+	n := netsim.New(1)
+	s, server := startSimServer(t, n)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	resp := a.keyLogin("a", pub, key)
+	if !resp.Result {
+		t.Fatalf("login: %+v", resp)
+	}
+	id, _ := strconv.Atoi(strings.Fields(resp.Data)[0])
+	a.request(proto.Cmd(proto.CmdCreate, "r", strconv.Itoa(id)))
+
+	v, _ := s.Clients.Load(id)
+	stale := v.(*ClientInfo)
+	atomic.StoreInt64(&stale.LastHeartbeatTime, 0)
+	if resp := a.keyLogin("a", pub, key); !resp.Result {
+		t.Fatalf("relogin: %+v", resp)
+	}
+	if s.expireClient(id, stale, 1) {
+		t.Fatal("expired the new session")
+	}
+	if _, ok := s.Clients.Load(id); !ok || atomic.LoadInt64(&s.sessions) != 1 {
+		t.Fatalf("session lost, sessions %d", atomic.LoadInt64(&s.sessions))
+	}
+	if ok, _ := s.Store.Get(bucketSessions, strconv.Itoa(id), &ClientInfo{}); !ok {
+		t.Fatal("saved session deleted")
+	}
+	if !s.Rooms.ShareRoom(id, id) {
+		t.Fatal("left room")
+	}
+
+	v, _ = s.Clients.Load(id)
+	atomic.StoreInt64(&v.(*ClientInfo).LastHeartbeatTime, 0)
+	if !s.expireClient(id, v.(*ClientInfo), 1) {
+		t.Fatal("stale session not expired")
+	}
+	if _, ok := s.Clients.Load(id); ok || atomic.LoadInt64(&s.sessions) != 0 {
+		t.Fatalf("session not deleted, sessions %d", atomic.LoadInt64(&s.sessions))
+	}
+}
+
+// TestE2EBoundName 绑定了公钥的名字不能不带公钥登录，没有公钥的会话不能发离线消息
+func TestE2EBoundName(t *testing.T) {
+	n := netsim.New(1)
+	_, server := startSimServer(t, n)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	if resp := a.keyLogin("a", pub, key); !resp.Result {
+		t.Fatalf("login: %+v", resp)
+	}
+
+	b := newSimPeer(t, n, netsim.FullCone, "100.0.0.2", server)
+	b.send(server, proto.Cmd(proto.CmdLogin, "a"))
+	if resp, err := proto.ParseServerResponse([]byte(b.mustExpect(server, "login "))); err != nil || resp.Result || resp.Code != proto.CodeUnauthorized {
+		t.Fatalf("unkeyed login with bound name: %+v %v", resp, err)
+	}
+
+	b.login("b")
+	b.send(server, proto.Cmd(proto.CmdStore, strconv.Itoa(b.id), "a", "payload"))
+	if resp, err := proto.ParseServerResponse([]byte(b.mustExpect(server, "store "))); err != nil || resp.Result || resp.Code != proto.CodeUnauthorized {
+		t.Fatalf("store from unkeyed session: %+v %v", resp, err)
+	}
+}
+
+// TestE2ERoaming a的NAT重启换了公网端口，带token的心跳更新地址并通知打过洞的b
+func TestE2ERoaming(t *testing.T) {
+	n := netsim.New(1)
+	s, server := startSimServer(t, n)
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	b := newSimPeer(t, n, netsim.FullCone, "100.0.0.2", server)
+	a.login("a")
+	b.login("b")
+	a.request(proto.Cmd(proto.CmdPunch, strconv.Itoa(a.id), strconv.Itoa(b.id)))
+	b.mustExpect(server, proto.CmdGetPunch)
+
+	client, _ := s.Clients.Load(a.id)
+	oldAddr := client.(*ClientInfo).UDPAddr.String()
+	a.nat.Reset()
+	// token不对的心跳不能改地址
+	a.send(server, proto.BuildHeartbeatMsg(a.id, "bad"))
+	if msg, ok := b.expect(server, proto.CmdAddrChange); ok {
+		t.Fatalf("addr changed with bad token: %q", msg)
+	}
+	a.send(server, proto.BuildHeartbeatMsg(a.id, a.token))
+	a.mustExpect(server, proto.HeartbeatReply)
+
+	ok, id, addr, err := proto.TryParseAddrChange([]byte(b.mustExpect(server, proto.CmdAddrChange)))
+	if !ok || err != nil || id != a.id {
+		t.Fatalf("bad addrchange: %v %d %s %v", ok, id, addr, err)
+	}
+	client, _ = s.Clients.Load(a.id)
+	if got := client.(*ClientInfo).UDPAddr.String(); got != addr || got == oldAddr {
+		t.Fatalf("registered %s, pushed %s, old %s", got, addr, oldAddr)
+	}
+}
+
+// TestE2ERelay 只中转给同一个房间的成员或者请求过打洞的对端
+func TestE2ERelay(t *testing.T) {
+	n := netsim.New(1)
+	s, server := startSimServer(t, n)
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	b := newSimPeer(t, n, netsim.FullCone, "100.0.0.2", server)
+	c := newSimPeer(t, n, netsim.FullCone, "100.0.0.3", server)
+	a.login("a")
+	b.login("b")
+	c.login("c")
+	relay := func(from, to *simPeer, payload string) {
+		t.Helper()
+		from.send(server, proto.Cmd(proto.CmdRelay, strconv.Itoa(from.id), strconv.Itoa(to.id), payload))
+	}
+
+	relay(a, b, "hi")
+	if msg, ok := b.expect(server, proto.CmdRelayed); ok {
+		t.Fatalf("relayed without room or punch: %q", msg)
+	}
+	if s.Drops.Snapshot()[DropRelayDenied] != 1 {
+		t.Fatalf("drops %v", s.Drops)
+	}
+
+	a.request(proto.Cmd(proto.CmdCreate, "r", strconv.Itoa(a.id)))
+	b.request(proto.Cmd(proto.CmdJoin, "r", strconv.Itoa(b.id)))
+	relay(a, b, "room")
+	if msg := b.mustExpect(server, proto.CmdRelayed); !strings.HasSuffix(msg, "room") {
+		t.Fatalf("relayed %q", msg)
+	}
+
+	c.request(proto.Cmd(proto.CmdPunch, strconv.Itoa(c.id), strconv.Itoa(a.id)))
+	relay(a, c, "punch")
+	if msg := c.mustExpect(server, proto.CmdRelayed); !strings.HasSuffix(msg, "punch") {
+		t.Fatalf("relayed %q", msg)
+	}
+}
+
+// TestE2EKickLost 踢下线的推送丢了，下一次心跳回复kicked，不让客户端重新登录
+func TestE2EKickLost(t *testing.T) {
+	n := netsim.New(1)
+	s, server := startSimServer(t, n)
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	a.login("a")
+
+	n.SetLoss(1)
+	if !s.kickClient(a.id, "bye") {
+		t.Fatal("kick fail")
+	}
+	n.SetLoss(0)
+	if msg, ok := a.expect(server, proto.CmdKicked); ok {
+		t.Fatalf("kick not lost: %q", msg)
+	}
+
+	a.send(server, proto.BuildHeartbeatMsg(a.id, a.token))
+	msg := a.mustExpect(server, "")
+	if ok, reason, err := proto.TryParseKickedMsg([]byte(msg)); !ok || err != nil || reason != "bye" {
+		t.Fatalf("heartbeat after kick: %q", msg)
+	}
+	// 别的token还是让重新登录
+	a.send(server, proto.BuildHeartbeatMsg(a.id, "other"))
+	if msg := a.mustExpect(server, ""); msg != proto.ReloginMsg {
+		t.Fatalf("heartbeat with other token: %q", msg)
+	}
+}
+
+// TestE2ERoamingRepunch a换了地址，刚打过洞的b和c同时重新打洞，打洞限流不能挡住它们
+func TestE2ERoamingRepunch(t *testing.T) {
+	n := netsim.New(1)
+	s, server := startSimServer(t, n)
+	s.Limiters.Punch.SetRate(0.5)
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	b := newSimPeer(t, n, netsim.FullCone, "100.0.0.2", server)
+	c := newSimPeer(t, n, netsim.FullCone, "100.0.0.3", server)
+	d := newSimPeer(t, n, netsim.FullCone, "100.0.0.4", server)
+	for _, p := range []*simPeer{a, b, c, d} {
+		p.login(p.nat.IP().String())
+	}
+	punchCmd := func(from, to *simPeer) string {
+		return proto.Cmd(proto.CmdPunch, strconv.Itoa(from.id), strconv.Itoa(to.id))
+	}
+	b.request(punchCmd(b, a))
+	c.request(punchCmd(c, a))
+
+	a.nat.Reset()
+	a.send(server, proto.BuildHeartbeatMsg(a.id, a.token))
+	a.mustExpect(server, proto.HeartbeatReply)
+	for _, p := range []*simPeer{b, c} {
+		if ok, id, _, err := proto.TryParseAddrChange([]byte(p.mustExpect(server, proto.CmdAddrChange))); !ok || err != nil || id != a.id {
+			t.Fatalf("bad addrchange for %d", p.id)
+		}
+	}
+	// 两个对端同时重新打洞，都要成功
+	b.send(server, punchCmd(b, a))
+	c.send(server, punchCmd(c, a))
+	for _, p := range []*simPeer{b, c} {
+		if resp, err := proto.ParseServerResponse([]byte(p.mustExpect(server, proto.CmdPunch+" "))); err != nil || !resp.Result {
+			t.Fatalf("repunch from %d: %+v %v", p.id, resp, err)
+		}
+	}
+
+	// 地址没变时同一对仍然限流，别的请求者不受影响
+	b.send(server, punchCmd(b, a))
+	b.mustExpect(server, proto.CmdPunch+" FAIL")
+	d.request(punchCmd(d, a))
+}
+
+// TestE2ERetransmit 丢包时用同一个请求ID重发，服务器只登录一次
+func TestE2ERetransmit(t *testing.T) {
+	n := netsim.New(3)
+	s, server := startSimServer(t, n)
+	a := newSimPeer(t, n, netsim.FullCone, "100.0.0.1", server)
+	n.SetLoss(0.4)
+
+	req := proto.BuildRequest(1, proto.Cmd(proto.CmdLogin, "a"))
+	var replies []string
+	for i := 0; i < 20 && len(replies) < 3; i++ {
+		a.send(server, req)
+		a.conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		buf := make([]byte, 1500)
+		if size, _, err := a.conn.ReadFromUDP(buf); err == nil {
+			replies = append(replies, string(buf[:size]))
+		}
+	}
+	if len(replies) < 2 {
+		t.Fatalf("only %d replies with 40%% loss", len(replies))
+	}
+	for _, r := range replies[1:] {
+		if r != replies[0] {
+			t.Fatalf("replies differ: %q and %q", replies[0], r)
+		}
+	}
+	if logins := atomic.LoadUint64(&s.Metrics.Logins); logins != 1 {
+		t.Fatalf("logged in %d times", logins)
+	}
+	if n.Drops()[netsim.DropLoss] == 0 {
+		t.Fatal("no packet lost")
+	}
+}
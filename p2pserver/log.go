@@ -2,17 +2,43 @@ package main
 
 import (
 	"flag"
-	"log"
 	"os"
+
+	"udpdemo/logging"
+)
+
+var (
+	LogFile       = flag.String("logfile", "./p2p-server.log", "file path")
+	LogLevel      = flag.String("loglevel", "info", "日志级别：debug/info/warn/error")
+	LogFormat     = flag.String("logformat", "logfmt", "日志格式：logfmt/json")
+	LogMaxSize    = flag.Int("logmaxsize", 100, "日志文件超过多少MB轮转，0不轮转")
+	LogMaxBackups = flag.Int("logbackups", 5, "保留几个轮转的旧日志")
 )
 
-var LogFile = flag.String("logfile", "./p2p-server.log", "file path")
+var (
+	serverLog    = logging.New("server")
+	heartbeatLog = logging.New("heartbeat")
+	adminLog     = logging.New("admin")
+	configLog    = logging.New("config")
+	metricsLog   = logging.New("metrics")
+	offlineLog   = logging.New("offline")
+	roomLog      = logging.New("room")
+	storeLog     = logging.New("store")
+)
+
+// openLog 按配置打开日志，重新加载配置时再调用会替换旧的
+func openLog(c *Config) error {
+	return logging.Init(logging.Options{
+		File:       c.Log.File,
+		Level:      c.Log.Level,
+		Format:     c.Log.Format,
+		MaxSize:    int64(c.Log.MaxSize) * 1024 * 1024,
+		MaxBackups: c.Log.MaxBackups,
+	})
+}
 
-func initLog() {
-	logFile, err := os.OpenFile(*LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		panic(err)
-	}
-	log.SetOutput(logFile)
-	log.SetFlags(log.Llongfile | log.Ldate | log.Ltime)
+// fatal 启动失败，日志还没打开时输出到stderr
+func fatal(msg string, args ...interface{}) {
+	serverLog.Error(msg, args...)
+	os.Exit(1)
 }
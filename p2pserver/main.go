@@ -1,14 +1,19 @@
-// 所有命令，客户端未收到回复则进行重试
+// 所有命令，客户端未收到回复则进行重试，重试的请求带同一个请求ID，服务器不会重复执行，见reply.go
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"udpdemo/proto"
@@ -16,12 +21,9 @@ import (
 
 var Port = flag.Int("port", 10086, "listen port")
 
-const ClientTimeoutSec = 10
+const ClientTimeoutSec = 10 // 默认值，可以在配置文件里修改
 
-func init() {
-	flag.Parse()
-	initLog()
-}
+var errUnknownCmd = errors.New("unknown command")
 
 type ClientInfo struct {
 	ID   int
@@ -30,110 +32,230 @@ type ClientInfo struct {
 	LastHeartbeatTime int64
 
 	UDPAddr *net.UDPAddr
+	Key     string // 登录时上报的公钥，没有的收不了离线消息
+	Token   string // 登录时分配，心跳换地址时校验
 }
 
 type UDPMsg struct {
 	Data       []byte
 	RemoteAddr *net.UDPAddr
-}
 
-var (
-	GClientID = 0
-)
+	buf *[]byte // Data所在的缓冲区，处理完放回池里
+}
 
-func getID() int {
-	GClientID++
-	return GClientID
+// PacketConn 服务器收发包用的连接，*net.UDPConn和测试用的netsim.Conn都实现了
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+	Close() error
 }
 
 type Server struct {
 	Addr     *net.UDPAddr
-	listener *net.UDPConn
+	listener PacketConn
 
 	Clients *sync.Map // ID -> *ClientInfo
+	Rooms   *RoomManager
+	Offline *OfflineStore
+	Store   Store
+	Peers   *PeerGraph
+
+	Limiters   *Limiters
+	Drops      *DropStats
+	Metrics    *Metrics
+	Bans       *BanList
+	Punches    *PunchLog
+	Replies    *Replies
+	Challenges *Challenges
+	Kicked     *KickedList
+	sessions   int64 // 在线会话数
+	drain      int32 // 1表示正在退出
+
+	idLock      sync.Mutex
+	accountLock sync.Mutex
+	sessionLock sync.Mutex // 会话的增删和计数一起做
 }
 
-func (s *Server) ListenAndServer() {
-	var err error
-	s.listener, err = net.ListenUDP("udp", s.Addr)
+// ListenAndServer 阻塞到ctx结束并且drain完
+func (s *Server) ListenAndServer(ctx context.Context) {
+	conn, err := net.ListenUDP("udp", s.Addr)
 	if err != nil {
+		serverLog.Error("listen fail", "addr", s.Addr, "err", err)
 		return
 	}
-	log.Printf("Local: <%s> \n", s.listener.LocalAddr().String())
-	defer s.listener.Close()
+	s.Serve(ctx, conn)
+}
 
-	c := make(chan UDPMsg)
+// Serve 在conn上收发包，阻塞到ctx结束并且drain完，返回前关闭conn
+func (s *Server) Serve(ctx context.Context, conn PacketConn) {
+	s.listener = conn
+	serverLog.Info("listen", "addr", s.listener.LocalAddr())
+	defer s.listener.Close()
 
-	go s.handleData(c)
-	go s.checkHeartbeat()
-	s.recvData(c)
+	// 后台的循环在worker处理完之前一直运行，defer后进先出，cancel要在pool.Close之前注册
+	loopCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := conf()
+	pool := NewWorkerPool(c.Server.Workers, c.Server.Queue, s.handleData)
+	defer pool.Close()
+
+	go s.checkHeartbeat(loopCtx)
+	go s.reportDrops(loopCtx)
+	if len(c.Listen.Metrics) > 0 {
+		go s.listenMetrics(loopCtx, c.Listen.Metrics)
+	}
+	if len(c.Listen.Admin) > 0 {
+		go s.listenAdmin(loopCtx, c.Listen.Admin)
+	}
+	if len(*ConfigFile) > 0 {
+		go s.watchReload(loopCtx, *ConfigFile)
+	}
+	go s.shutdown(ctx)
+	s.recvData(ctx, pool)
+	serverLog.Info("stopping")
 }
 
-func (s *Server) handleData(c <-chan UDPMsg) {
-	for data := range c {
-		log.Printf("[%s] handle data now: %s\n", data.RemoteAddr, data.Data)
-		if proto.IsHeartbeatMsg(string(data.Data)) {
-			id := proto.ParseHeartbeatMsg(string(data.Data))
-			if id == 0 {
-				log.Printf("bad heartbeat: %s", data.Data)
-				continue
-			}
+// handleData 在worker里调用，不同客户端的包会并发处理
+func (s *Server) handleData(data UDPMsg) {
+	if s.Bans.IPBanned(data.RemoteAddr.IP) {
+		s.Drops.Inc(DropBanned)
+		return
+	}
+	if !s.Limiters.IP.Allow(data.RemoteAddr.IP.String()) {
+		s.Drops.Inc(DropIPRate)
+		return
+	}
+	serverLog.Debug("recv", "addr", data.RemoteAddr, "data", string(data.Data))
+	if proto.IsHeartbeatMsg(string(data.Data)) {
+		id, token, err := proto.ParseHeartbeatMsg(string(data.Data))
+		if err != nil || id == 0 {
+			heartbeatLog.Warn("bad heartbeat", "addr", data.RemoteAddr, "data", string(data.Data), "err", err)
+			return
+		}
 
-			client, ok := s.Clients.Load(id)
-			if !ok {
-				log.Printf("[heartbeat] %d not found", id)
-				continue
+		client, ok := s.Clients.Load(id)
+		if !ok {
+			if reason, kicked := s.Kicked.Reason(id, token); kicked {
+				heartbeatLog.Info("heartbeat from kicked session", "id", id, "addr", data.RemoteAddr)
+				if err := s.sendTo(data.RemoteAddr, []byte(proto.BuildKickedMsg(reason))); err != nil {
+					heartbeatLog.Warn("send kicked fail", "id", id, "err", err)
+				}
+				return
 			}
-			client.(*ClientInfo).LastHeartbeatTime = time.Now().Unix()
-
-			if err := s.sendTo(data.RemoteAddr, []byte(proto.BuildHeartbeatReply(0))); err != nil {
-				log.Printf("send heaetbeat fail: %+v", err)
+			// 服务器重启丢了状态或者心跳超时被删除，让客户端重新登录
+			heartbeatLog.Info("unknown id, ask to relogin", "id", id, "addr", data.RemoteAddr)
+			if err := s.sendTo(data.RemoteAddr, []byte(proto.ReloginMsg)); err != nil {
+				heartbeatLog.Warn("send relogin fail", "id", id, "err", err)
 			}
-			continue
+			return
+		}
+		if !s.allowUser(id) {
+			return
 		}
-		cmd, args := proto.ParseCmd(data.Data)
-		if err := s.execCmd(data.RemoteAddr, cmd, args...); err != nil {
-			log.Printf("exec cmd error: %+v\n", err)
+		atomic.AddUint64(&s.Metrics.Heartbeats, 1)
+		if client.(*ClientInfo).UDPAddr.String() != data.RemoteAddr.String() {
+			if token != client.(*ClientInfo).Token {
+				heartbeatLog.Warn("bad token", "id", id, "addr", data.RemoteAddr)
+				return
+			}
+			updated := s.updateClientAddr(client.(*ClientInfo), data.RemoteAddr)
+			if updated == nil {
+				return
+			}
+			client = updated
+		}
+		atomic.StoreInt64(&client.(*ClientInfo).LastHeartbeatTime, time.Now().Unix())
+		s.deliverOffline(client.(*ClientInfo))
+
+		if err := s.sendTo(data.RemoteAddr, []byte(proto.BuildHeartbeatReply(0))); err != nil {
+			heartbeatLog.Warn("send heartbeat reply fail", "id", id, "err", err)
+		}
+		return
+	}
+	reqID, body := proto.SplitRequestID(data.Data)
+	if len(reqID) > 0 && s.resendReply(data.RemoteAddr, reqID) {
+		return
+	}
+	cmd, args := proto.ParseCmd(body)
+	if len(reqID) > 0 {
+		s.Replies.Begin(data.RemoteAddr, reqID, cmd)
+		defer s.Replies.End(data.RemoteAddr)
+	}
+	err := s.execCmd(data.RemoteAddr, cmd, args...)
+	if err == errUnknownCmd {
+		err = nil
+		// 带了请求ID的客户端在等回复，不认识的命令多半是客户端的协议比服务器新
+		if len(reqID) > 0 {
+			err = s.sendTo(data.RemoteAddr, []byte(proto.ErrorMsg(strings.ToLower(cmd), proto.CodeVersionMismatch, "unknown command")))
 		}
 	}
+	if err != nil {
+		serverLog.Warn("exec cmd fail", "cmd", cmd, "addr", data.RemoteAddr, "err", err)
+	}
+	s.Metrics.commandDone(cmd, err)
 }
 
-func (s *Server) recvData(c chan<- UDPMsg) {
-	defer close(c)
-	data := make([]byte, 1024)
+func (s *Server) recvData(ctx context.Context, pool *WorkerPool) {
 	for {
-		n, remoteAddr, err := s.listener.ReadFromUDP(data)
+		buf := getPacketBuf()
+		n, remoteAddr, err := s.listener.ReadFromUDP(*buf)
 		if err != nil {
-			log.Printf("error during read: %s", err)
+			putPacketBuf(buf)
+			if ctx.Err() != nil {
+				return
+			}
+			atomic.AddUint64(&s.Metrics.RecvErrors, 1)
+			serverLog.Error("read fail", "err", err)
+			continue
 		}
-		c <- UDPMsg{
-			Data:       data[:n],
+		msg := UDPMsg{
+			Data:       (*buf)[:n],
 			RemoteAddr: remoteAddr,
+			buf:        buf,
+		}
+		if !pool.Dispatch(msg) {
+			putPacketBuf(buf)
+			s.Drops.Inc(DropQueueFull)
 		}
 	}
 }
 
 func (s *Server) sendTo(addr *net.UDPAddr, data []byte) error {
-	if n, err := s.listener.WriteToUDP(data, addr); err != nil || n != len(data) {
+	out := s.Replies.tag(addr, data)
+	if n, err := s.listener.WriteToUDP(out, addr); err != nil || n != len(out) {
+		atomic.AddUint64(&s.Metrics.SendErrors, 1)
 		return fmt.Errorf("[login] write error: %+v, n: %d", err, n)
 	}
+	s.Metrics.response(data)
 	return nil
 }
 
 func (s *Server) execCmd(addr *net.UDPAddr, cmd string, args ...string) error {
 	switch strings.ToLower(cmd) {
-	case proto.CmdLogin:
+	case proto.CmdChallenge:
 		if len(args) != 1 {
-			return s.sendTo(addr, []byte(proto.BadArgsMsg(proto.CmdLogin)))
+			return s.sendTo(addr, []byte(proto.BadArgsMsg(proto.CmdChallenge)))
 		}
-		return s.login(addr, args[0])
+		return s.challenge(addr, args[0])
+	case proto.CmdLogin:
+		switch len(args) {
+		case 1:
+			return s.login(addr, args[0], "", "")
+		case 2:
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeUnauthorized, "login proof required")))
+		case 3:
+			return s.login(addr, args[0], args[1], args[2])
+		}
+		return s.sendTo(addr, []byte(proto.BadArgsMsg(proto.CmdLogin)))
 	case proto.CmdLogout:
 		if len(args) != 1 {
 			return s.sendTo(addr, []byte(proto.BadArgsMsg(proto.CmdLogout)))
 		}
 		v, err := strconv.Atoi(args[0])
 		if err != nil {
-			return s.sendTo(addr, []byte(proto.FailureMsg(proto.CmdLogout, "id must be int")))
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogout, proto.CodeBadArgs, "id must be int")))
 		}
 		return s.logout(addr, v)
 	case proto.CmdGet:
@@ -142,7 +264,7 @@ func (s *Server) execCmd(addr *net.UDPAddr, cmd string, args ...string) error {
 		}
 		v, err := strconv.Atoi(args[0])
 		if err != nil {
-			return s.sendTo(addr, []byte(proto.FailureMsg(proto.CmdGet, "id must be int")))
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdGet, proto.CodeBadArgs, "id must be int")))
 		}
 		return s.getUserInfo(addr, v)
 	case proto.CmdPunch:
@@ -152,51 +274,165 @@ func (s *Server) execCmd(addr *net.UDPAddr, cmd string, args ...string) error {
 		v1, err1 := strconv.Atoi(args[0])
 		v2, err2 := strconv.Atoi(args[1])
 		if err1 != nil || err2 != nil {
-			return s.sendTo(addr, []byte(proto.FailureMsg(proto.CmdPunch, "id must be int")))
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdPunch, proto.CodeBadArgs, "id must be int")))
 		}
 		return s.punch(addr, v1, v2)
+	case proto.CmdCreate, proto.CmdJoin, proto.CmdLeave, proto.CmdMembers:
+		cmd = strings.ToLower(cmd)
+		if len(args) != 2 {
+			return s.sendTo(addr, []byte(proto.BadArgsMsg(cmd)))
+		}
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			return s.sendTo(addr, []byte(proto.ErrorMsg(cmd, proto.CodeBadArgs, "id must be int")))
+		}
+		switch cmd {
+		case proto.CmdCreate:
+			return s.createRoom(addr, args[0], v)
+		case proto.CmdJoin:
+			return s.joinRoom(addr, args[0], v)
+		case proto.CmdLeave:
+			return s.leaveRoom(addr, args[0], v)
+		default:
+			return s.getMembers(addr, args[0], v)
+		}
+	case proto.CmdRelay:
+		if len(args) < 3 {
+			return fmt.Errorf("bad relay args: %v", args)
+		}
+		v1, err1 := strconv.Atoi(args[0])
+		v2, err2 := strconv.Atoi(args[1])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("bad relay id: %v", args)
+		}
+		return s.relay(addr, v1, v2, strings.Join(args[2:], proto.ArgSplitChar))
+	case proto.CmdKey:
+		if len(args) != 2 {
+			return s.sendTo(addr, []byte(proto.BadArgsMsg(proto.CmdKey)))
+		}
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdKey, proto.CodeBadArgs, "id must be int")))
+		}
+		return s.getKey(addr, args[0], v)
+	case proto.CmdStore:
+		if len(args) != 3 {
+			return s.sendTo(addr, []byte(proto.BadArgsMsg(proto.CmdStore)))
+		}
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdStore, proto.CodeBadArgs, "id must be int")))
+		}
+		return s.storeOffline(addr, v, args[1], args[2])
+	case proto.CmdOfflineAck:
+		if len(args) != 2 {
+			return fmt.Errorf("bad offline ack args: %v", args)
+		}
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("bad offline ack id: %v", args)
+		}
+		return s.ackOffline(addr, v, args[1])
 	}
-	return nil
+	return errUnknownCmd
 }
 
 // checkClient 检查id是否存在，true存在，false不存在，如果不存在，给addr发送不存在的消息
 func (s *Server) checkClient(addr *net.UDPAddr, cmd string, id int) (bool, error) {
 	if _, ok := s.Clients.Load(id); !ok {
-		err := s.sendTo(addr, []byte(proto.FailureMsg(cmd, fmt.Sprintf("%d is not exists", id))))
+		err := s.sendTo(addr, []byte(proto.ErrorMsg(cmd, proto.CodeNotFound, fmt.Sprintf("%d is not exists", id))))
 		return false, err
 	}
 	return true, nil
 }
 
 // login 登录，保存用户信息
-// request: login name
-// response: login [OK userID]/[FAIL msg]
-func (s *Server) login(addr *net.UDPAddr, name string) error {
-	id := getID()
-	if _, ok := s.Clients.Load(id); ok {
-		return s.sendTo(addr, []byte(proto.FailureMsg(proto.CmdLogin, fmt.Sprintf("%d has exists\n", id))))
+// request: login name [pubkey proof]
+// response: login [OK userID token]/[FAIL msg]
+// 带了公钥的名字和公钥绑定，之后可以收离线消息，离线消息在心跳时推送
+// 带公钥登录要先challenge，proof证明持有私钥，见proto/auth.go
+// 同一个账号每次登录都是同一个ID，重新登录时替换旧的会话
+func (s *Server) login(addr *net.UDPAddr, name, key, proof string) error {
+	if !s.Limiters.Login.Allow(addr.IP.String()) {
+		s.Drops.Inc(DropLoginRate)
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeRateLimited, "too many logins")))
+	}
+
+	if s.draining() {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeUnavailable, "server shutting down")))
+	}
+
+	if s.Bans.NameBanned(name) {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeBanned, fmt.Sprintf("%s is banned", name))))
+	}
+
+	if key != "" && !s.verifyLogin(addr, name, key, proof) {
+		serverLog.Warn("bad login proof", "name", name, "addr", addr)
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeUnauthorized, "bad login proof")))
+	}
+
+	var id int
+	if key != "" {
+		a, err := s.bindAccount(name, key)
+		if errors.Is(err, errKeyConflict) {
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeConflict, err.Error())))
+		}
+		if err != nil {
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeInternal, err.Error())))
+		}
+		id = a.ID
+	} else {
+		// 绑定了公钥的名字只能带公钥登录，否则谁都能用这个名字发离线消息、进房间
+		if _, bound := s.account(name); bound {
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeUnauthorized, fmt.Sprintf("%s is bound to a key, login with key", name))))
+		}
+		var err error
+		if id, err = s.newID(); err != nil {
+			serverLog.Error("alloc id fail", "err", err)
+			return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeInternal, "alloc id fail")))
+		}
+	}
+
+	s.sessionLock.Lock()
+	_, existed := s.Clients.Load(id)
+	maxSessions := conf().Limits.MaxSessions
+	if !existed && maxSessions > 0 && atomic.LoadInt64(&s.sessions) >= int64(maxSessions) {
+		s.sessionLock.Unlock()
+		s.Drops.Inc(DropFull)
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLogin, proto.CodeUnavailable, "server is full")))
 	}
 
 	client := ClientInfo{
 		ID:      id,
 		Name:    name,
 		UDPAddr: addr,
+		Key:     key,
+		Token:   newToken(),
+
+		LastHeartbeatTime: time.Now().Unix(),
 	}
 	s.Clients.Store(id, &client)
-	log.Printf("Save client: %+v\n", client)
+	if !existed {
+		atomic.AddInt64(&s.sessions, 1)
+	}
+	s.sessionLock.Unlock()
+	s.saveSession(&client)
+	atomic.AddUint64(&s.Metrics.Logins, 1)
+	serverLog.Info("login", "id", id, "name", name, "addr", addr, "hasKey", len(key) > 0)
 
-	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdLogin, fmt.Sprintf("%d", id))))
+	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdLogin, fmt.Sprintf("%d %s", id, client.Token))))
 }
 
 // logout 登出
 // request：logout userID
 // response: logout [OK msg]/[FAIL msg]
 func (s *Server) logout(addr *net.UDPAddr, id int) error {
-	if ok, err := s.checkClient(addr, proto.CmdLogout, id); !ok {
+	if ok, err := s.checkClientAddr(addr, proto.CmdLogout, id); !ok {
 		return err
 	}
 
 	s.deleteClient(id)
+	atomic.AddUint64(&s.Metrics.Logouts, 1)
 
 	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdLogout, "")))
 }
@@ -221,12 +457,20 @@ func (s *Server) getUserInfo(addr *net.UDPAddr, id int) error {
 // user response: punch OK/FAIL msg
 // target msg: getpunch ip:port
 func (s *Server) punch(addr *net.UDPAddr, userID, targetID int) error {
-	if ok, err := s.checkClient(addr, proto.CmdPunch, userID); !ok {
+	if ok, err := s.checkClientAddr(addr, proto.CmdPunch, userID); !ok {
 		return err
 	}
 	if ok, err := s.checkClient(addr, proto.CmdPunch, targetID); !ok {
+		s.recordPunch(addr, userID, targetID, "target not exists")
 		return err
 	}
+	// 按请求者和目标限制打洞次数，防止利用服务器向别人的地址刷包；
+	// 不能只按目标限制，否则目标换了地址时所有打过洞的对端同时重新打洞，只有第一个能成功
+	if !s.Limiters.Punch.Allow(punchKey(userID, targetID)) {
+		s.Drops.Inc(DropPunchRate)
+		s.recordPunch(addr, userID, targetID, "rate limited")
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdPunch, proto.CodeRateLimited, fmt.Sprintf("too many punch requests to %d", targetID))))
+	}
 
 	userInfo, userOK := s.Clients.Load(userID)
 	targetInfo, targetOK := s.Clients.Load(targetID)
@@ -236,34 +480,129 @@ func (s *Server) punch(addr *net.UDPAddr, userID, targetID int) error {
 
 	err := s.sendTo(targetInfo.(*ClientInfo).UDPAddr, []byte(proto.Cmd(proto.CmdGetPunch, userInfo.(*ClientInfo).UDPAddr.String())))
 	if err != nil {
-		targetErr := s.sendTo(addr, []byte(proto.FailureMsg(proto.CmdPunch, fmt.Sprintf("send punch to %d fail", targetID))))
+		s.recordPunch(addr, userID, targetID, "send to target fail")
+		targetErr := s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdPunch, proto.CodeInternal, fmt.Sprintf("send punch to %d fail", targetID))))
 		return fmt.Errorf("send punch data to target fail: %+v, send to target err: %+v", err, targetErr)
 	}
+	s.Peers.Link(userID, targetID)
+	atomic.AddUint64(&s.Metrics.PunchRequests, 1)
+	s.recordPunch(addr, userID, targetID, ResultOK)
 
 	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdPunch, "")))
 }
 
-func (s *Server) checkHeartbeat() {
+func (s *Server) checkHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastExpire := time.Now().Unix()
 	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Now().Unix()-lastExpire > offlineExpireSec {
+			lastExpire = time.Now().Unix()
+			if n := s.Offline.Expire(); n > 0 {
+				offlineLog.Info("expired", "count", n)
+			}
+		}
+		timeout := int64(conf().Timeouts.Client.Seconds())
 		s.Clients.Range(func(key, value interface{}) bool {
-			if time.Now().Unix()-value.(*ClientInfo).LastHeartbeatTime > ClientTimeoutSec {
-				s.deleteClient(key.(int))
+			if s.expireClient(key.(int), value.(*ClientInfo), timeout) {
+				atomic.AddUint64(&s.Metrics.Evictions, 1)
 			}
 			return true
 		})
-		time.Sleep(time.Duration(1) * time.Second)
 	}
 }
 
 func (s *Server) deleteClient(id int) {
-	s.Clients.Delete(id)
-	log.Printf("deleted client: %d", id)
+	s.sessionLock.Lock()
+	if _, ok := s.Clients.LoadAndDelete(id); ok {
+		atomic.AddInt64(&s.sessions, -1)
+	}
+	s.sessionLock.Unlock()
+	s.cleanupClient(id)
+}
+
+// expireClient 心跳超时删除，返回是否删除
+// 检查和删除之间别的worker可能已经重新登录或者换了地址，存的不再是检查过的client时不删
+// 清理也在锁里做，否则会删掉刚登录的会话的存档和房间
+func (s *Server) expireClient(id int, client *ClientInfo, timeout int64) bool {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if time.Now().Unix()-atomic.LoadInt64(&client.LastHeartbeatTime) <= timeout || !s.Clients.CompareAndDelete(id, client) {
+		return false
+	}
+	atomic.AddInt64(&s.sessions, -1)
+	s.cleanupClient(id)
+	return true
+}
+
+func (s *Server) cleanupClient(id int) {
+	s.deleteSession(id)
+	s.Peers.Remove(id)
+	s.leaveAllRooms(id)
+	serverLog.Info("deleted client", "id", id)
 }
 
 func main() {
+	flag.Parse()
+	c := configFromFlags()
+	if len(*ConfigFile) > 0 {
+		var err error
+		if c, err = loadConfig(*ConfigFile, c); err != nil {
+			fatal("load config fail", "path", *ConfigFile, "err", err)
+		}
+	} else if err := c.Validate(); err != nil {
+		fatal("bad args", "err", err)
+	}
+	setConfig(c)
+	if err := openLog(c); err != nil {
+		fatal("open log fail", "err", err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", c.Listen.UDP)
+	if err != nil {
+		fatal("resolve listen addr fail", "addr", c.Listen.UDP, "err", err)
+	}
+	store, err := OpenStore(c.Store.Type, c.Store.Path)
+	if err != nil {
+		fatal("open store fail", "err", err)
+	}
+	defer store.Close()
+	offline, err := NewOfflineStore(store)
+	if err != nil {
+		fatal("load offline msgs fail", "err", err)
+	}
+	bans, err := NewBanList(store)
+	if err != nil {
+		fatal("load bans fail", "err", err)
+	}
 	server := Server{
-		Addr:    &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: *Port},
+		Addr:    addr,
 		Clients: new(sync.Map),
+		Rooms:   NewRoomManager(),
+		Offline: offline,
+		Store:   store,
+		Peers:   NewPeerGraph(),
+
+		Limiters: NewLimiters(c),
+		Drops:    new(DropStats),
+		Metrics:  new(Metrics),
+		Bans:     bans,
+		Punches:  NewPunchLog(),
+		Replies:  NewReplies(),
+
+		Challenges: NewChallenges(),
+		Kicked:     NewKickedList(),
+	}
+	if err := server.loadState(); err != nil {
+		fatal("load state fail", "err", err)
 	}
-	server.ListenAndServer()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server.ListenAndServer(ctx)
+	serverLog.Info("stopped")
 }
@@ -0,0 +1,152 @@
+// Prometheus指标，-metrics指定地址后通过HTTP的/metrics导出，文本格式自己拼，不引入依赖
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"udpdemo/proto"
+)
+
+var MetricsAddr = flag.String("metrics", "", "Prometheus指标的HTTP监听地址，比如:9100，为空不开启")
+
+const (
+	ResultOK    = "ok"
+	ResultFail  = "fail"
+	ResultError = "error" // 处理出错，比如回复发不出去
+)
+
+// requestCmds 客户端发给服务器的命令，其他的都算unknown，防止标签无限增长
+var requestCmds = map[string]bool{
+	proto.CmdChallenge: true, proto.CmdLogin: true, proto.CmdLogout: true, proto.CmdGet: true, proto.CmdPunch: true,
+	proto.CmdCreate: true, proto.CmdJoin: true, proto.CmdLeave: true, proto.CmdMembers: true,
+	proto.CmdRelay: true, proto.CmdKey: true, proto.CmdStore: true, proto.CmdOfflineAck: true,
+}
+
+// noReplyCmds 不回复的命令，处理没出错就算成功
+var noReplyCmds = map[string]bool{proto.CmdRelay: true, proto.CmdOfflineAck: true}
+
+type Metrics struct {
+	Logins        uint64
+	Logouts       uint64
+	Heartbeats    uint64
+	Evictions     uint64 // 心跳超时被删除的
+	PunchRequests uint64 // 转发给目标的打洞请求
+	RelayBytes    uint64
+	Retransmits   uint64 // 重复的请求，重发了缓存的回复
+	RecvErrors    uint64
+	SendErrors    uint64
+
+	commands sync.Map // "cmd result" -> *uint64
+}
+
+func (m *Metrics) command(cmd, result string) {
+	cmd = strings.ToLower(cmd)
+	if !requestCmds[cmd] {
+		cmd = "unknown"
+	}
+	key := cmd + " " + result
+	v, ok := m.commands.Load(key)
+	if !ok {
+		v, _ = m.commands.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// commandDone 处理完一条命令，回复的结果在sendTo里统计
+func (m *Metrics) commandDone(cmd string, err error) {
+	switch {
+	case err != nil:
+		m.command(cmd, ResultError)
+	case !requestCmds[strings.ToLower(cmd)]:
+		m.command(cmd, ResultFail)
+	case noReplyCmds[strings.ToLower(cmd)]:
+		m.command(cmd, ResultOK)
+	}
+}
+
+// response 统计发出去的 cmd OK/FAIL 回复
+func (m *Metrics) response(data []byte) {
+	segs := strings.SplitN(string(data), " ", 3)
+	if len(segs) < 2 || !requestCmds[segs[0]] {
+		return
+	}
+	switch segs[1] {
+	case proto.Success:
+		m.command(segs[0], ResultOK)
+	case proto.Failure:
+		m.command(segs[0], ResultFail)
+	}
+}
+
+func writeMetric(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeCounter(buf *bytes.Buffer, name, help string, counter *uint64) {
+	writeMetric(buf, name, "counter", help)
+	fmt.Fprintf(buf, "%s %d\n", name, atomic.LoadUint64(counter))
+}
+
+// writeMetrics Prometheus的文本格式
+func (s *Server) writeMetrics(buf *bytes.Buffer) {
+	m := s.Metrics
+	writeMetric(buf, "p2p_online_clients", "gauge", "Number of online client sessions.")
+	fmt.Fprintf(buf, "p2p_online_clients %d\n", atomic.LoadInt64(&s.sessions))
+	writeCounter(buf, "p2p_logins_total", "Successful logins.", &m.Logins)
+	writeCounter(buf, "p2p_logouts_total", "Successful logouts.", &m.Logouts)
+	writeCounter(buf, "p2p_heartbeats_total", "Heartbeats from known clients.", &m.Heartbeats)
+	writeCounter(buf, "p2p_evictions_total", "Clients removed after heartbeat timeout.", &m.Evictions)
+	writeCounter(buf, "p2p_punch_requests_total", "Punch requests forwarded to the target.", &m.PunchRequests)
+	writeCounter(buf, "p2p_relay_bytes_total", "Payload bytes relayed between clients.", &m.RelayBytes)
+	writeCounter(buf, "p2p_retransmitted_requests_total", "Duplicate requests answered from the reply cache.", &m.Retransmits)
+
+	writeMetric(buf, "p2p_datagram_errors_total", "counter", "Datagrams failed to receive or send.")
+	fmt.Fprintf(buf, "p2p_datagram_errors_total{op=\"recv\"} %d\n", atomic.LoadUint64(&m.RecvErrors))
+	fmt.Fprintf(buf, "p2p_datagram_errors_total{op=\"send\"} %d\n", atomic.LoadUint64(&m.SendErrors))
+
+	writeMetric(buf, "p2p_commands_total", "counter", "Commands handled by type and result.")
+	var keys []string
+	m.commands.Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, key := range keys {
+		v, _ := m.commands.Load(key)
+		segs := strings.SplitN(key, " ", 2)
+		fmt.Fprintf(buf, "p2p_commands_total{cmd=%q,result=%q} %d\n", segs[0], segs[1], atomic.LoadUint64(v.(*uint64)))
+	}
+
+	writeMetric(buf, "p2p_dropped_total", "counter", "Datagrams dropped by reason.")
+	stats := s.Drops.Snapshot()
+	reasons := make([]string, 0, len(stats))
+	for reason := range stats {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(buf, "p2p_dropped_total{reason=%q} %d\n", reason, stats[reason])
+	}
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	s.writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// listenMetrics 阻塞到ctx结束
+func (s *Server) listenMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	serveHTTP(ctx, addr, mux, metricsLog)
+}
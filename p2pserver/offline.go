@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"udpdemo/proto"
+)
+
+const (
+	maxOfflineMsgsPerUser = 100           // 每个人最多保存多少条离线消息，默认值，可以在配置文件里修改
+	offlineMsgTTL         = 7 * 24 * 3600 // 默认值
+	offlineRedeliverSec   = 5             // 推送之后多久没确认重发
+	offlineExpireSec      = 60
+)
+
+type OfflineMsg struct {
+	ID      string
+	From    string
+	To      string
+	Time    int64
+	Payload string
+
+	lastPush int64
+}
+
+// OfflineStore 离线消息，按接收者索引在内存，修改同时写到Store
+type OfflineStore struct {
+	lock  sync.Mutex
+	store Store
+
+	msgs map[string][]*OfflineMsg // to -> msgs
+}
+
+func NewOfflineStore(store Store) (*OfflineStore, error) {
+	o := &OfflineStore{
+		store: store,
+		msgs:  make(map[string][]*OfflineMsg),
+	}
+	err := store.ForEach(bucketOffline, func(key string, value []byte) error {
+		m := &OfflineMsg{}
+		if err := json.Unmarshal(value, m); err != nil {
+			return fmt.Errorf("bad offline msg %s: %v", key, err)
+		}
+		o.msgs[m.To] = append(o.msgs[m.To], m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, msgs := range o.msgs {
+		sort.Slice(msgs, func(i, j int) bool {
+			return msgs[i].Time < msgs[j].Time
+		})
+	}
+	return o, nil
+}
+
+var errInboxFull = errors.New("inbox is full")
+
+func (o *OfflineStore) Add(from, to, payload string) (*OfflineMsg, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if limit := conf().Limits.OfflinePerUser; limit > 0 && len(o.msgs[to]) >= limit {
+		return nil, fmt.Errorf("%s %w", to, errInboxFull)
+	}
+	id, err := nextSeq(o.store, "offlineID")
+	if err != nil {
+		return nil, err
+	}
+	m := &OfflineMsg{
+		ID:      strconv.Itoa(id),
+		From:    from,
+		To:      to,
+		Time:    time.Now().Unix(),
+		Payload: payload,
+	}
+	if err := o.store.Put(bucketOffline, m.ID, m); err != nil {
+		return nil, err
+	}
+	o.msgs[to] = append(o.msgs[to], m)
+	return m, nil
+}
+
+// Pending 需要推送的消息，推送过但还没超时的不返回
+func (o *OfflineStore) Pending(to string) []*OfflineMsg {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Now().Unix()
+	var msgs []*OfflineMsg
+	for _, m := range o.msgs[to] {
+		if now-m.lastPush < offlineRedeliverSec {
+			continue
+		}
+		m.lastPush = now
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func (o *OfflineStore) Ack(to, id string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	msgs := o.msgs[to]
+	for i, m := range msgs {
+		if m.ID != id {
+			continue
+		}
+		o.msgs[to] = append(msgs[:i:i], msgs[i+1:]...)
+		if len(o.msgs[to]) == 0 {
+			delete(o.msgs, to)
+		}
+		if err := o.store.Delete(bucketOffline, id); err != nil {
+			offlineLog.Error("delete fail", "msg", id, "err", err)
+		}
+		return true
+	}
+	return false
+}
+
+// Expire 删除过期的消息，返回删除的数量
+func (o *OfflineStore) Expire() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Now().Unix()
+	ttl := int64(conf().Timeouts.OfflineTTL.Seconds())
+	n := 0
+	for to, msgs := range o.msgs {
+		kept := msgs[:0]
+		for _, m := range msgs {
+			if now-m.Time > ttl {
+				if err := o.store.Delete(bucketOffline, m.ID); err != nil {
+					offlineLog.Error("delete fail", "msg", m.ID, "err", err)
+				}
+				n++
+				continue
+			}
+			kept = append(kept, m)
+		}
+		if len(kept) == 0 {
+			delete(o.msgs, to)
+		} else {
+			o.msgs[to] = kept
+		}
+	}
+	return n
+}
+
+// getKey 获取名字绑定的公钥
+// request: key name userID
+// response: key OK pubkey/FAIL msg
+func (s *Server) getKey(addr *net.UDPAddr, name string, userID int) error {
+	if ok, err := s.checkClientAddr(addr, proto.CmdKey, userID); !ok {
+		return err
+	}
+	a, ok := s.account(name)
+	if !ok {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdKey, proto.CodeNotFound, fmt.Sprintf("%s is not exists", name))))
+	}
+	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdKey, a.Key)))
+}
+
+// storeOffline 保存离线消息，接收者在线则立即推送
+// request: store userID name payload
+// response: store OK/FAIL msg
+func (s *Server) storeOffline(addr *net.UDPAddr, userID int, to, payload string) error {
+	if ok, err := s.checkClientAddr(addr, proto.CmdStore, userID); !ok {
+		return err
+	}
+	// 发送者的名字会作为From给接收者看，没有公钥的会话不能证明名字是自己的
+	client, ok := s.Clients.Load(userID)
+	if !ok {
+		return fmt.Errorf("store from deleted user %d", userID)
+	}
+	if client.(*ClientInfo).Key == "" {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdStore, proto.CodeUnauthorized, "login with key to send offline msg")))
+	}
+	if len(payload) > proto.MaxOfflinePayload {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdStore, proto.CodeTooLarge, "msg too long")))
+	}
+	if _, ok := s.account(to); !ok {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdStore, proto.CodeNotFound, fmt.Sprintf("%s is not exists", to))))
+	}
+	m, err := s.Offline.Add(client.(*ClientInfo).Name, to, payload)
+	if errors.Is(err, errInboxFull) {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdStore, proto.CodeUnavailable, err.Error())))
+	}
+	if err != nil {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdStore, proto.CodeInternal, err.Error())))
+	}
+	offlineLog.Info("stored", "msg", m.ID, "from", m.From, "to", m.To)
+	if err := s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdStore, ""))); err != nil {
+		return err
+	}
+
+	s.Clients.Range(func(key, value interface{}) bool {
+		if value.(*ClientInfo).Name == to {
+			s.deliverOffline(value.(*ClientInfo))
+		}
+		return true
+	})
+	return nil
+}
+
+// deliverOffline 推送还没确认的离线消息
+func (s *Server) deliverOffline(client *ClientInfo) {
+	if client.Key == "" {
+		return
+	}
+	for _, m := range s.Offline.Pending(client.Name) {
+		msg := proto.BuildOfflineMsg(&proto.OfflineMsg{MsgID: m.ID, From: m.From, Time: m.Time, Payload: m.Payload})
+		if err := s.sendTo(client.UDPAddr, []byte(msg)); err != nil {
+			offlineLog.Warn("deliver fail", "msg", m.ID, "err", err)
+		}
+	}
+}
+
+// ackOffline 接收者确认收到，删除消息
+// request: offlineack userID msgID
+func (s *Server) ackOffline(addr *net.UDPAddr, userID int, msgID string) error {
+	client, ok := s.Clients.Load(userID)
+	if !ok || client.(*ClientInfo).UDPAddr.String() != addr.String() || client.(*ClientInfo).Key == "" {
+		return fmt.Errorf("offline ack from bad user %d <%s>", userID, addr)
+	}
+	if !s.allowUser(userID) {
+		return fmt.Errorf("offline ack from %d rate limited", userID)
+	}
+	if s.Offline.Ack(client.(*ClientInfo).Name, msgID) {
+		offlineLog.Info("delivered", "msg", msgID, "to", client.(*ClientInfo).Name)
+	}
+	return nil
+}
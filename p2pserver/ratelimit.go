@@ -0,0 +1,202 @@
+// 限流，防止有人刷包：每个IP的包数、每个用户的命令数、每个IP的登录数、每对用户之间请求打洞的次数，以及会话总数
+package main
+
+import (
+	"context"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	IPRate      = flag.Float64("iprate", 50, "每个IP每秒最多处理多少个包")
+	UserRate    = flag.Float64("userrate", 20, "每个用户每秒最多处理多少条命令")
+	LoginRate   = flag.Float64("loginrate", 1, "每个IP每秒最多登录几次")
+	PunchRate   = flag.Float64("punchrate", 0.5, "每个用户每秒最多向同一个目标请求打洞几次，目标换了地址时打过洞的对端重新计数")
+	MaxSessions = flag.Int("maxsessions", 10000, "最多同时在线多少个会话")
+)
+
+const (
+	limiterBurstSec = 2 // 桶的容量是几秒的量
+	limiterIdleSec  = 60
+	dropsReportSec  = 60
+
+	DropIPRate    = "ip_rate"
+	DropUserRate  = "user_rate"
+	DropLoginRate = "login_rate"
+	DropPunchRate = "punch_rate"
+	DropFull      = "sessions_full"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter 按key的令牌桶，每秒补充rate个，最多攒burst个
+type Limiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func NewLimiter(rate float64) *Limiter {
+	l := &Limiter{buckets: make(map[string]*tokenBucket)}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate 修改速率，已有的桶按新的速率补充
+func (l *Limiter) SetRate(rate float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+	l.burst = rate * limiterBurstSec
+	if l.burst < 1 {
+		l.burst = 1
+	}
+}
+
+// Allow 拿一个令牌，没有了返回false，rate<=0不限制
+func (l *Limiter) Allow(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reset 删除key的桶，下次按满的桶算
+func (l *Limiter) Reset(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.buckets, key)
+}
+
+// Cleanup 删除很久没用的桶，已经补满的桶删掉和不存在是一样的
+func (l *Limiter) Cleanup() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for key, b := range l.buckets {
+		if time.Since(b.last) > limiterIdleSec*time.Second {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type Limiters struct {
+	IP    *Limiter
+	User  *Limiter
+	Login *Limiter
+	Punch *Limiter
+}
+
+func NewLimiters(c *Config) *Limiters {
+	return &Limiters{
+		IP:    NewLimiter(c.Limits.IPRate),
+		User:  NewLimiter(c.Limits.UserRate),
+		Login: NewLimiter(c.Limits.LoginRate),
+		Punch: NewLimiter(c.Limits.PunchRate),
+	}
+}
+
+func (l *Limiters) SetRates(c *Config) {
+	l.IP.SetRate(c.Limits.IPRate)
+	l.User.SetRate(c.Limits.UserRate)
+	l.Login.SetRate(c.Limits.LoginRate)
+	l.Punch.SetRate(c.Limits.PunchRate)
+}
+
+func (l *Limiters) Cleanup() {
+	for _, limiter := range []*Limiter{l.IP, l.User, l.Login, l.Punch} {
+		limiter.Cleanup()
+	}
+}
+
+// DropStats 各种原因丢弃的包数
+type DropStats struct {
+	counters sync.Map // reason -> *uint64
+}
+
+func (d *DropStats) Inc(reason string) {
+	v, ok := d.counters.Load(reason)
+	if !ok {
+		v, _ = d.counters.LoadOrStore(reason, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+func (d *DropStats) Snapshot() map[string]uint64 {
+	stats := make(map[string]uint64)
+	d.counters.Range(func(key, value interface{}) bool {
+		stats[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return stats
+}
+
+func (d *DropStats) String() string {
+	stats := d.Snapshot()
+	reasons := make([]string, 0, len(stats))
+	for reason := range stats {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	segs := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		segs = append(segs, reason+"="+strconv.FormatUint(stats[reason], 10))
+	}
+	return strings.Join(segs, " ")
+}
+
+// reportDrops 定期清理限流的桶、回复缓存、登录挑战和踢下线的记录，有丢包时打日志
+func (s *Server) reportDrops(ctx context.Context) {
+	ticker := time.NewTicker(dropsReportSec * time.Second)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.Limiters.Cleanup()
+		s.Replies.Expire()
+		s.Challenges.Expire()
+		s.Kicked.Expire()
+		if stats := s.Drops.String(); stats != last {
+			serverLog.Warn("dropped", "stats", stats)
+			last = stats
+		}
+	}
+}
+
+// allowUser 用户命令限流
+func (s *Server) allowUser(id int) bool {
+	if s.Limiters.User.Allow(strconv.Itoa(id)) {
+		return true
+	}
+	s.Drops.Inc(DropUserRate)
+	return false
+}
@@ -0,0 +1,107 @@
+// 请求ID和回复缓存：命令带了请求ID时回复也带上，并且缓存一段时间
+// 客户端没收到回复会用同一个ID重发，重复的请求直接重发缓存的回复，不会再执行一次（比如重复登录）
+// 同一个地址的包总是在同一个worker里按顺序处理，所以每个地址同时只有一个正在处理的请求
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"udpdemo/proto"
+)
+
+const replyCacheSec = 30 // 比客户端最长的重试时间长
+
+type pendingReq struct {
+	id  string
+	cmd string
+}
+
+type cachedReply struct {
+	data []byte
+	time int64
+}
+
+type Replies struct {
+	current sync.Map // addr -> pendingReq 正在处理的请求，每次发包都要查，不加锁
+
+	lock  sync.Mutex
+	cache map[string]*cachedReply // addr id -> 带ID的回复
+}
+
+func NewReplies() *Replies {
+	return &Replies{cache: make(map[string]*cachedReply)}
+}
+
+func replyKey(addr *net.UDPAddr, id string) string {
+	return addr.String() + " " + id
+}
+
+// Get 重复请求的回复，没有或者过期了返回false
+func (r *Replies) Get(addr *net.UDPAddr, id string) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	c, ok := r.cache[replyKey(addr, id)]
+	if !ok || time.Now().Unix()-c.time > replyCacheSec {
+		return nil, false
+	}
+	return c.data, true
+}
+
+// Begin 开始处理addr的请求，之后发给addr的cmd回复会带上ID
+func (r *Replies) Begin(addr *net.UDPAddr, id, cmd string) {
+	r.current.Store(addr.String(), pendingReq{id: id, cmd: strings.ToLower(cmd)})
+}
+
+func (r *Replies) End(addr *net.UDPAddr) {
+	r.current.Delete(addr.String())
+}
+
+// tag 是正在处理的请求的回复时加上ID并缓存，其他消息原样返回
+func (r *Replies) tag(addr *net.UDPAddr, data []byte) []byte {
+	v, ok := r.current.Load(addr.String())
+	if !ok {
+		return data
+	}
+	req := v.(pendingReq)
+	if !proto.IsResponseOf(data, req.cmd) {
+		return data
+	}
+	data = proto.WithRequestID(req.id, data)
+	r.lock.Lock()
+	r.cache[replyKey(addr, req.id)] = &cachedReply{data: data, time: time.Now().Unix()}
+	r.lock.Unlock()
+	return data
+}
+
+// Expire 删除过期的回复，返回删除的个数
+func (r *Replies) Expire() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now().Unix()
+	n := 0
+	for key, c := range r.cache {
+		if now-c.time > replyCacheSec {
+			delete(r.cache, key)
+			n++
+		}
+	}
+	return n
+}
+
+// resendReply 重复的请求，重发缓存的回复，返回false表示不是重复的请求
+func (s *Server) resendReply(addr *net.UDPAddr, id string) bool {
+	data, ok := s.Replies.Get(addr, id)
+	if !ok {
+		return false
+	}
+	atomic.AddUint64(&s.Metrics.Retransmits, 1)
+	if n, err := s.listener.WriteToUDP(data, addr); err != nil || n != len(data) {
+		atomic.AddUint64(&s.Metrics.SendErrors, 1)
+		serverLog.Warn("resend reply fail", "addr", addr, "id", id, "err", err)
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"udpdemo/proto"
+)
+
+// PeerGraph 记录谁和谁打过洞，地址变化时通知这些对端
+type PeerGraph struct {
+	lock  sync.Mutex
+	links map[int]map[int]struct{}
+}
+
+func NewPeerGraph() *PeerGraph {
+	return &PeerGraph{links: make(map[int]map[int]struct{})}
+}
+
+func (g *PeerGraph) Link(a, b int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, pair := range [][2]int{{a, b}, {b, a}} {
+		if _, ok := g.links[pair[0]]; !ok {
+			g.links[pair[0]] = make(map[int]struct{})
+		}
+		g.links[pair[0]][pair[1]] = struct{}{}
+	}
+}
+
+// Linked a和b之间是否请求过打洞
+func (g *PeerGraph) Linked(a, b int) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	_, ok := g.links[a][b]
+	return ok
+}
+
+func (g *PeerGraph) Remove(id int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for peer := range g.links[id] {
+		delete(g.links[peer], id)
+	}
+	delete(g.links, id)
+}
+
+func (g *PeerGraph) Peers(id int) []int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	peers := make([]int, 0, len(g.links[id]))
+	for peer := range g.links[id] {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// punchKey 打洞限流的key，按请求者和目标
+func punchKey(userID, targetID int) string {
+	return strconv.Itoa(userID) + ">" + strconv.Itoa(targetID)
+}
+
+// updateClientAddr 客户端换了公网地址，替换注册的地址并通知打过洞的对端重新打洞
+// 对端刚打过洞的话令牌还没补回来，重置它们的打洞限流，保证重新打洞不被拒绝
+// client已经被心跳超时删除或者被重新登录替换时返回nil，不能把旧的会话加回去
+func (s *Server) updateClientAddr(client *ClientInfo, addr *net.UDPAddr) *ClientInfo {
+	updated := *client
+	updated.UDPAddr = addr
+	updated.LastHeartbeatTime = time.Now().Unix()
+	if !s.Clients.CompareAndSwap(updated.ID, client, &updated) {
+		return nil
+	}
+	s.saveSession(&updated)
+	serverLog.Info("addr changed", "id", updated.ID, "old", client.UDPAddr, "new", addr)
+
+	msg := []byte(proto.BuildAddrChangeMsg(updated.ID, addr.String()))
+	for _, id := range s.Peers.Peers(updated.ID) {
+		s.Limiters.Punch.Reset(punchKey(id, updated.ID))
+		peer, ok := s.Clients.Load(id)
+		if !ok {
+			continue
+		}
+		if err := s.sendTo(peer.(*ClientInfo).UDPAddr, msg); err != nil {
+			serverLog.Warn("notify addr change fail", "id", id, "err", err)
+		}
+	}
+	return &updated
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"udpdemo/proto"
+)
+
+const (
+	maxRoomNameLen = 32
+
+	DropRelayDenied = "relay_denied"
+)
+
+type Room struct {
+	Name    string
+	Members map[int]struct{}
+}
+
+type RoomManager struct {
+	lock  sync.Mutex
+	rooms map[string]*Room
+}
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{rooms: make(map[string]*Room)}
+}
+
+// ShareRoom a和b是否在同一个房间里
+func (m *RoomManager) ShareRoom(a, b int) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, room := range m.rooms {
+		_, okA := room.Members[a]
+		_, okB := room.Members[b]
+		if okA && okB {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoomName 房间名会出现在以空格分隔的消息里
+func checkRoomName(name string) error {
+	if len(name) == 0 || len(name) > maxRoomNameLen || strings.ContainsAny(name, " :,") {
+		return fmt.Errorf("bad room name")
+	}
+	return nil
+}
+
+// checkClientAddr 检查id是否存在并且属于addr，防止冒用别人的ID
+func (s *Server) checkClientAddr(addr *net.UDPAddr, cmd string, id int) (bool, error) {
+	client, ok := s.Clients.Load(id)
+	if !ok {
+		err := s.sendTo(addr, []byte(proto.ErrorMsg(cmd, proto.CodeNotFound, fmt.Sprintf("%d is not exists", id))))
+		return false, err
+	}
+	if client.(*ClientInfo).UDPAddr.String() != addr.String() {
+		err := s.sendTo(addr, []byte(proto.ErrorMsg(cmd, proto.CodeUnauthorized, fmt.Sprintf("%d is not yours", id))))
+		return false, err
+	}
+	if !s.allowUser(id) {
+		err := s.sendTo(addr, []byte(proto.ErrorMsg(cmd, proto.CodeRateLimited, "rate limited")))
+		return false, err
+	}
+	return true, nil
+}
+
+// saveRoom 保存房间成员，没人了删除，需要持有锁
+func (s *Server) saveRoom(room *Room) {
+	var err error
+	if len(room.Members) == 0 {
+		err = s.Store.Delete(bucketRooms, room.Name)
+	} else {
+		ids := make([]int, 0, len(room.Members))
+		for id := range room.Members {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		err = s.Store.Put(bucketRooms, room.Name, ids)
+	}
+	if err != nil {
+		roomLog.Error("save fail", "room", room.Name, "err", err)
+	}
+}
+
+// roomMembers 房间成员的 ID -> 名字，需要持有锁
+func (s *Server) roomMembers(room *Room) map[int]string {
+	members := make(map[int]string)
+	for id := range room.Members {
+		if client, ok := s.Clients.Load(id); ok {
+			members[id] = client.(*ClientInfo).Name
+		}
+	}
+	return members
+}
+
+// pushRoomUpdate 通知房间里的所有人成员变化，需要持有锁
+func (s *Server) pushRoomUpdate(room *Room) {
+	members := s.roomMembers(room)
+	msg := []byte(proto.Cmd(proto.CmdRoomUpdate, room.Name, proto.BuildMembers(members)))
+	for id := range members {
+		client, ok := s.Clients.Load(id)
+		if !ok {
+			continue
+		}
+		if err := s.sendTo(client.(*ClientInfo).UDPAddr, msg); err != nil {
+			roomLog.Warn("push update fail", "room", room.Name, "id", id, "err", err)
+		}
+	}
+}
+
+// createRoom 创建房间，创建者自动加入
+// request: create room userID
+// response: create OK members/FAIL msg
+func (s *Server) createRoom(addr *net.UDPAddr, name string, userID int) error {
+	if ok, err := s.checkClientAddr(addr, proto.CmdCreate, userID); !ok {
+		return err
+	}
+	if err := checkRoomName(name); err != nil {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdCreate, proto.CodeBadArgs, err.Error())))
+	}
+
+	s.Rooms.lock.Lock()
+	defer s.Rooms.lock.Unlock()
+	if _, ok := s.Rooms.rooms[name]; ok {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdCreate, proto.CodeConflict, fmt.Sprintf("%s has exists", name))))
+	}
+	room := &Room{Name: name, Members: map[int]struct{}{userID: {}}}
+	s.Rooms.rooms[name] = room
+	s.saveRoom(room)
+	roomLog.Info("create", "room", name, "id", userID)
+
+	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdCreate, proto.BuildMembers(s.roomMembers(room)))))
+}
+
+// joinRoom 加入房间，通知其他成员
+// request: join room userID
+// response: join OK members/FAIL msg
+func (s *Server) joinRoom(addr *net.UDPAddr, name string, userID int) error {
+	if ok, err := s.checkClientAddr(addr, proto.CmdJoin, userID); !ok {
+		return err
+	}
+
+	s.Rooms.lock.Lock()
+	defer s.Rooms.lock.Unlock()
+	room, ok := s.Rooms.rooms[name]
+	if !ok {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdJoin, proto.CodeNotFound, fmt.Sprintf("%s is not exists", name))))
+	}
+	room.Members[userID] = struct{}{}
+	s.saveRoom(room)
+	roomLog.Info("join", "room", name, "id", userID)
+
+	if err := s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdJoin, proto.BuildMembers(s.roomMembers(room))))); err != nil {
+		return err
+	}
+	s.pushRoomUpdate(room)
+	return nil
+}
+
+// leaveRoom 离开房间，没人了就删除房间
+// request: leave room userID
+// response: leave OK/FAIL msg
+func (s *Server) leaveRoom(addr *net.UDPAddr, name string, userID int) error {
+	if ok, err := s.checkClientAddr(addr, proto.CmdLeave, userID); !ok {
+		return err
+	}
+
+	s.Rooms.lock.Lock()
+	room, ok := s.Rooms.rooms[name]
+	if !ok {
+		s.Rooms.lock.Unlock()
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdLeave, proto.CodeNotFound, fmt.Sprintf("%s is not exists", name))))
+	}
+	s.removeMember(room, userID)
+	s.Rooms.lock.Unlock()
+
+	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdLeave, "")))
+}
+
+// removeMember 需要持有锁
+func (s *Server) removeMember(room *Room, userID int) {
+	if _, ok := room.Members[userID]; !ok {
+		return
+	}
+	delete(room.Members, userID)
+	s.saveRoom(room)
+	roomLog.Info("leave", "room", room.Name, "id", userID)
+	if len(room.Members) == 0 {
+		delete(s.Rooms.rooms, room.Name)
+		roomLog.Info("deleted", "room", room.Name)
+		return
+	}
+	s.pushRoomUpdate(room)
+}
+
+// leaveAllRooms 客户端下线时调用
+func (s *Server) leaveAllRooms(userID int) {
+	s.Rooms.lock.Lock()
+	defer s.Rooms.lock.Unlock()
+	for _, room := range s.Rooms.rooms {
+		s.removeMember(room, userID)
+	}
+}
+
+// getMembers 获取房间成员
+// request: members room userID
+// response: members OK members/FAIL msg
+func (s *Server) getMembers(addr *net.UDPAddr, name string, userID int) error {
+	if ok, err := s.checkClientAddr(addr, proto.CmdMembers, userID); !ok {
+		return err
+	}
+
+	s.Rooms.lock.Lock()
+	defer s.Rooms.lock.Unlock()
+	room, ok := s.Rooms.rooms[name]
+	if !ok {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdMembers, proto.CodeNotFound, fmt.Sprintf("%s is not exists", name))))
+	}
+	if _, ok := room.Members[userID]; !ok {
+		return s.sendTo(addr, []byte(proto.ErrorMsg(proto.CmdMembers, proto.CodeUnauthorized, fmt.Sprintf("%d not in %s", userID, name))))
+	}
+	return s.sendTo(addr, []byte(proto.SuccessMsg(proto.CmdMembers, proto.BuildMembers(s.roomMembers(room)))))
+}
+
+// relay 中转消息给没有打洞成功的对端，不回复
+// 只中转给同一个房间的成员或者请求过打洞的对端，否则任何人都能借服务器给任意ID发消息
+// request: relay userID targetID payload
+// target msg: relayed userID payload
+func (s *Server) relay(addr *net.UDPAddr, userID, targetID int, payload string) error {
+	client, ok := s.Clients.Load(userID)
+	if !ok || client.(*ClientInfo).UDPAddr.String() != addr.String() {
+		return fmt.Errorf("relay from bad user %d <%s>", userID, addr)
+	}
+	if !s.allowUser(userID) {
+		return fmt.Errorf("relay from %d rate limited", userID)
+	}
+	if c := conf(); !c.Relay.Enabled {
+		return fmt.Errorf("relay is disabled")
+	} else if len(payload) > c.Relay.MaxPayload {
+		return fmt.Errorf("relay payload from %d too large: %d", userID, len(payload))
+	}
+	target, ok := s.Clients.Load(targetID)
+	if !ok {
+		return fmt.Errorf("relay target %d not found", targetID)
+	}
+	if !s.Peers.Linked(userID, targetID) && !s.Rooms.ShareRoom(userID, targetID) {
+		s.Drops.Inc(DropRelayDenied)
+		return fmt.Errorf("relay from %d to %d denied: no shared room or punch", userID, targetID)
+	}
+	if err := s.sendTo(target.(*ClientInfo).UDPAddr, []byte(proto.Cmd(proto.CmdRelayed, fmt.Sprintf("%d", userID), payload))); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.Metrics.RelayBytes, uint64(len(payload)))
+	return nil
+}
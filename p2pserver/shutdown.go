@@ -0,0 +1,69 @@
+// 优雅退出：收到SIGINT/SIGTERM后先进入drain，拒绝新的登录，通知所有客户端，
+// 等drain时间过后停止收包，处理完已经排队的请求再关闭存储
+// drain期间再收到一次信号直接退出
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"udpdemo/proto"
+)
+
+var DrainTime = flag.Duration("drain", 3*time.Second, "退出前等待客户端处理停止通知的时间")
+
+// draining 进入drain后不再接受登录
+func (s *Server) draining() bool {
+	return atomic.LoadInt32(&s.drain) == 1
+}
+
+// drainClients 通知所有客户端服务器要停止，返回通知到的客户端数
+func (s *Server) drainClients(wait time.Duration) int {
+	atomic.StoreInt32(&s.drain, 1)
+	msg := []byte(proto.BuildShutdownMsg(int(wait.Seconds())))
+	n := 0
+	s.Clients.Range(func(key, value interface{}) bool {
+		if err := s.sendTo(value.(*ClientInfo).UDPAddr, msg); err != nil {
+			serverLog.Warn("send shutdown fail", "id", key, "err", err)
+		} else {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// shutdown 等ctx结束后drain，然后让recvData返回
+func (s *Server) shutdown(ctx context.Context) {
+	<-ctx.Done()
+	// 恢复默认的信号处理，再收到信号直接退出
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	wait := conf().Timeouts.Drain.Duration
+	n := s.drainClients(wait)
+	serverLog.Info("draining", "clients", n, "wait", wait)
+	time.Sleep(wait)
+	// 读超时让收包循环退出，连接留到worker处理完再关
+	s.listener.SetReadDeadline(time.Now())
+}
+
+// serveHTTP 阻塞到ctx结束，出错时只打日志，不影响服务器
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, logger *slog.Logger) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	logger.Info("listen", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error("listen fail", "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,500 @@
+// 服务器状态的持久化：账号、ID分配、在线会话、房间、离线消息
+// 重启后恢复，客户端不需要重新登录，已经分配的ID也不会再被分配出去
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	StoreType = flag.String("store", "file", "状态存储：file/memory")
+	StorePath = flag.String("db", "./p2p-server.db", "file存储的文件路径")
+)
+
+const (
+	bucketMeta     = "meta"
+	bucketAccounts = "accounts"
+	bucketSessions = "sessions"
+	bucketRooms    = "rooms"
+	bucketOffline  = "offline"
+)
+
+// Store 按bucket和key保存JSON，实现需要并发安全
+type Store interface {
+	// Get 不存在返回false
+	Get(bucket, key string, v interface{}) (bool, error)
+	Put(bucket, key string, v interface{}) error
+	Delete(bucket, key string) error
+	// ForEach 遍历bucket，fn返回错误时停止
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+func OpenStore(typ, path string) (Store, error) {
+	switch typ {
+	case "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return openFileStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store type: %s", typ)
+	}
+}
+
+// memoryStore 只保存在内存，重启丢失
+type memoryStore struct {
+	lock    sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memoryStore) Get(bucket, key string, v interface{}) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	b, ok := m.buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+func (m *memoryStore) put(bucket, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.buckets[bucket]; !ok {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	m.buckets[bucket][key] = b
+	return nil
+}
+
+func (m *memoryStore) Put(bucket, key string, v interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.put(bucket, key, v)
+}
+
+func (m *memoryStore) Delete(bucket, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memoryStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	m.lock.RLock()
+	items := make(map[string][]byte, len(m.buckets[bucket]))
+	for k, v := range m.buckets[bucket] {
+		items[k] = v
+	}
+	m.lock.RUnlock()
+
+	for k, v := range items {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore 内存里保存全部数据，修改追加到日志文件，每storeFlushInterval刷一次盘
+// 登录、心跳换地址这些按包触发的写只是往缓冲区追加一行，崩溃时最多丢失最后一个间隔的修改
+// 日志里的记录比数据多很多时压缩：把当前数据写成新的日志，fsync之后rename覆盖
+type fileStore struct {
+	memoryStore
+	path    string
+	file    *os.File
+	w       *bufio.Writer
+	records int  // 日志里的记录数
+	dirty   bool // 有没刷盘的修改
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+const (
+	storeFlushInterval = time.Second
+	storeCompactMin    = 1024 // 日志至少有这么多条记录才压缩
+)
+
+// storeLogHeader 日志的第一行，没有这一行的是旧版本的整个JSON快照，打开时转换成日志
+const storeLogHeader = `{"format":"p2p-server-log","version":1}`
+
+const (
+	storeOpPut    = "put"
+	storeOpDelete = "del"
+)
+
+type storeRecord struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"b"`
+	Key    string          `json:"k"`
+	Value  json.RawMessage `json:"v,omitempty"`
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	f := &fileStore{
+		memoryStore: *newMemoryStore(),
+		path:        path,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err := f.load(b); err != nil {
+			return nil, fmt.Errorf("parse %s error: %v", path, err)
+		}
+	}
+	// 打开时总是重写一遍，去掉没写完的最后一行，旧的快照也转换成日志
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	go f.flushLoop()
+	return f, nil
+}
+
+// load 恢复日志或者旧版本的快照
+func (f *fileStore) load(b []byte) error {
+	if !bytes.HasPrefix(b, []byte(storeLogHeader+"\n")) {
+		var buckets map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(b, &buckets); err != nil {
+			return err
+		}
+		for name, bucket := range buckets {
+			f.buckets[name] = make(map[string][]byte, len(bucket))
+			for k, v := range bucket {
+				f.buckets[name][k] = v
+			}
+		}
+		return nil
+	}
+
+	lines := bytes.Split(b[len(storeLogHeader)+1:], []byte("\n"))
+	// 最后一段没有换行，是崩溃时没写完的记录，丢掉
+	for i, line := range lines[:len(lines)-1] {
+		var r storeRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("bad record at line %d: %v", i+2, err)
+		}
+		switch r.Op {
+		case storeOpPut:
+			if _, ok := f.buckets[r.Bucket]; !ok {
+				f.buckets[r.Bucket] = make(map[string][]byte)
+			}
+			f.buckets[r.Bucket][r.Key] = []byte(r.Value)
+		case storeOpDelete:
+			delete(f.buckets[r.Bucket], r.Key)
+		default:
+			return fmt.Errorf("bad record op at line %d: %s", i+2, r.Op)
+		}
+	}
+	if tail := lines[len(lines)-1]; len(tail) > 0 {
+		storeLog.Warn("drop incomplete record", "path", f.path, "size", len(tail))
+	}
+	return nil
+}
+
+func writeRecord(w io.Writer, r *storeRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// append 追加一条记录，需要持有锁
+func (f *fileStore) append(r *storeRecord) error {
+	if err := writeRecord(f.w, r); err != nil {
+		return err
+	}
+	f.records++
+	f.dirty = true
+	return nil
+}
+
+// compact 把当前数据写成新的日志替换旧的，需要持有锁
+// 先写临时文件并fsync，再rename覆盖，崩溃时文件要么是旧的要么是新的
+func (f *fileStore) compact() error {
+	dir := filepath.Dir(f.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	records := 0
+	_, err = w.WriteString(storeLogHeader + "\n")
+	for name, bucket := range f.buckets {
+		for k, v := range bucket {
+			if err != nil {
+				break
+			}
+			err = writeRecord(w, &storeRecord{Op: storeOpPut, Bucket: name, Key: k, Value: v})
+			records++
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	// rename之后目录也要sync，否则掉电可能丢失
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	// 旧日志缓冲区里没刷盘的修改已经在新日志里了
+	if f.file != nil {
+		f.file.Close()
+	}
+	if f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	f.w = bufio.NewWriter(f.file)
+	f.records = records
+	f.dirty = false
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (f *fileStore) flushLoop() {
+	defer close(f.done)
+	ticker := time.NewTicker(storeFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := f.flush(); err != nil {
+			storeLog.Error("flush fail", "path", f.path, "err", err)
+		}
+	}
+}
+
+// flush 把缓冲的记录写到文件并fsync，记录太多时压缩
+func (f *fileStore) flush() error {
+	f.lock.Lock()
+	if !f.dirty {
+		f.lock.Unlock()
+		return nil
+	}
+	if err := f.w.Flush(); err != nil {
+		f.lock.Unlock()
+		return err
+	}
+	f.dirty = false
+	file := f.file
+	f.lock.Unlock()
+	// fsync的时候不挡住别的写，文件只在这个循环里压缩时替换
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.records < storeCompactMin || f.records < 2*f.count() {
+		return nil
+	}
+	return f.compact()
+}
+
+// count 数据的条数，需要持有锁
+func (f *fileStore) count() int {
+	n := 0
+	for _, bucket := range f.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func (f *fileStore) Put(bucket, key string, v interface{}) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.put(bucket, key, v); err != nil {
+		return err
+	}
+	return f.append(&storeRecord{Op: storeOpPut, Bucket: bucket, Key: key, Value: f.buckets[bucket][key]})
+}
+
+func (f *fileStore) Delete(bucket, key string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(f.buckets[bucket], key)
+	return f.append(&storeRecord{Op: storeOpDelete, Bucket: bucket, Key: key})
+}
+
+// Close 停止定时刷盘，把剩下的记录写完
+func (f *fileStore) Close() error {
+	close(f.stop)
+	<-f.done
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.w.Flush()
+	if serr := f.file.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// nextSeq 自增计数器，调用者保证同一个name不会并发调用
+func nextSeq(store Store, name string) (int, error) {
+	var n int
+	if _, err := store.Get(bucketMeta, name, &n); err != nil {
+		return 0, err
+	}
+	n++
+	if err := store.Put(bucketMeta, name, n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Account 带公钥登录的名字，公钥和ID第一次登录时绑定，之后登录复用同一个ID
+type Account struct {
+	Name string
+	Key  string
+	ID   int
+}
+
+var errKeyConflict = errors.New("bound to another key")
+
+// bindAccount 没有账号时创建，有的话检查公钥
+func (s *Server) bindAccount(name, key string) (*Account, error) {
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+	a := &Account{}
+	ok, err := s.Store.Get(bucketAccounts, name, a)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if a.Key != key {
+			return nil, fmt.Errorf("%s is %w", name, errKeyConflict)
+		}
+		return a, nil
+	}
+
+	id, err := s.newID()
+	if err != nil {
+		return nil, err
+	}
+	a = &Account{Name: name, Key: key, ID: id}
+	return a, s.Store.Put(bucketAccounts, name, a)
+}
+
+func (s *Server) account(name string) (*Account, bool) {
+	a := &Account{}
+	ok, err := s.Store.Get(bucketAccounts, name, a)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return a, true
+}
+
+// newID 分配新的用户ID，重启后继续递增
+func (s *Server) newID() (int, error) {
+	s.idLock.Lock()
+	defer s.idLock.Unlock()
+	return nextSeq(s.Store, "clientID")
+}
+
+func (s *Server) saveSession(client *ClientInfo) {
+	if err := s.Store.Put(bucketSessions, strconv.Itoa(client.ID), client); err != nil {
+		storeLog.Error("save session fail", "id", client.ID, "err", err)
+	}
+}
+
+func (s *Server) deleteSession(id int) {
+	if err := s.Store.Delete(bucketSessions, strconv.Itoa(id)); err != nil {
+		storeLog.Error("delete session fail", "id", id, "err", err)
+	}
+}
+
+// loadState 恢复会话和房间，会话的心跳时间从现在开始算，没有继续心跳的按超时删除
+func (s *Server) loadState() error {
+	now := time.Now().Unix()
+	err := s.Store.ForEach(bucketSessions, func(key string, value []byte) error {
+		client := &ClientInfo{}
+		if err := json.Unmarshal(value, client); err != nil {
+			return fmt.Errorf("bad session %s: %v", key, err)
+		}
+		client.LastHeartbeatTime = now
+		s.Clients.Store(client.ID, client)
+		atomic.AddInt64(&s.sessions, 1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Store.ForEach(bucketRooms, func(key string, value []byte) error {
+		var ids []int
+		if err := json.Unmarshal(value, &ids); err != nil {
+			return fmt.Errorf("bad room %s: %v", key, err)
+		}
+		room := &Room{Name: key, Members: make(map[int]struct{}, len(ids))}
+		for _, id := range ids {
+			// 会话已经不在的成员不恢复
+			if _, ok := s.Clients.Load(id); ok {
+				room.Members[id] = struct{}{}
+			}
+		}
+		if len(room.Members) == 0 {
+			return s.Store.Delete(bucketRooms, key)
+		}
+		s.Rooms.rooms[key] = room
+		return nil
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestStore(t *testing.T, path string) *fileStore {
+	t.Helper()
+	f, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func expectValue(t *testing.T, s Store, bucket, key string, want int) {
+	t.Helper()
+	var v int
+	ok, err := s.Get(bucket, key, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want < 0 {
+		if ok {
+			t.Fatalf("%s/%s = %d, want deleted", bucket, key, v)
+		}
+		return
+	}
+	if !ok || v != want {
+		t.Fatalf("%s/%s = %d %v, want %d", bucket, key, v, ok, want)
+	}
+}
+
+// TestFileStoreReplay 关闭后重新打开，按日志恢复修改和删除
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	f := openTestStore(t, path)
+	f.Put("a", "1", 1)
+	f.Put("a", "2", 2)
+	f.Put("a", "1", 10)
+	f.Delete("a", "2")
+	f.Put("b", "x", 3)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f = openTestStore(t, path)
+	defer f.Close()
+	expectValue(t, f, "a", "1", 10)
+	expectValue(t, f, "a", "2", -1)
+	expectValue(t, f, "b", "x", 3)
+}
+
+// TestFileStoreCompact 反复覆盖同一个key，日志压缩后只剩一条
+func TestFileStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	f := openTestStore(t, path)
+	defer f.Close()
+	for i := 0; i < storeCompactMin; i++ {
+		f.Put("a", "1", i)
+	}
+	if err := f.flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.lock.RLock()
+	records := f.records
+	f.lock.RUnlock()
+	if records != 1 {
+		t.Fatalf("records %d after compact, want 1", records)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 2 {
+		t.Fatalf("log has %d lines, want 2", n)
+	}
+	expectValue(t, f, "a", "1", storeCompactMin-1)
+}
+
+// TestFileStoreLegacySnapshot 旧版本的整个JSON快照打开时转换成日志
+func TestFileStoreLegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	if err := ioutil.WriteFile(path, []byte(`{"a":{"1":1,"2":2}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := openTestStore(t, path)
+	expectValue(t, f, "a", "1", 1)
+	f.Delete("a", "1")
+	f.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(storeLogHeader+"\n")) {
+		t.Fatalf("not converted to log: %s", b)
+	}
+	f = openTestStore(t, path)
+	defer f.Close()
+	expectValue(t, f, "a", "1", -1)
+	expectValue(t, f, "a", "2", 2)
+}
+
+// TestFileStoreTornTail 崩溃时最后一行没写完，打开时丢掉这一行
+func TestFileStoreTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	f := openTestStore(t, path)
+	f.Put("a", "1", 1)
+	f.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"put","b":"a","k":"1","v":`)
+	file.Close()
+
+	f = openTestStore(t, path)
+	defer f.Close()
+	expectValue(t, f, "a", "1", 1)
+}
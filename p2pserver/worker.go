@@ -0,0 +1,96 @@
+// 收包和处理分开：收包的goroutine只负责读，按来源地址分给固定的worker处理
+// 同一个地址的包总是在同一个worker里按顺序处理，不同地址之间并发
+package main
+
+import (
+	"flag"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+var (
+	Workers   = flag.Int("workers", runtime.NumCPU(), "处理请求的worker数")
+	QueueSize = flag.Int("queue", 1024, "每个worker最多排队多少个包，满了丢弃")
+)
+
+const (
+	maxPacketSize = 2048
+
+	DropQueueFull = "queue_full"
+)
+
+// 每个包一个缓冲区，处理完放回去，不会被下一个包覆盖
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, maxPacketSize)
+		return &b
+	},
+}
+
+func getPacketBuf() *[]byte {
+	return packetPool.Get().(*[]byte)
+}
+
+func putPacketBuf(b *[]byte) {
+	if b != nil {
+		packetPool.Put(b)
+	}
+}
+
+// WorkerPool 固定数量的worker，每个worker一个有界队列
+type WorkerPool struct {
+	queues []chan UDPMsg
+	handle func(UDPMsg)
+	wg     sync.WaitGroup
+}
+
+func NewWorkerPool(workers, queueSize int, handle func(UDPMsg)) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WorkerPool{queues: make([]chan UDPMsg, workers), handle: handle}
+	for i := range p.queues {
+		p.queues[i] = make(chan UDPMsg, queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *WorkerPool) work(queue <-chan UDPMsg) {
+	defer p.wg.Done()
+	for msg := range queue {
+		p.handle(msg)
+		putPacketBuf(msg.buf)
+	}
+}
+
+// queueOf 按地址选worker，保证同一个客户端的包有序
+func (p *WorkerPool) queueOf(addr *net.UDPAddr) chan UDPMsg {
+	h := fnv.New32a()
+	h.Write(addr.IP)
+	h.Write([]byte(strconv.Itoa(addr.Port)))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// Dispatch 不阻塞，队列满了返回false，由调用者丢弃
+// 阻塞的话一个慢的worker会拖住所有客户端，不如让UDP丢包
+func (p *WorkerPool) Dispatch(msg UDPMsg) bool {
+	select {
+	case p.queueOf(msg.RemoteAddr) <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 不再接收新的包，等已经排队的处理完
+func (p *WorkerPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
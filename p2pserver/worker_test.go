@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"udpdemo/proto"
+)
+
+// newMemServer 内存存储，不限流，还没有监听
+func newMemServer(tb testing.TB) *Server {
+	store := newMemoryStore()
+	offline, err := NewOfflineStore(store)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	bans, err := NewBanList(store)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Server{
+		Clients: new(sync.Map),
+		Rooms:   NewRoomManager(),
+		Offline: offline,
+		Store:   store,
+		Peers:   NewPeerGraph(),
+
+		Limiters: &Limiters{IP: NewLimiter(0), User: NewLimiter(0), Login: NewLimiter(0), Punch: NewLimiter(0)},
+		Drops:    new(DropStats),
+		Metrics:  new(Metrics),
+		Bans:     bans,
+		Punches:  NewPunchLog(),
+		Replies:  NewReplies(),
+
+		Challenges: NewChallenges(),
+		Kicked:     NewKickedList(),
+	}
+}
+
+// newBenchServer 内存存储，不限流，clients个已登录的客户端
+func newBenchServer(b *testing.B, clients int) (*Server, []*net.UDPAddr) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+	s := newMemServer(b)
+	s.listener = listener
+
+	addrs := make([]*net.UDPAddr, clients)
+	for i := range addrs {
+		// 回复发到没人监听的端口，UDP不会报错
+		addrs[i] = &net.UDPAddr{IP: net.IPv4(127, 0, byte(i>>8), byte(i)), Port: 20000 + i%10000}
+		s.Clients.Store(i+1, &ClientInfo{
+			ID:                i + 1,
+			Name:              fmt.Sprintf("user%d", i+1),
+			UDPAddr:           addrs[i],
+			Token:             newToken(),
+			LastHeartbeatTime: time.Now().Unix(),
+		})
+	}
+	return s, addrs
+}
+
+// benchmarkHandle 模拟clients个客户端轮流发心跳，workers=1时相当于原来单goroutine处理
+func benchmarkHandle(b *testing.B, workers, clients int) {
+	log.SetOutput(ioutil.Discard)
+	s, addrs := newBenchServer(b, clients)
+	msgs := make([][]byte, clients)
+	for i := range msgs {
+		msgs[i] = []byte(proto.BuildHeartbeatMsg(i+1, ""))
+	}
+
+	pool := NewWorkerPool(workers, 1024, s.handleData)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := i % clients
+		buf := getPacketBuf()
+		n := copy(*buf, msgs[c])
+		msg := UDPMsg{Data: (*buf)[:n], RemoteAddr: addrs[c], buf: buf}
+		// 压测时不丢包，等worker空出来
+		for !pool.Dispatch(msg) {
+			runtime.Gosched()
+		}
+	}
+	pool.Close()
+}
+
+func BenchmarkHandleData(b *testing.B) {
+	for _, clients := range []int{1000, 5000} {
+		for _, workers := range []int{1, 8, 32} {
+			b.Run(fmt.Sprintf("clients=%d/workers=%d", clients, workers), func(b *testing.B) {
+				benchmarkHandle(b, workers, clients)
+			})
+		}
+	}
+}
+
+// 同一个地址的包按收到的顺序处理
+func TestWorkerPoolOrder(t *testing.T) {
+	const clients, packets = 100, 100
+	var lock sync.Mutex
+	got := make(map[string][]int)
+	pool := NewWorkerPool(8, clients*packets, func(msg UDPMsg) {
+		var seq int
+		fmt.Sscanf(string(msg.Data), "%d", &seq)
+		lock.Lock()
+		got[msg.RemoteAddr.String()] = append(got[msg.RemoteAddr.String()], seq)
+		lock.Unlock()
+	})
+	for seq := 0; seq < packets; seq++ {
+		for c := 0; c < clients; c++ {
+			addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(c)), Port: 10000 + c}
+			if !pool.Dispatch(UDPMsg{Data: []byte(fmt.Sprint(seq)), RemoteAddr: addr}) {
+				t.Fatalf("dispatch %d to %s fail", seq, addr)
+			}
+		}
+	}
+	pool.Close()
+
+	if len(got) != clients {
+		t.Fatalf("got %d clients, want %d", len(got), clients)
+	}
+	for addr, seqs := range got {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("%s: packet %d handled at %d", addr, seq, i)
+			}
+		}
+	}
+}
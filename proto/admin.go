@@ -0,0 +1,41 @@
+package proto
+
+import "strings"
+
+// 管理员通过服务器的admin接口发起的推送
+// notice text 广播通知，text可以带空格
+// kicked reason 被踢下线，客户端不再自动重新登录
+const (
+	CmdNotice = "notice"
+	CmdKicked = "kicked"
+)
+
+func BuildNoticeMsg(text string) string {
+	return Cmd(CmdNotice, text)
+}
+
+func BuildKickedMsg(reason string) string {
+	return Cmd(CmdKicked, reason)
+}
+
+// tryParseText 解析 cmd text 格式的推送
+func tryParseText(b []byte, cmd string) (bool, string, error) {
+	segs := strings.SplitN(string(b), CmdSplitChar, 2)
+	if segs[0] != cmd {
+		return false, "", nil
+	}
+	if len(segs) != 2 {
+		return true, "", malformed(cmd)
+	}
+	return true, segs[1], nil
+}
+
+// TryParseNoticeMsg 尝试解析通知，返回值：是否通知，内容，格式错误
+func TryParseNoticeMsg(b []byte) (bool, string, error) {
+	return tryParseText(b, CmdNotice)
+}
+
+// TryParseKickedMsg 尝试解析踢下线推送，返回值：是否踢下线，原因，格式错误
+func TryParseKickedMsg(b []byte) (bool, string, error) {
+	return tryParseText(b, CmdKicked)
+}
@@ -0,0 +1,25 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// 带公钥登录要证明持有私钥，否则知道别人公钥（key命令能查到）就能顶掉别人的账号
+// challenge name -> challenge OK serverPub，serverPub是服务器为这次登录生成的临时X25519公钥
+// login name pubkey proof，proof = hex(HMAC-SHA256(ECDH(私钥, serverPub), "name pubkey"))
+// 服务器用临时私钥和上报的公钥算出同样的共享密钥来校验，挑战只能用一次
+const CmdChallenge = "challenge"
+
+// LoginProof 登录证明，shared是客户端私钥和服务器临时公钥的ECDH结果
+func LoginProof(shared []byte, name, pubkey string) string {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(name + CmdSplitChar + pubkey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckLoginProof 常数时间比较
+func CheckLoginProof(shared []byte, name, pubkey, proof string) bool {
+	return hmac.Equal([]byte(LoginProof(shared, name, pubkey)), []byte(proof))
+}
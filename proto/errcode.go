@@ -0,0 +1,74 @@
+package proto
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 失败回复带错误码：cmd FAIL E404 msg，客户端按错误码判断，msg给人看
+// 错误码参考HTTP状态码，旧服务器的回复没有错误码，解析出来是CodeUnknown
+type ErrCode int
+
+const (
+	CodeUnknown         ErrCode = 0
+	CodeBadArgs         ErrCode = 400 // 参数个数或者格式不对
+	CodeUnauthorized    ErrCode = 401 // ID不属于发请求的地址
+	CodeBanned          ErrCode = 403
+	CodeNotFound        ErrCode = 404 // 用户、房间、账号不存在
+	CodeConflict        ErrCode = 409 // 已经存在，或者名字绑定了别的公钥
+	CodeTooLarge        ErrCode = 413
+	CodeVersionMismatch ErrCode = 426 // 服务器不认识的命令，客户端的协议比服务器新
+	CodeRateLimited     ErrCode = 429
+	CodeInternal        ErrCode = 500
+	CodeUnavailable     ErrCode = 503 // 服务器满了或者正在退出
+)
+
+const errCodePrefix = "E"
+
+var codeNames = map[ErrCode]string{
+	CodeUnknown:         "unknown",
+	CodeBadArgs:         "bad_args",
+	CodeUnauthorized:    "unauthorized",
+	CodeBanned:          "banned",
+	CodeNotFound:        "not_found",
+	CodeConflict:        "conflict",
+	CodeTooLarge:        "too_large",
+	CodeVersionMismatch: "version_mismatch",
+	CodeRateLimited:     "rate_limited",
+	CodeInternal:        "internal",
+	CodeUnavailable:     "unavailable",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrCode(%d)", int(c))
+}
+
+// ErrorMsg 带错误码的失败回复
+func ErrorMsg(cmd string, code ErrCode, msg string) string {
+	text := errCodePrefix + strconv.Itoa(int(code))
+	if len(msg) > 0 {
+		text += CmdSplitChar + msg
+	}
+	return FailureMsg(cmd, text)
+}
+
+// SplitErrCode 拆出失败回复内容开头的错误码，没有时返回CodeUnknown和原内容
+func SplitErrCode(data string) (ErrCode, string) {
+	segs := strings.SplitN(data, CmdSplitChar, 2)
+	head := segs[0]
+	if len(head) != len(errCodePrefix)+3 || !strings.HasPrefix(head, errCodePrefix) {
+		return CodeUnknown, data
+	}
+	n, err := strconv.Atoi(head[len(errCodePrefix):])
+	if err != nil || n < 100 {
+		return CodeUnknown, data
+	}
+	if len(segs) == 1 {
+		return ErrCode(n), ""
+	}
+	return ErrCode(n), segs[1]
+}
@@ -0,0 +1,42 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMalformed 所有解析失败的错误都是它，可以用errors.Is判断
+// 解析函数对任意输入都不会panic，收到的包不合法时返回错误
+var ErrMalformed = errors.New("malformed message")
+
+// ParseError 解析失败的消息类型和字段，Err是ErrMalformed或者strconv之类的底层错误
+type ParseError struct {
+	Kind  string // 消息类型，如heartbeat、punch
+	Field string // 出错的字段，整条消息格式不对时为空
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	if len(e.Field) == 0 {
+		return fmt.Sprintf("proto: bad %s msg: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("proto: bad %s msg %s: %v", e.Kind, e.Field, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParseError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+// malformed 整条消息格式不对
+func malformed(kind string) error {
+	return &ParseError{Kind: kind, Err: ErrMalformed}
+}
+
+// badField 某个字段不合法
+func badField(kind, field string, err error) error {
+	return &ParseError{Kind: kind, Field: field, Err: err}
+}
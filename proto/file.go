@@ -0,0 +1,120 @@
+package proto
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 文件传输消息，客户端之间直接发送
+// offer:  %file offer srcID fileID size sha256 name
+// accept: %file accept srcID fileID offset
+// reject: %file reject srcID fileID
+// chunk:  %file chunk srcID fileID offset base64data
+// ack:    %file ack srcID fileID offset
+// done:   %file done srcID fileID OK/FAIL
+const (
+	FileMsgPrefix = "%file"
+
+	FileOffer  = "offer"
+	FileAccept = "accept"
+	FileReject = "reject"
+	FileChunk  = "chunk"
+	FileAck    = "ack"
+	FileDone   = "done"
+
+	// FileChunkSize 每个分片的原始字节数，base64之后加上头部不超过一个UDP包
+	FileChunkSize = 1024
+)
+
+type FileMsg struct {
+	Type   string
+	SrcID  int
+	FileID string
+
+	Offset int64  // accept/chunk/ack
+	Size   int64  // offer
+	Hash   string // offer, sha256 hex
+	Name   string // offer
+	Data   []byte // chunk
+	Result bool   // done
+}
+
+func IsFileMsg(msg string) bool {
+	return strings.HasPrefix(msg, FileMsgPrefix+" ")
+}
+
+func BuildFileMsg(m *FileMsg) string {
+	head := []string{FileMsgPrefix, m.Type, strconv.Itoa(m.SrcID), m.FileID}
+	switch m.Type {
+	case FileOffer:
+		head = append(head, strconv.FormatInt(m.Size, 10), m.Hash, m.Name)
+	case FileAccept, FileAck:
+		head = append(head, strconv.FormatInt(m.Offset, 10))
+	case FileChunk:
+		head = append(head, strconv.FormatInt(m.Offset, 10), base64.StdEncoding.EncodeToString(m.Data))
+	case FileDone:
+		if m.Result {
+			head = append(head, Success)
+		} else {
+			head = append(head, Failure)
+		}
+	}
+	return strings.Join(head, " ")
+}
+
+func ParseFileMsg(msg string) (*FileMsg, error) {
+	segs := strings.SplitN(msg, " ", 4)
+	if len(segs) != 4 || segs[0] != FileMsgPrefix {
+		return nil, malformed("file")
+	}
+	srcID, err := strconv.Atoi(segs[2])
+	if err != nil {
+		return nil, badField("file", "src id", err)
+	}
+	m := &FileMsg{Type: segs[1], SrcID: srcID}
+
+	var args []string
+	switch m.Type {
+	case FileOffer:
+		args = strings.SplitN(segs[3], " ", 4)
+		if len(args) != 4 {
+			return nil, malformed("file offer")
+		}
+		if m.Size, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, badField("file offer", "size", err)
+		}
+		m.Hash = args[2]
+		m.Name = args[3]
+	case FileAccept, FileAck, FileChunk:
+		n := 2
+		if m.Type == FileChunk {
+			n = 3
+		}
+		args = strings.Split(segs[3], " ")
+		if len(args) != n {
+			return nil, malformed("file " + m.Type)
+		}
+		if m.Offset, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return nil, badField("file "+m.Type, "offset", err)
+		}
+		if m.Type == FileChunk {
+			if m.Data, err = base64.StdEncoding.DecodeString(args[2]); err != nil {
+				return nil, badField("file chunk", "data", err)
+			}
+		}
+	case FileReject:
+		args = []string{segs[3]}
+	case FileDone:
+		args = strings.Split(segs[3], " ")
+		if len(args) != 2 {
+			return nil, malformed("file done")
+		}
+		m.Result = args[1] == Success
+	default:
+		return nil, badField("file", "type", fmt.Errorf("unknown type %q", m.Type))
+	}
+	m.FileID = args[0]
+	return m, nil
+}
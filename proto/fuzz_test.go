@@ -0,0 +1,212 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 模糊测试：任意输入都不能panic，失败的返回ErrMalformed，成功的重新构造之后解析结果不变
+// go test -fuzz=FuzzParseHeartbeatMsg ./proto
+
+func checkMalformed(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrMalformed) {
+		t.Fatalf("error %v is not ErrMalformed", err)
+	}
+}
+
+func FuzzParseHeartbeatMsg(f *testing.F) {
+	for _, seed := range []string{"", "#", "#ping#", "#ping#1#", "#ping#1#token#", "#ping##", "#ping#1#a#b#"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		id, token, err := ParseHeartbeatMsg(msg)
+		if err != nil {
+			checkMalformed(t, err)
+			return
+		}
+		if strings.Contains(token, "#") {
+			t.Fatalf("token %q contains #", token)
+		}
+		id2, token2, err := ParseHeartbeatMsg(BuildHeartbeatMsg(id, token))
+		if err != nil || id2 != id || token2 != token {
+			t.Fatalf("rebuilt %d %q -> %d %q %v", id, token, id2, token2, err)
+		}
+	})
+}
+
+func FuzzParsePunchInfo(f *testing.F) {
+	for _, seed := range []string{"", "#", "$", "#hello#", "#hello#1#a#", "$world$1$a$", "$world$$", "#hello#1#a#b#"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		if id, name, err := ParsePunchReqInfo(msg); err != nil {
+			checkMalformed(t, err)
+		} else if id2, name2, err := ParsePunchReqInfo(BuildPunchReq(strconv.Itoa(id), name)); err != nil || id2 != id || name2 != name {
+			t.Fatalf("rebuilt req %d %q -> %d %q %v", id, name, id2, name2, err)
+		}
+		if id, name, err := ParsePunchReplyInfo(msg); err != nil {
+			checkMalformed(t, err)
+		} else if id2, name2, err := ParsePunchReplyInfo(BuildPunchReply(strconv.Itoa(id), name)); err != nil || id2 != id || name2 != name {
+			t.Fatalf("rebuilt reply %d %q -> %d %q %v", id, name, id2, name2, err)
+		}
+	})
+}
+
+// FuzzServerInput 和服务器收包的处理一样：心跳，或者带可选请求ID的命令
+func FuzzServerInput(f *testing.F) {
+	for _, seed := range []string{"", "@", "@1", "@1 ", "@1 login a", "@x get 1", "@123456789012345678901 get 1", "punch 1 2", "#ping#1#"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if IsHeartbeatMsg(string(b)) {
+			ParseHeartbeatMsg(string(b))
+			return
+		}
+		id, body := SplitRequestID(b)
+		if len(id) > 0 && !bytes.Equal(WithRequestID(id, body), b) {
+			t.Fatalf("split %q into %q %q", b, id, body)
+		}
+		cmd, args := ParseCmd(body)
+		if strings.Join(append([]string{cmd}, args...), CmdSplitChar) != string(body) {
+			t.Fatalf("parse cmd %q -> %q %q", body, cmd, args)
+		}
+	})
+}
+
+func FuzzParseServerResponse(f *testing.F) {
+	for _, seed := range []string{"", "x", "get OK", "get OK ", "get FAIL bad args", "get FAIL E404 not found", "get FAIL E400", "get FAIL E40x", "@7 get OK 1.2.3.4:5", "@7 OK", "getpunch 1.2.3.4:5"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp, err := ParseServerResponse(b)
+		if err != nil {
+			checkMalformed(t, err)
+			return
+		}
+		msg := []byte(ResponseMsg(resp.Cmd, resp.Data, resp.Result))
+		if resp.Code != CodeUnknown {
+			msg = []byte(ErrorMsg(resp.Cmd, resp.Code, resp.Data))
+		}
+		if len(resp.ReqID) > 0 {
+			msg = WithRequestID(resp.ReqID, msg)
+		}
+		resp2, err := ParseServerResponse(msg)
+		if err != nil || !reflect.DeepEqual(resp2, resp) {
+			t.Fatalf("rebuilt %+v -> %+v %v", resp, resp2, err)
+		}
+	})
+}
+
+func FuzzParseChatMsg(f *testing.F) {
+	for _, seed := range []string{"", "|", "1|", "1|hi", "x|hi", "1|a|b"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		id, text, err := ParseChatMsg(msg)
+		if err != nil {
+			checkMalformed(t, err)
+			return
+		}
+		id2, text2, err := ParseChatMsg(BuildChatMsg(id, text))
+		if err != nil || id2 != id || text2 != text {
+			t.Fatalf("rebuilt %d %q -> %d %q %v", id, text, id2, text2, err)
+		}
+	})
+}
+
+func FuzzParseMembers(f *testing.F) {
+	for _, seed := range []string{"", ",", ":", "1:a", "1:a,2:b", "1:a,", "x:a", "1:a:b"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		members, err := ParseMembers(text)
+		if err != nil {
+			checkMalformed(t, err)
+			return
+		}
+		members2, err := ParseMembers(BuildMembers(members))
+		if err != nil || !reflect.DeepEqual(members2, members) {
+			t.Fatalf("rebuilt %v -> %v %v", members, members2, err)
+		}
+	})
+}
+
+func FuzzParseGroupMsg(f *testing.F) {
+	for _, seed := range []string{"", "%group", "%group r m 1 3 a hi", "%group r m x 3 a hi", "%group      "} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		m, err := ParseGroupMsg(msg)
+		if err != nil {
+			checkMalformed(t, err)
+			return
+		}
+		m2, err := ParseGroupMsg(BuildGroupMsg(m))
+		if err != nil || !reflect.DeepEqual(m2, m) {
+			t.Fatalf("rebuilt %+v -> %+v %v", m, m2, err)
+		}
+	})
+}
+
+func FuzzParseFileMsg(f *testing.F) {
+	seeds := []string{
+		"", "%file", "%file offer 1 f 10 abc a b", "%file accept 1 f 0", "%file reject 1 f",
+		"%file chunk 1 f 0 aGk=", "%file chunk 1 f 0 !!", "%file ack 1 f 5", "%file done 1 f OK", "%file what 1 f",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		m, err := ParseFileMsg(msg)
+		if err != nil {
+			checkMalformed(t, err)
+			return
+		}
+		m2, err := ParseFileMsg(BuildFileMsg(m))
+		if err != nil || !reflect.DeepEqual(m2, m) {
+			t.Fatalf("rebuilt %+v -> %+v %v", m, m2, err)
+		}
+	})
+}
+
+// FuzzServerPush 客户端收到服务器的包时依次尝试的解析
+func FuzzServerPush(f *testing.F) {
+	seeds := []string{
+		"", "$pong$0$", "notice hi", "kicked", "shutdown 3", "shutdown -1", "getpunch 1.2.3.4:5",
+		"roomupdate r 1:a", "roomupdate r 1", "offline m a 1 p", "offline", "addrchange 1 a", "relayed 1 x", "#bye# 1",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// 是这种推送但是格式不对时返回ErrMalformed
+		for _, err := range []error{
+			errOfTry(TryParseNoticeMsg(b)),
+			errOfTry(TryParseKickedMsg(b)),
+			errOfTry(TryParsePunchMsg(b)),
+			errOf4(TryParseRoomUpdate(b)),
+			errOf4(TryParseAddrChange(b)),
+			errOf4(TryParseRelayMsg(b)),
+			errOf(ParseByeMsg(string(b))),
+		} {
+			if err != nil {
+				checkMalformed(t, err)
+			}
+		}
+		if ok, seconds, err := TryParseShutdownMsg(b); ok && err == nil && seconds < 0 {
+			t.Fatalf("negative shutdown %d", seconds)
+		} else if err != nil {
+			checkMalformed(t, err)
+		}
+		if ok, m, err := TryParseOfflineMsg(b); ok && err != nil {
+			checkMalformed(t, err)
+		} else if ok && m == nil {
+			t.Fatal("offline msg without error is nil")
+		}
+	})
+}
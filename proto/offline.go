@@ -0,0 +1,49 @@
+package proto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 离线消息，按名字发送，内容由客户端用接收者的公钥加密，服务器只负责保存和转交
+// login name pubkey proof 登录时上报公钥，名字第一次登录时和公钥绑定，要先challenge证明持有私钥，见auth.go
+// key name userID -> key OK pubkey
+// store userID name payload -> store OK / FAIL msg
+// 接收者登录后服务器推送 offline msgID fromName timestamp payload
+// 接收者收到后回复 offlineack userID msgID，不回复，没收到确认的服务器会重发
+const (
+	CmdKey        = "key"
+	CmdStore      = "store"
+	CmdOffline    = "offline"
+	CmdOfflineAck = "offlineack"
+
+	// MaxOfflinePayload 加密后base64的最大长度
+	MaxOfflinePayload = 768
+)
+
+type OfflineMsg struct {
+	MsgID   string
+	From    string
+	Time    int64
+	Payload string
+}
+
+func BuildOfflineMsg(m *OfflineMsg) string {
+	return Cmd(CmdOffline, m.MsgID, m.From, strconv.FormatInt(m.Time, 10), m.Payload)
+}
+
+// TryParseOfflineMsg 尝试解析离线消息推送
+func TryParseOfflineMsg(b []byte) (bool, *OfflineMsg, error) {
+	segs := strings.Split(string(b), CmdSplitChar)
+	if segs[0] != CmdOffline {
+		return false, nil, nil
+	}
+	if len(segs) != 5 {
+		return true, nil, malformed("offline")
+	}
+	t, err := strconv.ParseInt(segs[3], 10, 64)
+	if err != nil {
+		return true, nil, badField("offline", "time", err)
+	}
+	return true, &OfflineMsg{MsgID: segs[1], From: segs[2], Time: t, Payload: segs[4]}, nil
+}
@@ -2,7 +2,6 @@ package proto
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 )
@@ -10,7 +9,6 @@ import (
 const (
 	CmdSplitChar = " "
 	ArgSplitChar = " "
-	BadArgsHint  = "FAIL bad args"
 
 	CmdLogin    = "login"
 	CmdLogout   = "logout"
@@ -26,27 +24,40 @@ const (
 
 	Heartbeat      = "#ping#"
 	HeartbeatReply = "$pong$"
+	ReloginMsg     = "$relogin$" // 服务器不认识心跳里的ID，需要重新登录
+
+	MuxMsgPrefix = "%mux" // 后面跟mux帧，客户端之间的可靠流
 )
 
 func IsHeartbeatMsg(msg string) bool {
 	return strings.HasPrefix(msg, Heartbeat)
 }
 
-func BuildHeartbeatMsg(id int) string {
-	return fmt.Sprintf("%s%d#", Heartbeat, id)
+// BuildHeartbeatMsg #ping#id#token#，token为空时省略
+func BuildHeartbeatMsg(id int, token string) string {
+	if len(token) == 0 {
+		return fmt.Sprintf("%s%d#", Heartbeat, id)
+	}
+	return fmt.Sprintf("%s%d#%s#", Heartbeat, id, token)
 }
 
-func ParseHeartbeatMsg(msg string) int {
-	msg = msg[1 : len(msg)-1]
-	segs := strings.Split(msg, "#")
-	if len(segs) != 2 {
-		return 0
+// ParseHeartbeatMsg 返回ID和token，没带token时token为空
+func ParseHeartbeatMsg(msg string) (int, string, error) {
+	if len(msg) <= len(Heartbeat) || !strings.HasPrefix(msg, Heartbeat) || !strings.HasSuffix(msg, "#") {
+		return 0, "", malformed("heartbeat")
 	}
-	id, err := strconv.Atoi(segs[1])
+	segs := strings.Split(msg[len(Heartbeat):len(msg)-1], "#")
+	if len(segs) > 2 {
+		return 0, "", malformed("heartbeat")
+	}
+	id, err := strconv.Atoi(segs[0])
 	if err != nil {
-		return 0
+		return 0, "", badField("heartbeat", "id", err)
 	}
-	return id
+	if len(segs) == 2 {
+		return id, segs[1], nil
+	}
+	return id, "", nil
 }
 
 func BuildHeartbeatReply(id int) string {
@@ -57,6 +68,14 @@ func IsHeartbeatReply(msg string) bool {
 	return strings.HasPrefix(msg, HeartbeatReply)
 }
 
+func IsReloginMsg(msg string) bool {
+	return strings.HasPrefix(msg, ReloginMsg)
+}
+
+func IsMuxMsg(msg string) bool {
+	return strings.HasPrefix(msg, MuxMsgPrefix)
+}
+
 func IsPunchRequest(msg string) bool {
 	return strings.HasPrefix(msg, PunchRequest)
 }
@@ -73,34 +92,29 @@ func BuildPunchReply(args ...string) string {
 	return fmt.Sprintf("%s$%s$", PunchReply, strings.Join(args, "$"))
 }
 
-func parsePunchInfo(msg string, isReq bool) (int, string, error) {
-	var splitChar string
-	if isReq {
-		splitChar = "#"
-	} else {
-		splitChar = "$"
+// parsePunchInfo 解析 prefix sep id sep name sep，返回id和name
+func parsePunchInfo(msg, prefix, sep string) (int, string, error) {
+	head := prefix + sep
+	if len(msg) < len(head)+len(sep) || !strings.HasPrefix(msg, head) || !strings.HasSuffix(msg, sep) {
+		return 0, "", malformed("punch")
 	}
-
-	msg = msg[1 : len(msg)-1]
-	segs := strings.Split(msg, splitChar)
-	log.Printf("~~~~~~~~~~~%s ~~~ %+v", msg, segs)
-	if len(segs) != 3 {
-		return 0, "", fmt.Errorf("bad req")
+	segs := strings.Split(msg[len(head):len(msg)-len(sep)], sep)
+	if len(segs) != 2 {
+		return 0, "", malformed("punch")
 	}
-	id, err := strconv.Atoi(segs[1])
-	log.Printf("@@@@@@@@ %d %+v --- %s", id, err, segs[1])
+	id, err := strconv.Atoi(segs[0])
 	if err != nil {
-		return 0, "", err
+		return 0, "", badField("punch", "id", err)
 	}
-	return id, segs[2], nil
+	return id, segs[1], nil
 }
 
 func ParsePunchReqInfo(msg string) (int, string, error) {
-	return parsePunchInfo(msg, true)
+	return parsePunchInfo(msg, PunchRequest, "#")
 }
 
 func ParsePunchReplyInfo(msg string) (int, string, error) {
-	return parsePunchInfo(msg, false)
+	return parsePunchInfo(msg, PunchReply, "$")
 }
 
 func Cmd(cmd string, args ...string) string {
@@ -109,14 +123,13 @@ func Cmd(cmd string, args ...string) string {
 
 func ParseCmd(rawData []byte) (cmd string, args []string) {
 	segments := strings.Split(string(rawData), CmdSplitChar)
-	fmt.Printf("segments: %v\n", segments)
 	cmd = segments[0]
 	args = segments[1:]
 	return
 }
 
 func BadArgsMsg(cmd string) string {
-	return strings.Join([]string{cmd, BadArgsHint}, CmdSplitChar)
+	return ErrorMsg(cmd, CodeBadArgs, "bad args")
 }
 
 func ResponseMsg(cmd, msg string, isSuccess bool) string {
@@ -143,39 +156,46 @@ func FailureMsg(cmd, msg string) string {
 }
 
 type ServerResponse struct {
-	Cmd    string // login/logout/get/punch
-	Result bool   // OK->true/FAIL->false
-	Data   string
+	ReqID  string  // 请求ID，请求没带ID时为空
+	Cmd    string  // login/logout/get/punch
+	Result bool    // OK->true/FAIL->false
+	Code   ErrCode // 失败时的错误码，旧服务器没有错误码时为CodeUnknown
+	Data   string  // 失败时不含错误码
 }
 
 func ParseServerResponse(b []byte) (*ServerResponse, error) {
+	reqID, b := SplitRequestID(b)
 	resp := string(b)
 	segs := strings.SplitN(resp, CmdSplitChar, 3)
-	if len(segs) < 2 {
-		return nil, fmt.Errorf("bad server response")
+	if len(segs) < 2 || (segs[1] != Success && segs[1] != Failure) {
+		return nil, malformed("server response")
 	}
 	offset := len(segs[0]) + len(segs[1]) + 1
 	if len(resp) > offset {
 		offset++
 	}
-	return &ServerResponse{
+	r := &ServerResponse{
+		ReqID:  reqID,
 		Cmd:    segs[0],
 		Result: segs[1] == Success,
 		Data:   resp[offset:],
-	}, nil
+	}
+	if !r.Result {
+		r.Code, r.Data = SplitErrCode(r.Data)
+	}
+	return r, nil
 }
 
-// TryParsePunchMsg 尝试解析打洞消息，返回值： 是否打洞消息，打洞地址
-func TryParsePunchMsg(b []byte) (bool, string) {
-	resp := string(b)
-	segs := strings.Split(resp, CmdSplitChar)
-	if len(segs) != 2 {
-		return false, ""
+// TryParsePunchMsg 尝试解析打洞消息，返回值： 是否打洞消息，打洞地址，格式错误
+func TryParsePunchMsg(b []byte) (bool, string, error) {
+	segs := strings.Split(string(b), CmdSplitChar)
+	if segs[0] != CmdGetPunch {
+		return false, "", nil
 	}
-	if segs[0] == CmdGetPunch {
-		return true, segs[1]
+	if len(segs) != 2 {
+		return true, "", malformed("getpunch")
 	}
-	return false, ""
+	return true, segs[1], nil
 }
 
 func BuildChatMsg(srcID int, msg string) string {
@@ -185,11 +205,11 @@ func BuildChatMsg(srcID int, msg string) string {
 func ParseChatMsg(msg string) (int, string, error) {
 	segs := strings.SplitN(msg, "|", 2)
 	if len(segs) != 2 {
-		return 0, "", fmt.Errorf("split chat msg error")
+		return 0, "", malformed("chat")
 	}
 	id, err := strconv.Atoi(segs[0])
 	if err != nil {
-		return 0, "", fmt.Errorf("split chat msg atoi error: %v", err)
+		return 0, "", badField("chat", "id", err)
 	}
 	return id, segs[1], nil
 }
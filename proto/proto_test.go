@@ -0,0 +1,346 @@
+package proto
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// clean 去掉seps里的分隔符，空的换成x，用随机字符串生成合法的字段
+func clean(s, seps string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(seps, r) {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) == 0 {
+		return "x"
+	}
+	return s
+}
+
+func check(t *testing.T, f interface{}) {
+	t.Helper()
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeartbeatRoundTrip(t *testing.T) {
+	check(t, func(id int, token string, withToken bool) bool {
+		token = clean(token, "#")
+		if !withToken {
+			token = ""
+		}
+		msg := BuildHeartbeatMsg(id, token)
+		gotID, gotToken, err := ParseHeartbeatMsg(msg)
+		return IsHeartbeatMsg(msg) && err == nil && gotID == id && gotToken == token
+	})
+}
+
+func TestPunchRoundTrip(t *testing.T) {
+	check(t, func(id int, name string) bool {
+		req := BuildPunchReq(strconv.Itoa(id), clean(name, "#"))
+		reqID, reqName, err := ParsePunchReqInfo(req)
+		if !IsPunchRequest(req) || err != nil || reqID != id || reqName != clean(name, "#") {
+			return false
+		}
+		reply := BuildPunchReply(strconv.Itoa(id), clean(name, "$"))
+		replyID, replyName, err := ParsePunchReplyInfo(reply)
+		return IsPunchReply(reply) && err == nil && replyID == id && replyName == clean(name, "$")
+	})
+}
+
+func TestCmdRoundTrip(t *testing.T) {
+	check(t, func(cmd string, args []string) bool {
+		cmd = clean(cmd, " ")
+		args = append(args, "last")
+		for i := range args {
+			args[i] = clean(args[i], " ")
+		}
+		gotCmd, gotArgs := ParseCmd([]byte(Cmd(cmd, args...)))
+		return gotCmd == cmd && reflect.DeepEqual(gotArgs, args)
+	})
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	check(t, func(id uint64, withID bool, cmd, data string, ok bool) bool {
+		cmd = clean(cmd, " @")
+		msg := []byte(ResponseMsg(cmd, data, ok))
+		if !IsResponseOf(msg, cmd) {
+			return false
+		}
+		want := &ServerResponse{Cmd: cmd, Result: ok, Data: data}
+		if !ok {
+			want.Code, want.Data = SplitErrCode(data)
+		}
+		if withID {
+			want.ReqID = strconv.FormatUint(id, 10)
+			msg = WithRequestID(want.ReqID, msg)
+		}
+		resp, err := ParseServerResponse(msg)
+		return err == nil && reflect.DeepEqual(resp, want)
+	})
+}
+
+func TestErrorMsgRoundTrip(t *testing.T) {
+	check(t, func(code uint16, cmd, msg string) bool {
+		cmd = clean(cmd, " @")
+		c := ErrCode(100 + int(code)%900)
+		resp, err := ParseServerResponse([]byte(ErrorMsg(cmd, c, msg)))
+		return err == nil && !resp.Result && resp.Cmd == cmd && resp.Code == c && resp.Data == msg
+	})
+}
+
+func TestSplitErrCode(t *testing.T) {
+	cases := []struct {
+		data string
+		code ErrCode
+		msg  string
+	}{
+		{"E404 user not found", CodeNotFound, "user not found"},
+		{"E400", CodeBadArgs, ""},
+		{"E426 unknown command", CodeVersionMismatch, "unknown command"},
+		{"E999 new code", ErrCode(999), "new code"},
+		// 旧服务器没有错误码
+		{"bad args", CodeUnknown, "bad args"},
+		{"user not found", CodeUnknown, "user not found"},
+		{"", CodeUnknown, ""},
+		{"E40 x", CodeUnknown, "E40 x"},
+		{"E4040 x", CodeUnknown, "E4040 x"},
+		{"E099 x", CodeUnknown, "E099 x"},
+		{"E+40 x", CodeUnknown, "E+40 x"},
+		{"e404 x", CodeUnknown, "e404 x"},
+	}
+	for _, tc := range cases {
+		code, msg := SplitErrCode(tc.data)
+		if code != tc.code || msg != tc.msg {
+			t.Errorf("SplitErrCode(%q) = %v %q, want %v %q", tc.data, code, msg, tc.code, tc.msg)
+		}
+	}
+
+	resp, err := ParseServerResponse([]byte("get FAIL user not found"))
+	if err != nil || resp.Code != CodeUnknown || resp.Data != "user not found" {
+		t.Errorf("old server response parsed as %+v %v", resp, err)
+	}
+	if BadArgsMsg("get") != "get FAIL E400 bad args" {
+		t.Errorf("bad args msg %q", BadArgsMsg("get"))
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	check(t, func(id uint64, cmd string) bool {
+		gotID, body := SplitRequestID([]byte(BuildRequest(id, cmd)))
+		return gotID == strconv.FormatUint(id, 10) && string(body) == cmd
+	})
+}
+
+func TestChatRoundTrip(t *testing.T) {
+	check(t, func(id int, text string) bool {
+		gotID, gotText, err := ParseChatMsg(BuildChatMsg(id, text))
+		return err == nil && gotID == id && gotText == text
+	})
+}
+
+func TestAddrChangeRoundTrip(t *testing.T) {
+	check(t, func(id int, addr string) bool {
+		addr = clean(addr, " ")
+		ok, gotID, gotAddr, err := TryParseAddrChange([]byte(BuildAddrChangeMsg(id, addr)))
+		return ok && err == nil && gotID == id && gotAddr == addr
+	})
+}
+
+func TestShutdownRoundTrip(t *testing.T) {
+	check(t, func(seconds uint16) bool {
+		ok, got, err := TryParseShutdownMsg([]byte(BuildShutdownMsg(int(seconds))))
+		return ok && err == nil && got == int(seconds)
+	})
+}
+
+func TestByeRoundTrip(t *testing.T) {
+	check(t, func(id int) bool {
+		msg := BuildByeMsg(id)
+		got, err := ParseByeMsg(msg)
+		return IsByeMsg(msg) && err == nil && got == id
+	})
+}
+
+func TestAdminRoundTrip(t *testing.T) {
+	check(t, func(text string) bool {
+		ok, notice, err := TryParseNoticeMsg([]byte(BuildNoticeMsg(text)))
+		if !ok || err != nil || notice != text {
+			return false
+		}
+		ok, reason, err := TryParseKickedMsg([]byte(BuildKickedMsg(text)))
+		return ok && err == nil && reason == text
+	})
+}
+
+func TestGetPunchRoundTrip(t *testing.T) {
+	check(t, func(addr string) bool {
+		addr = clean(addr, " ")
+		ok, got, err := TryParsePunchMsg([]byte(Cmd(CmdGetPunch, addr)))
+		return ok && err == nil && got == addr
+	})
+}
+
+func TestRelayRoundTrip(t *testing.T) {
+	check(t, func(id int, text string) bool {
+		ok, gotID, payload, err := TryParseRelayMsg([]byte(Cmd(CmdRelayed, strconv.Itoa(id), text)))
+		return ok && err == nil && gotID == id && payload == text
+	})
+}
+
+// TestTryParseOther TryParse*遇到别的消息返回false，不报错
+func TestTryParseOther(t *testing.T) {
+	for _, msg := range []string{"", "punch OK", "notices x", "relay 1 2 x", "$pong$0$"} {
+		b := []byte(msg)
+		if ok, _, _, err := TryParseAddrChange(b); ok || err != nil {
+			t.Errorf("addrchange %q: %v %v", msg, ok, err)
+		}
+		if ok, _, err := TryParseShutdownMsg(b); ok || err != nil {
+			t.Errorf("shutdown %q: %v %v", msg, ok, err)
+		}
+		if ok, _, err := TryParseNoticeMsg(b); ok || err != nil {
+			t.Errorf("notice %q: %v %v", msg, ok, err)
+		}
+		if ok, _, err := TryParseKickedMsg(b); ok || err != nil {
+			t.Errorf("kicked %q: %v %v", msg, ok, err)
+		}
+		if ok, _, err := TryParsePunchMsg(b); ok || err != nil {
+			t.Errorf("getpunch %q: %v %v", msg, ok, err)
+		}
+		if ok, _, _, err := TryParseRoomUpdate(b); ok || err != nil {
+			t.Errorf("roomupdate %q: %v %v", msg, ok, err)
+		}
+		if ok, _, _, err := TryParseRelayMsg(b); ok || err != nil {
+			t.Errorf("relayed %q: %v %v", msg, ok, err)
+		}
+	}
+}
+
+func TestMembersRoundTrip(t *testing.T) {
+	check(t, func(members map[int]string, room string) bool {
+		for id, name := range members {
+			members[id] = clean(name, ",")
+		}
+		got, err := ParseMembers(BuildMembers(members))
+		if err != nil || !reflect.DeepEqual(got, members) {
+			return false
+		}
+		room = clean(room, " ")
+		ok, gotRoom, got, err := TryParseRoomUpdate([]byte(Cmd(CmdRoomUpdate, room, BuildMembers(members))))
+		return ok && err == nil && gotRoom == room && reflect.DeepEqual(got, members)
+	})
+}
+
+func TestGroupRoundTrip(t *testing.T) {
+	check(t, func(m GroupMsg) bool {
+		m.Room = clean(m.Room, " ")
+		m.MsgID = clean(m.MsgID, " ")
+		m.Name = clean(m.Name, " ")
+		msg := BuildGroupMsg(&m)
+		got, err := ParseGroupMsg(msg)
+		return IsGroupMsg(msg) && err == nil && reflect.DeepEqual(*got, m)
+	})
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	types := []string{FileOffer, FileAccept, FileReject, FileChunk, FileAck, FileDone}
+	check(t, func(typ uint8, srcID int, fileID, hash, name string, offset, size int64, data []byte, result bool) bool {
+		// 每种类型只带自己的字段
+		m := FileMsg{Type: types[int(typ)%len(types)], SrcID: srcID, FileID: clean(fileID, " ")}
+		switch m.Type {
+		case FileOffer:
+			m.Size, m.Hash, m.Name = size, clean(hash, " "), name
+		case FileAccept, FileAck:
+			m.Offset = offset
+		case FileChunk:
+			m.Offset, m.Data = offset, append([]byte{}, data...)
+		case FileDone:
+			m.Result = result
+		}
+		msg := BuildFileMsg(&m)
+		got, err := ParseFileMsg(msg)
+		return IsFileMsg(msg) && err == nil && reflect.DeepEqual(*got, m)
+	})
+}
+
+func TestOfflineRoundTrip(t *testing.T) {
+	check(t, func(m OfflineMsg) bool {
+		m.MsgID = clean(m.MsgID, " ")
+		m.From = clean(m.From, " ")
+		m.Payload = clean(m.Payload, " ")
+		ok, got, err := TryParseOfflineMsg([]byte(BuildOfflineMsg(&m)))
+		return ok && err == nil && reflect.DeepEqual(*got, m)
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"heartbeat one byte", errOf3(ParseHeartbeatMsg("#"))},
+		{"heartbeat no id", errOf3(ParseHeartbeatMsg("#ping##"))},
+		{"heartbeat too many", errOf3(ParseHeartbeatMsg("#ping#1#a#b#"))},
+		{"punch req one byte", errOf3(ParsePunchReqInfo("#"))},
+		{"punch req empty", errOf3(ParsePunchReqInfo("#hello#"))},
+		{"punch reply no name", errOf3(ParsePunchReplyInfo("$world$1$"))},
+		{"response", errOf(ParseServerResponse([]byte("x")))},
+		{"response not ok/fail", errOf(ParseServerResponse([]byte("getpunch 1.2.3.4:5")))},
+		{"chat", errOf3(ParseChatMsg("hello"))},
+		{"members", errOf(ParseMembers("1:a,b"))},
+		{"group", errOf(ParseGroupMsg("%group a b"))},
+		{"file", errOf(ParseFileMsg("%file what 1 x"))},
+		{"file offer", errOf(ParseFileMsg("%file offer 1 x"))},
+		{"addrchange no addr", errOf4(TryParseAddrChange([]byte("addrchange 1")))},
+		{"addrchange id", errOf4(TryParseAddrChange([]byte("addrchange x 1.2.3.4:5")))},
+		{"shutdown", errOfTry(TryParseShutdownMsg([]byte("shutdown")))},
+		{"shutdown negative", errOfTry(TryParseShutdownMsg([]byte("shutdown -1")))},
+		{"bye", errOf(ParseByeMsg("#bye# x"))},
+		{"notice", errOfTry(TryParseNoticeMsg([]byte("notice")))},
+		{"kicked", errOfTry(TryParseKickedMsg([]byte("kicked")))},
+		{"getpunch", errOfTry(TryParsePunchMsg([]byte("getpunch a b")))},
+		{"roomupdate", errOf4(TryParseRoomUpdate([]byte("roomupdate")))},
+		{"roomupdate members", errOf4(TryParseRoomUpdate([]byte("roomupdate r 1")))},
+		{"relayed", errOf4(TryParseRelayMsg([]byte("relayed 1")))},
+		{"relayed id", errOf4(TryParseRelayMsg([]byte("relayed x hi")))},
+	}
+	for _, tc := range cases {
+		if !errors.Is(tc.err, ErrMalformed) {
+			t.Errorf("%s: %v is not ErrMalformed", tc.name, tc.err)
+		}
+		var pe *ParseError
+		if !errors.As(tc.err, &pe) {
+			t.Errorf("%s: %v is not *ParseError", tc.name, tc.err)
+		}
+	}
+
+	// 数字字段的错误可以拿到strconv的错误
+	_, _, err := ParseChatMsg("x|hi")
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) || !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("chat id error %v does not wrap strconv error", err)
+	}
+}
+
+func errOf(_ interface{}, err error) error {
+	return err
+}
+
+func errOf3(_ int, _ string, err error) error {
+	return err
+}
+
+func errOfTry(_ bool, _ interface{}, err error) error {
+	return err
+}
+
+func errOf4(_ bool, _, _ interface{}, err error) error {
+	return err
+}
@@ -0,0 +1,54 @@
+package proto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 请求ID：客户端发给服务器的命令前面带上 @id，服务器的回复原样带回，客户端按ID匹配回复
+// @12 get 3 -> @12 get OK 1.2.3.4:5678
+// 没收到回复时客户端用同一个ID重发，服务器对重复的请求直接重发之前的回复
+// 没有ID的命令照常处理，回复也不带ID
+const (
+	ReqIDPrefix = "@"
+	maxReqIDLen = 20 // uint64的十进制长度
+)
+
+func BuildRequest(id uint64, cmd string) string {
+	return ReqIDPrefix + strconv.FormatUint(id, 10) + CmdSplitChar + cmd
+}
+
+// SplitRequestID 去掉开头的请求ID，返回ID和剩下的部分，没有ID或者ID不合法时ID为空，b原样返回
+func SplitRequestID(b []byte) (string, []byte) {
+	s := string(b)
+	if !strings.HasPrefix(s, ReqIDPrefix) {
+		return "", b
+	}
+	end := strings.Index(s, CmdSplitChar)
+	if end < 0 {
+		return "", b
+	}
+	id := s[len(ReqIDPrefix):end]
+	if len(id) == 0 || len(id) > maxReqIDLen {
+		return "", b
+	}
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", b
+	}
+	return id, b[end+len(CmdSplitChar):]
+}
+
+// WithRequestID 回复前面加上请求ID
+func WithRequestID(id string, msg []byte) []byte {
+	b := make([]byte, 0, len(ReqIDPrefix)+len(id)+len(CmdSplitChar)+len(msg))
+	b = append(b, ReqIDPrefix...)
+	b = append(b, id...)
+	b = append(b, CmdSplitChar...)
+	return append(b, msg...)
+}
+
+// IsResponseOf 是不是cmd的 OK/FAIL 回复
+func IsResponseOf(msg []byte, cmd string) bool {
+	s := string(msg)
+	return strings.HasPrefix(s, cmd+CmdSplitChar+Success) || strings.HasPrefix(s, cmd+CmdSplitChar+Failure)
+}
@@ -0,0 +1,31 @@
+package proto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 客户端公网地址变化（比如换了WiFi），服务器通过心跳发现后通知和它打过洞的对端
+// 服务器推送 addrchange userID ip:port，对端收到后重新打洞
+// 心跳带上登录时服务器给的token，地址变化的心跳必须token正确，防止冒用ID
+const CmdAddrChange = "addrchange"
+
+func BuildAddrChangeMsg(id int, addr string) string {
+	return Cmd(CmdAddrChange, strconv.Itoa(id), addr)
+}
+
+// TryParseAddrChange 尝试解析地址变化推送，返回值：是否推送，ID，新地址，格式错误
+func TryParseAddrChange(b []byte) (bool, int, string, error) {
+	segs := strings.Split(string(b), CmdSplitChar)
+	if segs[0] != CmdAddrChange {
+		return false, 0, "", nil
+	}
+	if len(segs) != 3 {
+		return true, 0, "", malformed("addrchange")
+	}
+	id, err := strconv.Atoi(segs[1])
+	if err != nil {
+		return true, 0, "", badField("addrchange", "id", err)
+	}
+	return true, id, segs[2], nil
+}
@@ -0,0 +1,131 @@
+package proto
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 群聊房间，由服务器维护成员，消息由客户端直接发给每个成员，没打洞的通过服务器中转
+// create/join/members room userID 回复 OK members，leave room userID 回复 OK
+// relay userID targetID payload 不回复，服务器给target发 relayed userID payload
+// 成员变化时服务器给房间里的所有人推送 roomupdate room members
+// members格式：id:name,id:name
+const (
+	CmdCreate     = "create"
+	CmdJoin       = "join"
+	CmdLeave      = "leave"
+	CmdMembers    = "members"
+	CmdRelay      = "relay"
+	CmdRelayed    = "relayed"
+	CmdRoomUpdate = "roomupdate"
+
+	// GroupMsgPrefix 群消息：%group room msgID srcID ttl name text
+	// 成员之间互相转发，ttl每转发一次减一，到1不再转发
+	GroupMsgPrefix = "%group"
+)
+
+func BuildMembers(members map[int]string) string {
+	ids := make([]int, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	segs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		segs = append(segs, fmt.Sprintf("%d:%s", id, members[id]))
+	}
+	return strings.Join(segs, ",")
+}
+
+func ParseMembers(text string) (map[int]string, error) {
+	members := make(map[int]string)
+	if len(text) == 0 {
+		return members, nil
+	}
+	for _, item := range strings.Split(text, ",") {
+		segs := strings.SplitN(item, ":", 2)
+		if len(segs) != 2 {
+			return nil, malformed("members")
+		}
+		id, err := strconv.Atoi(segs[0])
+		if err != nil {
+			return nil, badField("members", "id", err)
+		}
+		members[id] = segs[1]
+	}
+	return members, nil
+}
+
+// TryParseRoomUpdate 尝试解析成员变化推送，返回值：是否推送，房间名，成员，格式错误
+func TryParseRoomUpdate(b []byte) (bool, string, map[int]string, error) {
+	segs := strings.SplitN(string(b), CmdSplitChar, 3)
+	if segs[0] != CmdRoomUpdate {
+		return false, "", nil, nil
+	}
+	if len(segs) < 2 {
+		return true, "", nil, malformed("roomupdate")
+	}
+	text := ""
+	if len(segs) == 3 {
+		text = segs[2]
+	}
+	members, err := ParseMembers(text)
+	if err != nil {
+		return true, "", nil, badField("roomupdate", "members", err)
+	}
+	return true, segs[1], members, nil
+}
+
+// TryParseRelayMsg 尝试解析服务器中转的消息，返回值：是否中转消息，发送者ID，内容，格式错误
+func TryParseRelayMsg(b []byte) (bool, int, string, error) {
+	segs := strings.SplitN(string(b), CmdSplitChar, 3)
+	if segs[0] != CmdRelayed {
+		return false, 0, "", nil
+	}
+	if len(segs) != 3 {
+		return true, 0, "", malformed("relayed")
+	}
+	id, err := strconv.Atoi(segs[1])
+	if err != nil {
+		return true, 0, "", badField("relayed", "id", err)
+	}
+	return true, id, segs[2], nil
+}
+
+type GroupMsg struct {
+	Room  string
+	MsgID string
+	SrcID int
+	TTL   int
+	Name  string // 发送者的名字
+	Text  string
+}
+
+func IsGroupMsg(msg string) bool {
+	return strings.HasPrefix(msg, GroupMsgPrefix+" ")
+}
+
+func BuildGroupMsg(m *GroupMsg) string {
+	return strings.Join([]string{
+		GroupMsgPrefix, m.Room, m.MsgID, strconv.Itoa(m.SrcID), strconv.Itoa(m.TTL), m.Name, m.Text,
+	}, " ")
+}
+
+func ParseGroupMsg(msg string) (*GroupMsg, error) {
+	segs := strings.SplitN(msg, " ", 7)
+	if len(segs) != 7 || segs[0] != GroupMsgPrefix {
+		return nil, malformed("group")
+	}
+	id, err := strconv.Atoi(segs[3])
+	if err != nil {
+		return nil, badField("group", "src id", err)
+	}
+	ttl, err := strconv.Atoi(segs[4])
+	if err != nil {
+		return nil, badField("group", "ttl", err)
+	}
+	return &GroupMsg{Room: segs[1], MsgID: segs[2], SrcID: id, TTL: ttl, Name: segs[5], Text: segs[6]}, nil
+}
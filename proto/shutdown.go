@@ -0,0 +1,58 @@
+package proto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// 退出时的通知
+// shutdown seconds 服务器推送，seconds秒后停止，期间不再接受登录，重启后客户端通过心跳自动重新登录
+// #bye# id 客户端退出时发给打过洞的对端，对端删除和它的连接
+const (
+	CmdShutdown = "shutdown"
+	PeerBye     = "#bye#"
+)
+
+func BuildShutdownMsg(seconds int) string {
+	return Cmd(CmdShutdown, strconv.Itoa(seconds))
+}
+
+// TryParseShutdownMsg 尝试解析停止推送，返回值：是否推送，多少秒后停止，格式错误
+func TryParseShutdownMsg(b []byte) (bool, int, error) {
+	segs := strings.Split(string(b), CmdSplitChar)
+	if segs[0] != CmdShutdown {
+		return false, 0, nil
+	}
+	if len(segs) != 2 {
+		return true, 0, malformed("shutdown")
+	}
+	seconds, err := strconv.Atoi(segs[1])
+	if err != nil {
+		return true, 0, badField("shutdown", "seconds", err)
+	}
+	if seconds < 0 {
+		return true, 0, badField("shutdown", "seconds", ErrMalformed)
+	}
+	return true, seconds, nil
+}
+
+func BuildByeMsg(id int) string {
+	return Cmd(PeerBye, strconv.Itoa(id))
+}
+
+func IsByeMsg(msg string) bool {
+	return strings.HasPrefix(msg, PeerBye)
+}
+
+// ParseByeMsg 返回退出的对端ID
+func ParseByeMsg(msg string) (int, error) {
+	segs := strings.Split(msg, CmdSplitChar)
+	if len(segs) != 2 || segs[0] != PeerBye {
+		return 0, malformed("bye")
+	}
+	id, err := strconv.Atoi(segs[1])
+	if err != nil {
+		return 0, badField("bye", "id", err)
+	}
+	return id, nil
+}